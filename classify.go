@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// namePattern matches bank or subsong names either with a shell glob or, when
+// prefixed with "re:", with a regular expression
+type namePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// compileNamePattern parses a glob or "re:" regular expression
+func compileNamePattern(pattern string) (*namePattern, error) {
+	if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", expr, err)
+		}
+		return &namePattern{re: re}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	return &namePattern{glob: pattern}, nil
+}
+
+// match reports whether name matches the pattern. A nil pattern matches everything.
+func (p *namePattern) match(name string) bool {
+	if p == nil {
+		return true
+	}
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+// classificationRule sends banks, or individual subsongs, whose names match to
+// a category path below the output directory
+type classificationRule struct {
+	Bank     string `json:"bank"`
+	Subsong  string `json:"subsong,omitempty"`
+	Category string `json:"category"`
+
+	bank    *namePattern
+	subsong *namePattern
+}
+
+// rulesFile is the layout of the file passed to --rules
+type rulesFile struct {
+	Rules []classificationRule `json:"rules"`
+}
+
+// fallbackCategory is used when no rule matches
+const fallbackCategory = "Other"
+
+var (
+	rulesPath           string
+	classificationRules = defaultClassificationRules()
+)
+
+// defaultClassificationRules sorts banks by their Music_ and SFX_ prefixes
+func defaultClassificationRules() []classificationRule {
+	rules := []classificationRule{
+		{Bank: "Music_*", Category: "Music"},
+		{Bank: "SFX_*", Category: "SFX"},
+		{Bank: "*", Category: fallbackCategory},
+	}
+	if err := compileRules(rules); err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// loadClassificationRules reads an ordered rule list from a JSON file
+func loadClassificationRules(path string) ([]classificationRule, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	var file rulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("%s contains no rules", path)
+	}
+	if err := compileRules(file.Rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return file.Rules, nil
+}
+
+// compileRules compiles the patterns of every rule and validates its category
+func compileRules(rules []classificationRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Bank == "" {
+			rule.Bank = "*"
+		}
+		var err error
+		if rule.bank, err = compileNamePattern(rule.Bank); err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		if rule.Subsong != "" {
+			if rule.subsong, err = compileNamePattern(rule.Subsong); err != nil {
+				return fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		}
+
+		category := path.Clean(filepath.ToSlash(rule.Category))
+		if rule.Category == "" || category == "." || path.IsAbs(category) || category == ".." || strings.HasPrefix(category, "../") {
+			return fmt.Errorf("rule %d: category %q must be a relative path inside the output directory", i+1, rule.Category)
+		}
+		rule.Category = category
+	}
+	return nil
+}
+
+// classifyBank returns the category of the first bank-level rule matching the bank name
+func classifyBank(bankName string) string {
+	for _, rule := range classificationRules {
+		if rule.subsong == nil && rule.bank.match(bankName) {
+			return rule.Category
+		}
+	}
+	return fallbackCategory
+}
+
+// classifySubsong returns the category of the first rule matching the bank
+// and subsong name. Subsong rules listed before a bank's own rule move single
+// subsongs out of the bank's category.
+func classifySubsong(bankName, subsongName string) string {
+	for _, rule := range classificationRules {
+		if !rule.bank.match(bankName) {
+			continue
+		}
+		if rule.subsong == nil || (subsongName != "" && rule.subsong.match(subsongName)) {
+			return rule.Category
+		}
+	}
+	return fallbackCategory
+}
+
+// ruleCategories lists every category the rules can produce, in rule order
+func ruleCategories() []string {
+	seen := make(map[string]bool)
+	categories := []string{}
+	for _, rule := range append(classificationRules, classificationRule{Category: fallbackCategory}) {
+		if !seen[rule.Category] {
+			seen[rule.Category] = true
+			categories = append(categories, rule.Category)
+		}
+	}
+	return categories
+}
+
+// routeOutputFiles assigns every output file its directory from the
+// classification rules and the layout, and moves files that belong somewhere
+// else than the bank's own directory out of it
+func routeOutputFiles(task *bankTask, files []outputFile) error {
+	result := &task.result
+	bankName := strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile))
+	bankRel := relOutputDir(result.OutputDir)
+
+	prepared := map[string]bool{bankRel: true}
+	for i := range files {
+		category := classifySubsong(bankName, streamName(*result, files[i].Subsong))
+		dir, err := layoutDir(category, bankName, files[i].Tags)
+		if err != nil {
+			return err
+		}
+		files[i].Dir = dir
+		if files[i].Dir == bankRel {
+			continue
+		}
+
+		target := filepath.Join(outputDir, filepath.FromSlash(files[i].Dir))
+		if task.stageDir != "" {
+			target = stagingDir(target)
+		}
+		if !prepared[files[i].Dir] {
+			// Clear whatever an interrupted run left in the staging directory
+			if task.stageDir != "" {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+			if err := os.MkdirAll(target, 0750); err != nil {
+				return err
+			}
+			prepared[files[i].Dir] = true
+		}
+		if err := os.Rename(filepath.Join(task.workDir(), files[i].Name), filepath.Join(target, files[i].Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relOutputDir returns dir relative to the output directory with forward slashes
+func relOutputDir(dir string) string {
+	rel, err := filepath.Rel(outputDir, dir)
+	if err != nil {
+		return filepath.ToSlash(dir)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// outputDirs returns every directory below the output directory the bank writes to
+func outputDirs(task *bankTask) []string {
+	dirs := []string{relOutputDir(task.result.OutputDir)}
+	seen := map[string]bool{dirs[0]: true}
+	for _, file := range task.result.Files {
+		if file.Dir != "" && !seen[file.Dir] {
+			seen[file.Dir] = true
+			dirs = append(dirs, file.Dir)
+		}
+		// With --images-tree the images are in a directory of their own
+		for _, image := range []string{file.Waveform, file.Spectrogram} {
+			if dir := path.Dir(image); image != "" && !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+// streamName returns the stream name of a subsong, or "" if it is unknown
+func streamName(result bankResult, subsong int) string {
+	stream, _ := findStream(result, subsong)
+	return stream.Name
+}
+
+// findStream returns the metadata of a subsong, if vgmstream reported it
+func findStream(result bankResult, subsong int) (streamInfo, bool) {
+	for _, stream := range result.Streams {
+		if stream.Index == subsong {
+			return stream, true
+		}
+	}
+	return streamInfo{}, false
+}
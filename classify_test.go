@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNamePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matches bool
+	}{
+		{"Music_*", "Music_Prairie", true},
+		{"Music_*", "SFX_Prairie", false},
+		{"*_Amb?", "Forest_Amb1", true},
+		{"re:(?i)^sfx_ui", "SFX_UI_Menu", true},
+		{"re:^Voice", "SFX_Voice", false},
+	}
+	for _, test := range tests {
+		pattern, err := compileNamePattern(test.pattern)
+		if err != nil {
+			t.Fatalf("Failed to compile %q: %v", test.pattern, err)
+		}
+		if got := pattern.match(test.name); got != test.matches {
+			t.Errorf("%q matching %q: expected %v, got %v", test.pattern, test.name, test.matches, got)
+		}
+	}
+
+	for _, invalid := range []string{"[", "re:("} {
+		if _, err := compileNamePattern(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestDefaultClassification(t *testing.T) {
+	tests := map[string]string{
+		"Music_Prairie": "Music",
+		"SFX_Creature":  "SFX",
+		"Ambience_Cave": "Other",
+		"music_lower":   "Other",
+	}
+	for bank, expected := range tests {
+		if got := classifyBank(bank); got != expected {
+			t.Errorf("classifyBank(%q): expected %s, got %s", bank, expected, got)
+		}
+	}
+	categories := ruleCategories()
+	if len(categories) != 3 || categories[0] != "Music" || categories[1] != "SFX" || categories[2] != "Other" {
+		t.Errorf("Unexpected default categories: %v", categories)
+	}
+}
+
+func TestLoadClassificationRules(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	path := filepath.Join(tempDir, "rules.json")
+	content := `{"rules": [
+		{"bank": "*", "subsong": "re:^vo_", "category": "Voice"},
+		{"bank": "re:^SFX_UI", "category": "SFX/UI"},
+		{"bank": "SFX_*", "category": "SFX"},
+		{"bank": "*_Amb*", "category": "Ambience/"},
+		{"category": "Misc"}
+	]}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+
+	rules, err := loadClassificationRules(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+	originalRules := classificationRules
+	classificationRules = rules
+	defer func() { classificationRules = originalRules }()
+
+	bankTests := map[string]string{
+		"SFX_UI_Menu":  "SFX/UI",
+		"SFX_Creature": "SFX",
+		"Forest_Amb":   "Ambience",
+		"Unknown":      "Misc",
+	}
+	for bank, expected := range bankTests {
+		if got := classifyBank(bank); got != expected {
+			t.Errorf("classifyBank(%q): expected %s, got %s", bank, expected, got)
+		}
+	}
+	if got := classifySubsong("SFX_Creature", "vo_elder"); got != "Voice" {
+		t.Errorf("Expected the voice subsong rule to win, got %s", got)
+	}
+	if got := classifySubsong("SFX_Creature", "roar"); got != "SFX" {
+		t.Errorf("Expected other subsongs to stay with the bank, got %s", got)
+	}
+
+	for _, invalid := range []string{
+		`{"rules": []}`,
+		`{"rules": [{"bank": "[", "category": "X"}]}`,
+		`{"rules": [{"bank": "*", "category": "../outside"}]}`,
+		`{"rules": [{"bank": "*"}]}`,
+		`not json`,
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatalf("Failed to write rules: %v", err)
+		}
+		if _, err := loadClassificationRules(path); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestProcessBankFilesRoutesSubsongs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalInputDir, originalOutputDir := inputDir, outputDir
+	inputDir, outputDir = filepath.Join(tempDir, "in"), filepath.Join(tempDir, "out")
+	defer func() { inputDir, outputDir = originalInputDir, originalOutputDir }()
+
+	originalExecCommand, originalRules := execCommand, classificationRules
+	defer func() { execCommand, classificationRules = originalExecCommand, originalRules }()
+	execCommand = fakeExecCommand("HELPER_STREAM_TOTAL=3", "HELPER_WRITE_FILES=3")
+
+	classificationRules = []classificationRule{
+		{Bank: "*", Subsong: "stream2", Category: "Ambience"},
+		{Bank: "SFX_*", Category: "SFX/Creatures"},
+	}
+	if err := compileRules(classificationRules); err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	if err := os.MkdirAll(inputDir, 0750); err != nil {
+		t.Fatalf("Failed to create input dir: %v", err)
+	}
+	bankFile := filepath.Join(inputDir, "SFX_Birds.bank")
+	if err := os.WriteFile(bankFile, []byte("FSB5"), 0600); err != nil {
+		t.Fatalf("Failed to write bank file: %v", err)
+	}
+
+	result := processBankFilesConcurrently([]string{bankFile}, 2)[0]
+	if result.Error != "" || result.Extracted != 3 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	if result.OutputDir != filepath.Join(outputDir, "SFX", "Creatures", "SFX_Birds") {
+		t.Errorf("Unexpected bank dir: %s", result.OutputDir)
+	}
+
+	expected := map[string]string{
+		"01_stream1.wav": filepath.Join(outputDir, "SFX", "Creatures", "SFX_Birds"),
+		"02_stream2.wav": filepath.Join(outputDir, "Ambience", "SFX_Birds"),
+		"03_stream3.wav": filepath.Join(outputDir, "SFX", "Creatures", "SFX_Birds"),
+	}
+	for name, dir := range expected {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s in %s: %v", name, dir, err)
+		}
+	}
+	if dirExists(filepath.Join(outputDir, stagingDirName, "Ambience", "SFX_Birds")) {
+		t.Errorf("Expected the routed staging directory to be committed")
+	}
+}
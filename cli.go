@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of the CLI with its own flags and help
+type command struct {
+	name    string
+	usage   string
+	summary string
+	flags   func(fs *flag.FlagSet)
+	run     func(fs *flag.FlagSet) error
+}
+
+// commands lists the subcommands in the order the help shows them
+var commands = []command{
+	{"extract", "[options]", "Extract every bank in the input directory (the default when no command is given)", registerExtractFlags, runExtract},
+	{"list", "[options] [bank...]", "List the banks in the input directory with their category and stream count", registerListFlags, runList},
+	{"info", "[options] bank...", "Show the streams of a bank: names, sample rate, channels, duration and loop points", registerInfoFlags, runInfo},
+	{"verify", "[options]", "Check the files in the output directory against their bank manifests", registerVerifyFlags, runVerify},
+	{"diff", "[options] old-dir new-dir", "Compare two output directories, e.g. before and after a game update", registerDiffFlags, runDiff},
+	{"serve", "[options]", "Browse the output directory in a web browser", registerServeFlags, runServe},
+	{"version", "", "Print the version", func(*flag.FlagSet) {}, runVersion},
+}
+
+// configOptions is the full set of options a config file may contain, even
+// when the command being run only uses some of them
+var configOptions *flag.FlagSet
+
+func main() {
+	configOptions = flag.NewFlagSet("config", flag.ContinueOnError)
+	registerExtractFlags(configOptions)
+
+	cmd, args := selectCommand(os.Args[1:])
+	if cmd == nil {
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	fs := newCommandFlagSet(*cmd)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		os.Exit(2)
+	}
+	if err := cmd.run(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
+
+// selectCommand picks the subcommand from the first argument. Invocations
+// that start with a flag, or have no arguments at all, run extract as before
+// subcommands existed.
+func selectCommand(args []string) (*command, []string) {
+	if len(args) == 0 {
+		return findCommand("extract"), args
+	}
+	switch first := args[0]; {
+	case first == "--version" || first == "-version":
+		return findCommand("version"), args[1:]
+	case first == "help" || first == "-h" || first == "--help":
+		if len(args) > 1 && findCommand(args[1]) != nil {
+			return findCommand(args[1]), []string{"-h"}
+		}
+		printUsage(os.Stdout)
+		os.Exit(0)
+	case strings.HasPrefix(first, "-"):
+		return findCommand("extract"), args
+	}
+	if cmd := findCommand(args[0]); cmd != nil {
+		return cmd, args[1:]
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	return nil, nil
+}
+
+// findCommand returns the subcommand called name, or nil
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// newCommandFlagSet creates the flag set of a subcommand with its help text
+func newCommandFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cmd.flags(fs)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s %s\n\n%s.\n", os.Args[0], cmd.name, cmd.usage, cmd.summary)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(out, "\nOptions:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// printUsage prints the list of subcommands
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [options]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun \"%s help <command>\" for the options of a command. Without a command, %s runs extract.\n", os.Args[0], os.Args[0])
+}
+
+// setupConsoleLogging sends log output of the inspection commands to stderr
+// when verbose, and nowhere otherwise, without creating the log file
+func setupConsoleLogging() {
+	out := io.Discard
+	if verbose {
+		out = os.Stderr
+	}
+	log.SetOutput(out)
+	fileLogger = log.New(out, "", log.LstdFlags)
+	summaryLogger = log.New(os.Stderr, "", 0)
+}
+
+// runVersion prints the version
+func runVersion(*flag.FlagSet) error {
+	fmt.Printf("SKY-FSBEXT version: %s by %s\n", version, author)
+	return nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	listStreams bool
+	infoJSON    bool
+	serveAddr   string
+)
+
+// registerInspectFlags registers the options shared by the commands that read banks
+func registerInspectFlags(fs *flag.FlagSet) {
+	fs.StringVar(&vgmstreamPath, "p", filepath.Join("vgmstream-win64", "vgmstream-cli.exe"), "Path to vgmstream-cli executable.")
+	fs.StringVar(&vgmstreamPath, "vgmstream-path", filepath.Join("vgmstream-win64", "vgmstream-cli.exe"), "Path to vgmstream-cli executable.")
+	fs.BoolVar(&verbose, "v", false, "Enable verbose output.")
+	fs.BoolVar(&verbose, "verbose", false, "Enable verbose output.")
+	fs.StringVar(&configPath, "config", "", "Path to a JSON config file.")
+}
+
+// registerListFlags registers the options of the list command
+func registerListFlags(fs *flag.FlagSet) {
+	registerInspectFlags(fs)
+	fs.StringVar(&inputDir, "i", "in", "Path to the input directory.")
+	fs.StringVar(&inputDir, "input-dir", "in", "Path to the input directory.")
+	fs.StringVar(&rulesPath, "rules", "", "Path to a JSON file with ordered rules that sort banks into categories.")
+	fs.BoolVar(&listStreams, "streams", false, "Also list the streams of every bank.")
+}
+
+// registerInfoFlags registers the options of the info command
+func registerInfoFlags(fs *flag.FlagSet) {
+	registerInspectFlags(fs)
+	fs.BoolVar(&infoJSON, "json", false, "Print the stream metadata as JSON.")
+}
+
+// registerVerifyFlags registers the options of the verify command
+func registerVerifyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&outputDir, "o", "out", "Path to the output directory.")
+	fs.StringVar(&outputDir, "output-dir", "out", "Path to the output directory.")
+	fs.StringVar(&configPath, "config", "", "Path to a JSON config file.")
+}
+
+// registerDiffFlags registers the options of the diff command
+func registerDiffFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", "", "Path to a JSON config file.")
+}
+
+// registerServeFlags registers the options of the serve command
+func registerServeFlags(fs *flag.FlagSet) {
+	fs.StringVar(&outputDir, "o", "out", "Path to the output directory.")
+	fs.StringVar(&outputDir, "output-dir", "out", "Path to the output directory.")
+	fs.StringVar(&configPath, "config", "", "Path to a JSON config file.")
+	fs.StringVar(&serveAddr, "addr", "127.0.0.1:8080", "Address to listen on.")
+}
+
+// loadRulesOption loads the classification rules given with --rules or inline
+// in the config file
+func loadRulesOption() error {
+	if rulesPath != "" {
+		rules, err := loadClassificationRules(rulesPath)
+		if err != nil {
+			return err
+		}
+		classificationRules = rules
+	} else if configRules != nil {
+		classificationRules = configRules
+	}
+	return nil
+}
+
+// runList prints the banks of the input directory, or the banks given as
+// arguments, with their category and stream count
+func runList(fs *flag.FlagSet) error {
+	if err := applyConfig(fs); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	setupConsoleLogging()
+	if err := loadRulesOption(); err != nil {
+		return err
+	}
+
+	bankFiles := fs.Args()
+	if len(bankFiles) == 0 {
+		var err error
+		if bankFiles, err = filepath.Glob(filepath.Join(inputDir, "*.bank")); err != nil {
+			return err
+		}
+		sort.Strings(bankFiles)
+	}
+	if len(bankFiles) == 0 {
+		return fmt.Errorf("no .bank files found in %s", inputDir)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BANK\tSIZE\tCATEGORY\tSTREAMS")
+	for _, bankFile := range bankFiles {
+		info, err := os.Stat(bankFile)
+		if err != nil {
+			return err
+		}
+		bankName := strings.TrimSuffix(filepath.Base(bankFile), filepath.Ext(bankFile))
+
+		streamCount := "-"
+		streams, err := queryBankInfo(bankFile)
+		if err != nil {
+			fileLogger.Printf("Failed to query %s: %v\n", bankFile, err)
+		} else {
+			streamCount = fmt.Sprint(len(streams))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", bankName, formatSize(info.Size()), classifyBank(bankName), streamCount)
+
+		if listStreams {
+			for _, stream := range streams {
+				fmt.Fprintf(w, "  %d\t%s\t%s\t\n", stream.Index, stream.Duration().Round(time.Millisecond), stream.Name)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// runInfo prints the stream metadata of the banks given as arguments
+func runInfo(fs *flag.FlagSet) error {
+	if err := applyConfig(fs); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	setupConsoleLogging()
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no bank file given")
+	}
+
+	for _, bankFile := range fs.Args() {
+		streams, err := queryBankInfo(bankFile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", bankFile, err)
+		}
+
+		if infoJSON {
+			data, err := json.MarshalIndent(map[string]interface{}{"bankFile": bankFile, "streams": streams}, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", data)
+			continue
+		}
+
+		fmt.Printf("%s: %d stream(s)\n", bankFile, len(streams))
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "INDEX\tNAME\tRATE\tCHANNELS\tDURATION\tLOOP\tENCODING")
+		for _, stream := range streams {
+			loop := "-"
+			if stream.Looping {
+				loop = fmt.Sprintf("%d-%d", stream.LoopStart, stream.LoopEnd)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\t%s\n", stream.Index, stream.Name, stream.SampleRate,
+				stream.Channels, stream.Duration().Round(time.Millisecond), loop, stream.Encoding)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadManifests reads every bank manifest below dir, skipping banks that are
+// still being staged
+func loadManifests(dir string) (map[string]string, []bankResult, error) {
+	manifestDirs := make(map[string]string)
+	var results []bankResult
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == stagingDirName {
+			return filepath.SkipDir
+		}
+		if entry.IsDir() || entry.Name() != manifestFileName {
+			return nil
+		}
+
+		data, err := os.ReadFile(filepath.Clean(p))
+		if err != nil {
+			return err
+		}
+		var result bankResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", p, err)
+		}
+		manifestDirs[result.BankFile] = filepath.Dir(p)
+		results = append(results, result)
+		return nil
+	})
+	sort.Slice(results, func(a, b int) bool {
+		return results[a].BankFile < results[b].BankFile
+	})
+	return manifestDirs, results, err
+}
+
+// verifyBank checks the files of one manifest and returns the problems found
+func verifyBank(root, manifestDir string, result bankResult) []string {
+	var problems []string
+	for _, file := range result.Files {
+		dir := manifestDir
+		if file.Dir != "" {
+			dir = filepath.Join(root, filepath.FromSlash(file.Dir))
+		}
+		filePath := filepath.Join(dir, file.Name)
+
+		sum, size, err := hashFile(filePath)
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, fmt.Sprintf("missing: %s", filePath))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("unreadable: %s: %v", filePath, err))
+		case size != file.Size:
+			problems = append(problems, fmt.Sprintf("size changed: %s (%d bytes, expected %d)", filePath, size, file.Size))
+		case file.SHA256 != "" && sum != file.SHA256:
+			problems = append(problems, fmt.Sprintf("hash mismatch: %s", filePath))
+		}
+	}
+	return problems
+}
+
+// runVerify checks every file listed in the manifests of the output directory
+func runVerify(fs *flag.FlagSet) error {
+	if err := applyConfig(fs); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	setupConsoleLogging()
+
+	manifestDirs, results, err := loadManifests(outputDir)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("no bank manifests found in %s", outputDir)
+	}
+
+	files, problems := 0, 0
+	for _, result := range results {
+		files += len(result.Files)
+		for _, problem := range verifyBank(outputDir, manifestDirs[result.BankFile], result) {
+			fmt.Println(problem)
+			problems++
+		}
+	}
+	fmt.Printf("Checked %d file(s) in %d bank(s): %d problem(s)\n", files, len(results), problems)
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
+// fileKey identifies an output file across runs by its bank and subsong, and
+// the channels for a split stem
+func fileKey(result bankResult, file outputFile) string {
+	bankName := strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile))
+	if file.Subsong > 0 && file.Stem != "" {
+		return fmt.Sprintf("%s #%d %s", bankName, file.Subsong, file.Stem)
+	}
+	if file.Subsong > 0 {
+		return fmt.Sprintf("%s #%d", bankName, file.Subsong)
+	}
+	return bankName + " " + file.Name
+}
+
+// diffOutputs compares the files of two sets of manifests and returns one
+// line per added (+), removed (-) or changed (~) file. Files are compared by
+// their decoded audio, so a new tool version or post-processing options that
+// only change the tags or encoding don't mark every file as changed.
+func diffOutputs(old, current []bankResult) []string {
+	index := func(results []bankResult) map[string]outputFile {
+		files := make(map[string]outputFile)
+		for _, result := range results {
+			for _, file := range result.Files {
+				files[fileKey(result, file)] = file
+			}
+		}
+		return files
+	}
+	oldFiles, newFiles := index(old), index(current)
+
+	var lines []string
+	for key, file := range newFiles {
+		previous, ok := oldFiles[key]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("+ %s (%s)", key, path.Join(file.Dir, file.Name)))
+		case previous.decodedHash() != file.decodedHash():
+			lines = append(lines, fmt.Sprintf("~ %s (%s)", key, path.Join(file.Dir, file.Name)))
+		}
+	}
+	for key, file := range oldFiles {
+		if _, ok := newFiles[key]; !ok {
+			lines = append(lines, fmt.Sprintf("- %s (%s)", key, path.Join(file.Dir, file.Name)))
+		}
+	}
+	sort.Slice(lines, func(a, b int) bool {
+		return lines[a][2:] < lines[b][2:]
+	})
+	return lines
+}
+
+// runDiff compares the manifests of two output directories
+func runDiff(fs *flag.FlagSet) error {
+	if err := applyConfig(fs); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	setupConsoleLogging()
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected two output directories")
+	}
+
+	_, old, err := loadManifests(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	_, current, err := loadManifests(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	lines := diffOutputs(old, current)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	fmt.Printf("%d difference(s)\n", len(lines))
+	return nil
+}
+
+// runServe serves the output directory and its manifests over HTTP
+func runServe(fs *flag.FlagSet) error {
+	if err := applyConfig(fs); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	setupConsoleLogging()
+	if !dirExists(outputDir) {
+		return fmt.Errorf("output directory %s does not exist", outputDir)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/banks", func(w http.ResponseWriter, _ *http.Request) {
+		_, results, err := loadManifests(outputDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			fileLogger.Printf("Error writing response: %v\n", err)
+		}
+	})
+	mux.Handle("/", http.FileServer(http.Dir(outputDir)))
+
+	server := &http.Server{
+		Addr:              serveAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	summaryLogger.Printf("Serving %s on http://%s/ (bank manifests at /api/banks)\n", outputDir, serveAddr)
+	return server.ListenAndServe()
+}
+
+// formatSize formats a byte count for humans
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelectCommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+		rest     int
+	}{
+		{nil, "extract", 0},
+		{[]string{"-i", "in", "--workers", "2"}, "extract", 4},
+		{[]string{"--version"}, "version", 0},
+		{[]string{"verify", "-o", "out"}, "verify", 2},
+		{[]string{"diff", "a", "b"}, "diff", 2},
+	}
+	for _, test := range tests {
+		cmd, rest := selectCommand(test.args)
+		if cmd == nil || cmd.name != test.expected || len(rest) != test.rest {
+			t.Errorf("selectCommand(%v): expected %s with %d args, got %+v %v", test.args, test.expected, test.rest, cmd, rest)
+		}
+	}
+
+	if cmd, _ := selectCommand([]string{"unknown"}); cmd != nil {
+		t.Errorf("Expected no command for an unknown name, got %s", cmd.name)
+	}
+
+	for _, cmd := range commands {
+		fs := newCommandFlagSet(cmd)
+		if cmd.name == "extract" && fs.Lookup("output-dir") == nil {
+			t.Errorf("Expected extract to keep the existing options")
+		}
+	}
+}
+
+// writeTestOutput writes a bank directory with one file and its manifest
+func writeTestOutput(t *testing.T, root, content string) bankResult {
+	t.Helper()
+	dir := filepath.Join(root, "Music", "Music_Test")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatalf("Failed to create %s: %v", dir, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "01_theme.wav"), []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write output file: %v", err)
+	}
+	files := []outputFile{{Subsong: 1, Dir: "Music/Music_Test", Name: "01_theme.wav"}}
+	if err := hashOutputFiles(dir, files); err != nil {
+		t.Fatalf("Failed to hash output file: %v", err)
+	}
+	result := bankResult{BankFile: "Music_Test.bank", Category: "Music", OutputDir: dir, Extracted: 1, Files: files}
+	if err := writeBankManifest(result, dir); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	return result
+}
+
+func TestVerifyBank(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	writeTestOutput(t, tempDir, "audio")
+	manifestDirs, results, err := loadManifests(tempDir)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Expected one manifest, got %d (err %v)", len(results), err)
+	}
+	manifestDir := manifestDirs[results[0].BankFile]
+	if problems := verifyBank(tempDir, manifestDir, results[0]); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+
+	filePath := filepath.Join(manifestDir, "01_theme.wav")
+	if err := os.WriteFile(filePath, []byte("AUDIO"), 0600); err != nil {
+		t.Fatalf("Failed to modify output file: %v", err)
+	}
+	if problems := verifyBank(tempDir, manifestDir, results[0]); len(problems) != 1 || !strings.HasPrefix(problems[0], "hash mismatch") {
+		t.Errorf("Expected a hash mismatch, got %v", problems)
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		t.Fatalf("Failed to remove output file: %v", err)
+	}
+	if problems := verifyBank(tempDir, manifestDir, results[0]); len(problems) != 1 || !strings.HasPrefix(problems[0], "missing") {
+		t.Errorf("Expected a missing file, got %v", problems)
+	}
+}
+
+func TestDiffOutputs(t *testing.T) {
+	old := []bankResult{{
+		BankFile: "Music_Test.bank",
+		Files: []outputFile{
+			{Subsong: 1, Name: "01_a.wav", SHA256: "aaa"},
+			{Subsong: 2, Name: "02_b.wav", SHA256: "bbb"},
+			{Subsong: 3, Name: "03_c.wav", SHA256: "ccc"},
+			{Subsong: 5, Name: "05_e_ch1-2.wav", SHA256: "front", Channels: []int{1, 2}, Stem: "ch1-2"},
+			{Subsong: 5, Name: "05_e_ch3-4.wav", SHA256: "rear", Channels: []int{3, 4}, Stem: "ch3-4"},
+		},
+	}}
+	current := []bankResult{{
+		BankFile: "Music_Test.bank",
+		Files: []outputFile{
+			{Subsong: 1, Name: "01_a.wav", SHA256: "aaa"},
+			{Subsong: 2, Name: "02_b.wav", SHA256: "changed"},
+			{Subsong: 4, Name: "04_d.wav", SHA256: "ddd"},
+			{Subsong: 5, Name: "05_e_ch1-2.wav", SHA256: "front", Channels: []int{1, 2}, Stem: "ch1-2"},
+			{Subsong: 5, Name: "05_e_ch3-4.wav", SHA256: "changed", Channels: []int{3, 4}, Stem: "ch3-4"},
+		},
+	}}
+
+	lines := diffOutputs(old, current)
+	expected := []string{
+		"~ Music_Test #2 (02_b.wav)",
+		"- Music_Test #3 (03_c.wav)",
+		"+ Music_Test #4 (04_d.wav)",
+		"~ Music_Test #5 ch3-4 (05_e_ch3-4.wav)",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestDiffOutputsIgnoresMetadata(t *testing.T) {
+	old := []bankResult{{
+		BankFile: "Music_Test.bank",
+		Files: []outputFile{
+			{Subsong: 1, Name: "01_a.wav", SHA256: "tagged-by-1.0", DecodedSHA256: "aaa"},
+			{Subsong: 2, Name: "02_b.wav", SHA256: "bbb"},
+			{Subsong: 3, Name: "03_c.wav", SHA256: "tagged-by-1.0", DecodedSHA256: "ccc"},
+		},
+	}}
+	// Only the embedded tool version differs, or the file was tagged this
+	// time and not before
+	current := []bankResult{{
+		BankFile: "Music_Test.bank",
+		Files: []outputFile{
+			{Subsong: 1, Name: "01_a.wav", SHA256: "tagged-by-1.1", DecodedSHA256: "aaa"},
+			{Subsong: 2, Name: "02_b.wav", SHA256: "tagged-by-1.1", DecodedSHA256: "bbb"},
+			{Subsong: 3, Name: "03_c.wav", SHA256: "tagged-by-1.1", DecodedSHA256: "changed"},
+		},
+	}}
+
+	lines := diffOutputs(old, current)
+	if len(lines) != 1 || lines[0] != "~ Music_Test #3 (03_c.wav)" {
+		t.Errorf("Expected only the file with new audio to differ, got %v", lines)
+	}
+}
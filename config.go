@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// configFileName is looked for in the working directory
+	configFileName = "sky-fsbext.json"
+
+	// envPrefix starts the environment variables that override config file values
+	envPrefix = "SKYFSBEXT_"
+)
+
+var (
+	configPath  string
+	printConfig bool
+
+	// configRules are classification rules given inline in the config file
+	configRules []classificationRule
+)
+
+// shortFlags maps the one-letter flags to the option they are short for
+var shortFlags = map[string]string{
+	"i": "input-dir",
+	"o": "output-dir",
+	"p": "vgmstream-path",
+	"c": "compression-ratio",
+	"v": "verbose",
+	"w": "workers",
+}
+
+// configOnlyFlags control where the configuration comes from and can't be set
+// in the config file itself
+var configOnlyFlags = map[string]bool{
+	"config":       true,
+	"print-config": true,
+}
+
+// envName returns the environment variable for an option, e.g. SKYFSBEXT_OUTPUT_DIR
+func envName(option string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// findConfigFile returns the config file to use: --config or its environment
+// variable, otherwise sky-fsbext.json in the working directory or config.json
+// in the user config directory. It returns "" if there is none.
+func findConfigFile(explicit string) (string, error) {
+	if explicit != "" {
+		if _, err := os.Stat(explicit); err != nil {
+			return "", err
+		}
+		return explicit, nil
+	}
+
+	candidates := []string{configFileName}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "sky-fsbext", "config.json"))
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+// loadConfigFile reads a config file into option values, rejecting keys that
+// aren't in options. Scalars are turned into the text the flag would take,
+// lists into one value per item for repeatable flags; "rules" may hold the
+// rules inline.
+func loadConfigFile(options *flag.FlagSet, path string) (map[string][]string, []classificationRule, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, nil, err
+	}
+	var raw map[string]json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	values := make(map[string][]string)
+	var rules []classificationRule
+	for key, message := range raw {
+		if options.Lookup(key) == nil || shortFlags[key] != "" || configOnlyFlags[key] {
+			return nil, nil, fmt.Errorf("%s: unknown option %q", path, key)
+		}
+
+		if key == "rules" && bytes.HasPrefix(bytes.TrimSpace(message), []byte("[")) {
+			if err := json.Unmarshal(message, &rules); err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid rules: %v", path, err)
+			}
+			if err := compileRules(rules); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", path, err)
+			}
+			continue
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(message))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, nil, fmt.Errorf("%s: %s: %v", path, key, err)
+		}
+		items := []interface{}{value}
+		if list, ok := value.([]interface{}); ok {
+			if !repeatable(options.Lookup(key)) {
+				return nil, nil, fmt.Errorf("%s: %s takes a single value", path, key)
+			}
+			items = list
+		}
+		for _, item := range items {
+			switch v := item.(type) {
+			case string:
+				values[key] = append(values[key], v)
+			case bool, json.Number:
+				values[key] = append(values[key], fmt.Sprint(v))
+			default:
+				return nil, nil, fmt.Errorf("%s: %s must be a string, number, boolean or a list of them", path, key)
+			}
+		}
+	}
+	return values, rules, nil
+}
+
+// repeatable reports whether a flag collects a list of values
+func repeatable(f *flag.Flag) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return false
+	}
+	_, isList := getter.Get().([]string)
+	return isList
+}
+
+// applyConfig fills in every option not given on the command line from its
+// environment variable, then from the config file. The precedence is flags,
+// then environment, then config file, then built-in defaults.
+func applyConfig(fs *flag.FlagSet) error {
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+		if long := shortFlags[f.Name]; long != "" {
+			onCommandLine[long] = true
+		}
+	})
+
+	explicit := configPath
+	if !onCommandLine["config"] {
+		if env, ok := os.LookupEnv(envName("config")); ok {
+			explicit = env
+		}
+	}
+	path, err := findConfigFile(explicit)
+	if err != nil {
+		return err
+	}
+	var fileValues map[string][]string
+	var fileRules []classificationRule
+	if path != "" {
+		options := configOptions
+		if options == nil {
+			options = fs
+		}
+		if fileValues, fileRules, err = loadConfigFile(options, path); err != nil {
+			return err
+		}
+		configPath = path
+	}
+
+	var applyErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if applyErr != nil || onCommandLine[f.Name] || shortFlags[f.Name] != "" || configOnlyFlags[f.Name] {
+			return
+		}
+		if env, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, env); err != nil {
+				applyErr = fmt.Errorf("%s: %v", envName(f.Name), err)
+			}
+			return
+		}
+		if values, ok := fileValues[f.Name]; ok {
+			for _, value := range values {
+				if err := fs.Set(f.Name, value); err != nil {
+					applyErr = fmt.Errorf("%s: %s: %v", path, f.Name, err)
+					return
+				}
+			}
+			return
+		}
+		if f.Name == "rules" && fileRules != nil {
+			configRules = fileRules
+		}
+	})
+	return applyErr
+}
+
+// writeEffectiveConfig prints the options in effect as a config file
+func writeEffectiveConfig(fs *flag.FlagSet, w io.Writer) error {
+	config := make(map[string]interface{})
+	fs.VisitAll(func(f *flag.Flag) {
+		if shortFlags[f.Name] != "" || configOnlyFlags[f.Name] {
+			return
+		}
+		// Durations and custom values are written the way the flag takes them
+		config[f.Name] = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			switch value := getter.Get().(type) {
+			case bool, float64, int, []string:
+				config[f.Name] = value
+			}
+		}
+	})
+	if configRules != nil {
+		config["rules"] = configRules
+	}
+
+	// Maps are written with sorted keys, so the output diffs cleanly
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
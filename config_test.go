@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyConfig(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalConfigPath, originalConfigRules := configPath, configRules
+	defer func() { configPath, configRules = originalConfigPath, originalConfigRules }()
+
+	path := filepath.Join(tempDir, "config.json")
+	content := `{
+		"input-dir": "from-file",
+		"output-dir": "from-file",
+		"compression-ratio": 4.5,
+		"verbose": true,
+		"lock-wait": "10m",
+		"include": ["Music_*", "subsong:re:^mus_"],
+		"rules": [{"bank": "Music_*", "category": "Soundtrack"}]
+	}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	var input, output, rules string
+	var ratio float64
+	var verboseFlag bool
+	var wait time.Duration
+	var include patternList
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&input, "i", "in", "")
+	fs.StringVar(&input, "input-dir", "in", "")
+	fs.StringVar(&output, "o", "out", "")
+	fs.StringVar(&output, "output-dir", "out", "")
+	fs.Float64Var(&ratio, "compression-ratio", 8, "")
+	fs.BoolVar(&verboseFlag, "verbose", false, "")
+	fs.DurationVar(&wait, "lock-wait", 0, "")
+	fs.StringVar(&rules, "rules", "", "")
+	fs.Var(&include, "include", "")
+	fs.StringVar(&configPath, "config", "", "")
+
+	t.Setenv(envName("output-dir"), "from-env")
+	t.Setenv(envName("input-dir"), "from-env")
+	if err := fs.Parse([]string{"-i", "from-flag", "--config", path}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if err := applyConfig(fs); err != nil {
+		t.Fatalf("applyConfig returned an error: %v", err)
+	}
+
+	if input != "from-flag" {
+		t.Errorf("Expected the flag to win over env and file, got %s", input)
+	}
+	if output != "from-env" {
+		t.Errorf("Expected the environment to win over the file, got %s", output)
+	}
+	if ratio != 4.5 || !verboseFlag || wait != 10*time.Minute {
+		t.Errorf("Expected the file values, got ratio %v, verbose %v, lock-wait %v", ratio, verboseFlag, wait)
+	}
+	if len(include.banks) != 1 || len(include.subsongs) != 1 {
+		t.Errorf("Expected a list to set a repeatable flag once per item, got %v", include.specs)
+	}
+	if len(configRules) != 1 || configRules[0].Category != "Soundtrack" || configRules[0].bank == nil {
+		t.Errorf("Expected the inline rules to be compiled, got %+v", configRules)
+	}
+
+	var out bytes.Buffer
+	if err := writeEffectiveConfig(fs, &out); err != nil {
+		t.Fatalf("writeEffectiveConfig returned an error: %v", err)
+	}
+	var effective map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &effective); err != nil {
+		t.Fatalf("Expected JSON, got %s: %v", out.String(), err)
+	}
+	if effective["input-dir"] != "from-flag" || effective["verbose"] != true || effective["lock-wait"] != "10m0s" {
+		t.Errorf("Unexpected effective config: %s", out.String())
+	}
+	if _, ok := effective["i"]; ok {
+		t.Errorf("Expected the short flags to be left out: %s", out.String())
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("o", "out", "")
+	fs.String("output-dir", "out", "")
+	fs.String("rules", "", "")
+
+	path := filepath.Join(tempDir, "config.json")
+	for _, invalid := range []string{
+		`{"unknown": 1}`,
+		`{"o": "short"}`,
+		`{"output-dir": ["a"]}`,
+		`{"rules": [{"bank": "*", "category": "../outside"}]}`,
+		`not json`,
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if _, _, err := loadConfigFile(fs, path); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
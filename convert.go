@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	depthFloat = "32f"
+
+	ditherTPDF = "tpdf"
+	ditherNone = "none"
+
+	// resamplerZeroCrossings is the half length of the resampling filter in
+	// zero crossings of its sinc, and resamplerTableSteps the resolution of
+	// the precomputed filter between two of them
+	resamplerZeroCrossings = 24
+	resamplerTableSteps    = 512
+
+	// resamplerBandwidth is the passband as a fraction of the lower Nyquist
+	// frequency, leaving room for the transition band
+	resamplerBandwidth  = 0.95
+	resamplerKaiserBeta = 9.0
+)
+
+var (
+	targetSampleRate int
+	targetChannels   int
+	targetBitDepth   string
+	ditherMode       = ditherTPDF
+)
+
+// audioFormat records what an output file was converted to
+type audioFormat struct {
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+	BitDepth   string `json:"bitDepth"`
+}
+
+// converting reports whether any conversion option is set
+func converting() bool {
+	return targetSampleRate > 0 || targetChannels > 0 || targetBitDepth != ""
+}
+
+// validateConversionOptions checks the conversion options
+func validateConversionOptions() error {
+	if targetSampleRate != 0 && (targetSampleRate < 8000 || targetSampleRate > 384000) {
+		return fmt.Errorf("--sample-rate %d is outside 8000 to 384000 Hz", targetSampleRate)
+	}
+	if targetChannels < 0 || targetChannels > 2 {
+		return fmt.Errorf("--channels %d isn't supported, only mono (1) and stereo (2) mixes are", targetChannels)
+	}
+	switch targetBitDepth {
+	case "", "16", "24":
+	case depthFloat:
+		if outputFormat == formatFLAC {
+			return fmt.Errorf("FLAC can't store 32-bit float audio")
+		}
+	default:
+		return fmt.Errorf("unknown bit depth %q, expected 16, 24 or %s", targetBitDepth, depthFloat)
+	}
+	if ditherMode != ditherTPDF && ditherMode != ditherNone {
+		return fmt.Errorf("unknown dither %q, expected %s or %s", ditherMode, ditherTPDF, ditherNone)
+	}
+	return nil
+}
+
+// downmixGain is the ITU-R BS.775 coefficient for centre and surround
+// channels folded into a stereo pair
+const downmixGain = 0.7071
+
+// remixMatrix returns the coefficients that mix the input channels, in WAV
+// channel order, into the output channels. The LFE is dropped from downmixes.
+func remixMatrix(from, to int) ([][]float64, error) {
+	if to == 1 && from > 1 {
+		stereo, err := remixMatrix(from, 2)
+		if err != nil {
+			return nil, err
+		}
+		mono := make([]float64, from)
+		for ch := range mono {
+			mono[ch] = (stereo[0][ch] + stereo[1][ch]) / 2
+		}
+		return [][]float64{mono}, nil
+	}
+	if to != 2 {
+		return nil, fmt.Errorf("can't remix %d channels to %d", from, to)
+	}
+
+	left, right := make([]float64, from), make([]float64, from)
+	switch from {
+	case 1:
+		left[0], right[0] = 1, 1
+	case 2:
+		left[0], right[1] = 1, 1
+	case 3: // L R C
+		left[0], right[1] = 1, 1
+		left[2], right[2] = downmixGain, downmixGain
+	case 4: // L R Ls Rs
+		left[0], right[1] = 1, 1
+		left[2], right[3] = downmixGain, downmixGain
+	case 5: // L R C Ls Rs
+		left[0], right[1] = 1, 1
+		left[2], right[2] = downmixGain, downmixGain
+		left[3], right[4] = downmixGain, downmixGain
+	case 6, 8: // L R C LFE Ls Rs, and Lb Rb for 7.1
+		left[0], right[1] = 1, 1
+		left[2], right[2] = downmixGain, downmixGain
+		for ch := 4; ch < from; ch += 2 {
+			left[ch], right[ch+1] = downmixGain, downmixGain
+		}
+	default:
+		return nil, fmt.Errorf("can't remix %d channels to %d", from, to)
+	}
+	return [][]float64{left, right}, nil
+}
+
+// remix applies a remix matrix
+func remix(channels [][]float64, matrix [][]float64) [][]float64 {
+	frames := len(channels[0])
+	mixed := make([][]float64, len(matrix))
+	for out, row := range matrix {
+		mixed[out] = make([]float64, frames)
+		for in, gain := range row {
+			if gain == 0 {
+				continue
+			}
+			for i, s := range channels[in] {
+				mixed[out][i] += gain * s
+			}
+		}
+	}
+	return mixed
+}
+
+// besselI0 is the modified Bessel function of the first kind used by the
+// Kaiser window
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+	}
+	return sum
+}
+
+// resampler converts between two sample rates with a Kaiser-windowed sinc
+// filter, looked up from a table
+type resampler struct {
+	ratio     float64 // output rate / input rate
+	halfWidth float64 // filter half length in input samples
+	scale     float64 // table steps per input sample
+	table     []float64
+}
+
+// newResampler builds the filter for the conversion
+func newResampler(from, to int) *resampler {
+	ratio := float64(to) / float64(from)
+	cutoff := resamplerBandwidth * min(1, ratio)
+	r := &resampler{
+		ratio:     ratio,
+		halfWidth: resamplerZeroCrossings / cutoff,
+		scale:     resamplerTableSteps * cutoff,
+	}
+	r.table = make([]float64, int(r.halfWidth*r.scale)+2)
+	norm := besselI0(resamplerKaiserBeta)
+	for i := range r.table {
+		x := float64(i) / r.scale
+		if x >= r.halfWidth {
+			continue
+		}
+		value := cutoff
+		if x > 0 {
+			value = math.Sin(math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		window := x / r.halfWidth
+		r.table[i] = value * besselI0(resamplerKaiserBeta*math.Sqrt(1-window*window)) / norm
+	}
+	return r
+}
+
+// kernel returns the filter value at a distance in input samples
+func (r *resampler) kernel(distance float64) float64 {
+	position := math.Abs(distance) * r.scale
+	index := int(position)
+	if index+1 >= len(r.table) {
+		return 0
+	}
+	fraction := position - float64(index)
+	return r.table[index] + fraction*(r.table[index+1]-r.table[index])
+}
+
+// resample converts one channel
+func (r *resampler) resample(signal []float64) []float64 {
+	frames := int(math.Ceil(float64(len(signal)) * r.ratio))
+	out := make([]float64, frames)
+	for n := range out {
+		t := float64(n) / r.ratio
+		first := max(int(math.Ceil(t-r.halfWidth)), 0)
+		last := min(int(math.Floor(t+r.halfWidth)), len(signal)-1)
+		var sum float64
+		for k := first; k <= last; k++ {
+			sum += signal[k] * r.kernel(t-float64(k))
+		}
+		out[n] = sum
+	}
+	return out
+}
+
+// ditherSource is a small deterministic random generator so converted files
+// are the same on every run
+type ditherSource struct {
+	state uint64
+}
+
+// next returns a uniform value in [0, 1)
+func (d *ditherSource) next() float64 {
+	// xorshift64*
+	d.state ^= d.state >> 12
+	d.state ^= d.state << 25
+	d.state ^= d.state >> 27
+	return float64((d.state*2685821657736338717)>>11) / (1 << 53)
+}
+
+// quantize converts float channels to integer PCM of the given bit depth,
+// adding triangular dither of one step when dither is set
+func quantize(channels [][]float64, rate, bits int, dither *ditherSource) *pcmAudio {
+	audio := &pcmAudio{SampleRate: rate, Channels: len(channels), BitsPerSample: bits}
+	fullScale := float64(int64(1) << (bits - 1))
+	frames := len(channels[0])
+	audio.Samples = make([]int32, frames*len(channels))
+	for i := 0; i < frames; i++ {
+		for ch, signal := range channels {
+			value := signal[i] * fullScale
+			if dither != nil {
+				value += dither.next() - dither.next()
+			}
+			value = math.Round(value)
+			audio.Samples[i*len(channels)+ch] = int32(max(min(value, fullScale-1), -fullScale))
+		}
+	}
+	return audio
+}
+
+// convertedStream returns the stream's metadata at the output sample rate,
+// so loop points still match the audio after resampling
+func convertedStream(stream streamInfo) streamInfo {
+	if targetSampleRate <= 0 || stream.SampleRate <= 0 || stream.SampleRate == targetSampleRate {
+		return stream
+	}
+	scale := func(position int64) int64 {
+		return int64(math.Round(float64(position) * float64(targetSampleRate) / float64(stream.SampleRate)))
+	}
+	stream.Samples = scale(stream.Samples)
+	stream.LoopStart = scale(stream.LoopStart)
+	stream.LoopEnd = scale(stream.LoopEnd)
+	stream.SampleRate = targetSampleRate
+	return stream
+}
+
+// convertAudio remixes, resamples and requantises decoded audio according to
+// the conversion options. It returns the WAV file and the resulting format.
+func convertAudio(audio *pcmAudio, chunks []wavChunk, seed uint64) ([]byte, audioFormat, error) {
+	channels := splitChannels(audio)
+	processed := false
+
+	if targetChannels > 0 && targetChannels != audio.Channels {
+		matrix, err := remixMatrix(audio.Channels, targetChannels)
+		if err != nil {
+			return nil, audioFormat{}, err
+		}
+		channels = remix(channels, matrix)
+		processed = true
+	}
+
+	rate := audio.SampleRate
+	if targetSampleRate > 0 && targetSampleRate != rate {
+		r := newResampler(rate, targetSampleRate)
+		for ch := range channels {
+			channels[ch] = r.resample(channels[ch])
+		}
+		rate = targetSampleRate
+		processed = true
+	}
+
+	depth := targetBitDepth
+	if depth == "" {
+		depth = strconv.Itoa(audio.BitsPerSample)
+	}
+	format := audioFormat{SampleRate: rate, Channels: len(channels), BitDepth: depth}
+
+	var buf bytes.Buffer
+	if depth == depthFloat {
+		err := writeFloatWAV(&buf, rate, channels, chunks)
+		return buf.Bytes(), format, err
+	}
+
+	// Dither whenever the samples no longer fall on the output's steps
+	bits, _ := strconv.Atoi(depth)
+	var dither *ditherSource
+	if ditherMode == ditherTPDF && (processed || bits < audio.BitsPerSample) {
+		dither = &ditherSource{state: seed | 1}
+	}
+	err := writeWAV(&buf, quantize(channels, rate, bits, dither), chunks)
+	return buf.Bytes(), format, err
+}
+
+// convertOutputFiles applies the conversion options to the WAV files in dir
+func convertOutputFiles(result bankResult, dir string, files []outputFile) error {
+	if !converting() {
+		return nil
+	}
+	var firstErr error
+	for i := range files {
+		if !strings.EqualFold(filepath.Ext(files[i].Name), ".wav") {
+			continue
+		}
+		path := filepath.Join(dir, files[i].Name)
+		err := func() error {
+			audio, chunks, err := readWAVFile(path)
+			if err != nil {
+				return err
+			}
+			// Loop points are rewritten for the new sample rate
+			var kept []wavChunk
+			for _, chunk := range chunks {
+				if chunk.ID != "smpl" && chunk.ID != "cue " {
+					kept = append(kept, chunk)
+				}
+			}
+			if stream, ok := findStream(result, files[i].Subsong); ok && writingLoopPoints() && hasLoop(stream) {
+				kept = append(kept, loopChunks(convertedStream(stream))...)
+			}
+
+			converted, format, err := convertAudio(audio, kept, uint64(files[i].Subsong))
+			if err != nil {
+				return err
+			}
+			temporary := path + ".tmp"
+			if err := os.WriteFile(temporary, converted, 0600); err != nil {
+				return err
+			}
+			if err := os.Rename(temporary, path); err != nil {
+				return err
+			}
+			files[i].Format = &format
+			return files[i].rehash(path)
+		}()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemixMatrix(t *testing.T) {
+	matrix, err := remixMatrix(6, 2)
+	if err != nil {
+		t.Fatalf("remixMatrix returned an error: %v", err)
+	}
+	expectedLeft := []float64{1, 0, downmixGain, 0, downmixGain, 0}
+	expectedRight := []float64{0, 1, downmixGain, 0, 0, downmixGain}
+	for ch := range expectedLeft {
+		if matrix[0][ch] != expectedLeft[ch] || matrix[1][ch] != expectedRight[ch] {
+			t.Errorf("Unexpected 5.1 downmix %v", matrix)
+			break
+		}
+	}
+
+	mono, err := remixMatrix(2, 1)
+	if err != nil || len(mono) != 1 || mono[0][0] != 0.5 || mono[0][1] != 0.5 {
+		t.Errorf("Expected stereo to mono to average the channels, got %v (%v)", mono, err)
+	}
+	stereo, err := remixMatrix(1, 2)
+	if err != nil || stereo[0][0] != 1 || stereo[1][0] != 1 {
+		t.Errorf("Expected mono to stereo to copy the channel, got %v (%v)", stereo, err)
+	}
+	if _, err := remixMatrix(7, 2); err == nil {
+		t.Errorf("Expected an error for 7 channels")
+	}
+}
+
+// rms returns the root mean square of the middle of a signal, away from the
+// filter's edges
+func rms(signal []float64) float64 {
+	middle := signal[len(signal)/4 : 3*len(signal)/4]
+	var sum float64
+	for _, s := range middle {
+		sum += s * s
+	}
+	return math.Sqrt(sum / float64(len(middle)))
+}
+
+func TestResample(t *testing.T) {
+	sine := func(rate int, frequency float64) []float64 {
+		signal := make([]float64, rate/2)
+		for i := range signal {
+			signal[i] = 0.5 * math.Sin(2*math.Pi*frequency*float64(i)/float64(rate))
+		}
+		return signal
+	}
+
+	out := newResampler(48000, 44100).resample(sine(48000, 1000))
+	if len(out) != 22050 {
+		t.Errorf("Expected 22050 samples, got %d", len(out))
+	}
+	if level := rms(out); math.Abs(level-0.5/math.Sqrt2) > 0.001 {
+		t.Errorf("Expected the level of a 1 kHz tone to be kept, got an RMS of %f", level)
+	}
+	// The resampled tone should match a tone generated at the new rate
+	reference := sine(44100, 1000)
+	for i := 1000; i < 21000; i++ {
+		if math.Abs(out[i]-reference[i]) > 0.001 {
+			t.Fatalf("Sample %d is %f, expected %f", i, out[i], reference[i])
+		}
+	}
+
+	// Frequencies above the new Nyquist frequency are filtered out
+	if level := rms(newResampler(48000, 32000).resample(sine(48000, 20000))); level > 0.001 {
+		t.Errorf("Expected a 20 kHz tone to be removed when resampling to 32 kHz, got an RMS of %f", level)
+	}
+	if out := newResampler(22050, 48000).resample(sine(22050, 440)); math.Abs(rms(out)-0.5/math.Sqrt2) > 0.001 {
+		t.Errorf("Expected upsampling to keep the level, got an RMS of %f", rms(out))
+	}
+}
+
+func TestConvertOutputFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalRate, originalChannels, originalDepth := targetSampleRate, targetChannels, targetBitDepth
+	defer func() {
+		targetSampleRate, targetChannels, targetBitDepth = originalRate, originalChannels, originalDepth
+	}()
+	targetSampleRate, targetChannels, targetBitDepth = 44100, 1, "24"
+
+	var wav bytes.Buffer
+	if err := writeWAV(&wav, sineAudio(48000, 2, 997, 0.5, 1), nil); err != nil {
+		t.Fatalf("writeWAV returned an error: %v", err)
+	}
+	for _, name := range []string{"00001_loop.wav", "00002_float.wav"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), wav.Bytes(), 0600); err != nil {
+			t.Fatalf("Failed to write WAV: %v", err)
+		}
+	}
+
+	result := bankResult{Streams: []streamInfo{{Index: 1, SampleRate: 48000, Looping: true, LoopStart: 4800, LoopEnd: 48000}}}
+	files := []outputFile{{Subsong: 1, Name: "00001_loop.wav", SHA256: "decoded"}}
+	if err := convertOutputFiles(result, tempDir, files); err != nil {
+		t.Fatalf("convertOutputFiles returned an error: %v", err)
+	}
+	if files[0].Format == nil || *files[0].Format != (audioFormat{SampleRate: 44100, Channels: 1, BitDepth: "24"}) {
+		t.Errorf("Expected the converted format to be recorded, got %+v", files[0].Format)
+	}
+	if files[0].DecodedSHA256 != "decoded" {
+		t.Errorf("Expected the decoded hash to be kept, got %+v", files[0])
+	}
+
+	audio, chunks, err := readWAVFile(filepath.Join(tempDir, "00001_loop.wav"))
+	if err != nil {
+		t.Fatalf("Failed to read the converted WAV: %v", err)
+	}
+	if audio.SampleRate != 44100 || audio.Channels != 1 || audio.BitsPerSample != 24 || audio.frames() != 44100 {
+		t.Errorf("Unexpected converted audio: %d Hz, %d channels, %d bits, %d samples", audio.SampleRate, audio.Channels, audio.BitsPerSample, audio.frames())
+	}
+	var smpl []byte
+	for _, chunk := range chunks {
+		if chunk.ID == "smpl" {
+			smpl = chunk.Data
+		}
+	}
+	if smpl == nil || binary.LittleEndian.Uint32(smpl[44:48]) != 4410 || binary.LittleEndian.Uint32(smpl[48:52]) != 44099 {
+		t.Errorf("Expected the loop points at the new sample rate, got % x", smpl)
+	}
+
+	// The same settings give the same file, dither included
+	first := files[0].SHA256
+	if err := os.WriteFile(filepath.Join(tempDir, "00001_loop.wav"), wav.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write WAV: %v", err)
+	}
+	if err := convertOutputFiles(result, tempDir, files); err != nil || files[0].SHA256 != first {
+		t.Errorf("Expected the conversion to be deterministic (%v)", err)
+	}
+
+	targetSampleRate, targetChannels, targetBitDepth = 0, 0, depthFloat
+	files = []outputFile{{Subsong: 2, Name: "00002_float.wav"}}
+	if err := convertOutputFiles(result, tempDir, files); err != nil {
+		t.Fatalf("convertOutputFiles returned an error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tempDir, "00002_float.wav"))
+	if err != nil {
+		t.Fatalf("Failed to read the float WAV: %v", err)
+	}
+	if binary.LittleEndian.Uint16(data[20:22]) != wavFormatFloat || binary.LittleEndian.Uint16(data[34:36]) != 32 {
+		t.Errorf("Expected a 32-bit float WAV, got header % x", data[:44])
+	}
+}
+
+func TestValidateConversionOptions(t *testing.T) {
+	originalRate, originalChannels, originalDepth, originalDither, originalFormat := targetSampleRate, targetChannels, targetBitDepth, ditherMode, outputFormat
+	defer func() {
+		targetSampleRate, targetChannels, targetBitDepth, ditherMode, outputFormat = originalRate, originalChannels, originalDepth, originalDither, originalFormat
+	}()
+
+	targetSampleRate, targetChannels, targetBitDepth, ditherMode, outputFormat = 48000, 2, "16", ditherTPDF, formatWAV
+	if err := validateConversionOptions(); err != nil {
+		t.Errorf("Expected 48 kHz 16-bit stereo to be valid: %v", err)
+	}
+	for _, invalid := range []func(){
+		func() { targetSampleRate = 1000 },
+		func() { targetChannels = 6 },
+		func() { targetBitDepth = "12" },
+		func() { ditherMode = "noise" },
+		func() { targetBitDepth, outputFormat = depthFloat, formatFLAC },
+	} {
+		targetSampleRate, targetChannels, targetBitDepth, ditherMode, outputFormat = 48000, 2, "16", ditherTPDF, formatWAV
+		invalid()
+		if err := validateConversionOptions(); err == nil {
+			t.Errorf("Expected an error for %d Hz, %d channels, %s bits, %s dither, %s", targetSampleRate, targetChannels, targetBitDepth, ditherMode, outputFormat)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// subsongPrefix makes an --include or --exclude pattern match subsong names
+// instead of bank names
+const subsongPrefix = "subsong:"
+
+// patternList is a repeatable flag of bank or subsong name patterns
+type patternList struct {
+	specs    []string
+	banks    []*namePattern
+	subsongs []*namePattern
+}
+
+func (l *patternList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.specs, ",")
+}
+
+// Set adds a pattern. Patterns starting with "subsong:" match subsong names.
+func (l *patternList) Set(value string) error {
+	spec, isSubsong := strings.CutPrefix(value, subsongPrefix)
+	pattern, err := compileNamePattern(spec)
+	if err != nil {
+		return err
+	}
+	if isSubsong {
+		l.subsongs = append(l.subsongs, pattern)
+	} else {
+		l.banks = append(l.banks, pattern)
+	}
+	l.specs = append(l.specs, value)
+	return nil
+}
+
+// Get returns the patterns as given, for --print-config
+func (l *patternList) Get() interface{} {
+	return l.specs
+}
+
+// matchAny reports whether any of the patterns matches name
+func matchAny(patterns []*namePattern, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	includePatterns patternList
+	excludePatterns patternList
+	minDuration     time.Duration
+	maxDuration     time.Duration
+)
+
+// bankIncluded reports whether the include and exclude patterns let a bank through
+func bankIncluded(bankName string) bool {
+	if len(includePatterns.banks) > 0 && !matchAny(includePatterns.banks, bankName) {
+		return false
+	}
+	return !matchAny(excludePatterns.banks, bankName)
+}
+
+// filterBanks drops the bank files the patterns exclude
+func filterBanks(bankFiles []string) []string {
+	var kept []string
+	for _, bankFile := range bankFiles {
+		bankName := strings.TrimSuffix(filepath.Base(bankFile), filepath.Ext(bankFile))
+		if bankIncluded(bankName) {
+			kept = append(kept, bankFile)
+		}
+	}
+	return kept
+}
+
+// subsongFiltersActive reports whether any filter applies to subsongs
+func subsongFiltersActive() bool {
+	return len(includePatterns.subsongs) > 0 || len(excludePatterns.subsongs) > 0 || minDuration > 0 || maxDuration > 0
+}
+
+// subsongIncluded reports whether a subsong passes the name and duration filters
+func subsongIncluded(stream streamInfo) bool {
+	if len(includePatterns.subsongs) > 0 && !matchAny(includePatterns.subsongs, stream.Name) {
+		return false
+	}
+	if matchAny(excludePatterns.subsongs, stream.Name) {
+		return false
+	}
+	if minDuration > 0 && stream.Duration() < minDuration {
+		return false
+	}
+	return maxDuration <= 0 || stream.Duration() <= maxDuration
+}
+
+// filterSubsongs returns the subsongs of a bank the filters drop
+func filterSubsongs(streams []streamInfo) []int {
+	filtered := []int{}
+	for _, stream := range streams {
+		if !subsongIncluded(stream) {
+			filtered = append(filtered, stream.Index)
+		}
+	}
+	return filtered
+}
+
+// validateDurationFilters checks that the duration range isn't empty
+func validateDurationFilters() error {
+	if minDuration < 0 || maxDuration < 0 {
+		return fmt.Errorf("durations can't be negative")
+	}
+	if maxDuration > 0 && minDuration > maxDuration {
+		return fmt.Errorf("--min-duration %s is longer than --max-duration %s", minDuration, maxDuration)
+	}
+	return nil
+}
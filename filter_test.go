@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// resetFilters clears the filters and returns a func that restores them
+func resetFilters() func() {
+	include, exclude, minimum, maximum := includePatterns, excludePatterns, minDuration, maxDuration
+	includePatterns, excludePatterns, minDuration, maxDuration = patternList{}, patternList{}, 0, 0
+	return func() {
+		includePatterns, excludePatterns, minDuration, maxDuration = include, exclude, minimum, maximum
+	}
+}
+
+func TestFilterBanks(t *testing.T) {
+	defer resetFilters()()
+
+	bankFiles := []string{"in/Music_Prairie.bank", "in/Music_Credits.bank", "in/SFX_UI.bank", "in/Ambience_Cave.bank"}
+	if got := filterBanks(bankFiles); !reflect.DeepEqual(got, bankFiles) {
+		t.Errorf("Expected every bank without filters, got %v", got)
+	}
+
+	for _, pattern := range []string{"Music_*", "re:^SFX_"} {
+		if err := includePatterns.Set(pattern); err != nil {
+			t.Fatalf("Failed to add %q: %v", pattern, err)
+		}
+	}
+	if err := excludePatterns.Set("*Credits"); err != nil {
+		t.Fatalf("Failed to add exclude pattern: %v", err)
+	}
+	expected := []string{"in/Music_Prairie.bank", "in/SFX_UI.bank"}
+	if got := filterBanks(bankFiles); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if includePatterns.String() != "Music_*,re:^SFX_" {
+		t.Errorf("Unexpected pattern list %q", includePatterns.String())
+	}
+
+	if err := excludePatterns.Set("subsong:["); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
+
+func TestFilterSubsongs(t *testing.T) {
+	defer resetFilters()()
+
+	streams := []streamInfo{
+		{Index: 1, Name: "ui_blip", SampleRate: 1000, Samples: 200},
+		{Index: 2, Name: "mus_theme", SampleRate: 1000, Samples: 120000},
+		{Index: 3, Name: "mus_long", SampleRate: 1000, Samples: 900000},
+		{Index: 4, Name: "amb_wind", SampleRate: 1000, Samples: 30000},
+	}
+	if subsongFiltersActive() {
+		t.Errorf("Expected no subsong filters by default")
+	}
+
+	minDuration = time.Second
+	maxDuration = 10 * time.Minute
+	if got := filterSubsongs(streams); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("Expected the blip and the long track to be filtered, got %v", got)
+	}
+
+	if err := excludePatterns.Set("subsong:amb_*"); err != nil {
+		t.Fatalf("Failed to add exclude pattern: %v", err)
+	}
+	if got := filterSubsongs(streams); !reflect.DeepEqual(got, []int{1, 3, 4}) {
+		t.Errorf("Expected amb_wind to be excluded by name, got %v", got)
+	}
+	if !bankIncluded("Ambience_Cave") {
+		t.Errorf("Expected subsong patterns not to filter banks")
+	}
+
+	minDuration, maxDuration = time.Minute, time.Second
+	if err := validateDurationFilters(); err == nil {
+		t.Errorf("Expected an error for an empty duration range")
+	}
+}
+
+func TestProcessBankFilesFilters(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+	defer resetFilters()()
+
+	originalInputDir, originalOutputDir := inputDir, outputDir
+	inputDir, outputDir = filepath.Join(tempDir, "in"), filepath.Join(tempDir, "out")
+	defer func() { inputDir, outputDir = originalInputDir, originalOutputDir }()
+
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+	execCommand = fakeExecCommand("HELPER_STREAM_TOTAL=4", "HELPER_WRITE_FILES=4")
+
+	if err := os.MkdirAll(inputDir, 0750); err != nil {
+		t.Fatalf("Failed to create input dir: %v", err)
+	}
+	var bankFiles []string
+	for _, name := range []string{"Music_Test.bank", "SFX_Test.bank"} {
+		bankFile := filepath.Join(inputDir, name)
+		if err := os.WriteFile(bankFile, []byte("FSB5"), 0600); err != nil {
+			t.Fatalf("Failed to write bank file: %v", err)
+		}
+		bankFiles = append(bankFiles, bankFile)
+	}
+
+	if err := excludePatterns.Set("subsong:re:^stream[13]$"); err != nil {
+		t.Fatalf("Failed to add exclude pattern: %v", err)
+	}
+	results := processBankFilesConcurrently(bankFiles, 2)
+	for _, result := range results {
+		if result.Error != "" || result.Extracted != 2 || result.Mismatch || !reflect.DeepEqual(result.Filtered, []int{1, 3}) {
+			t.Errorf("Expected subsongs 2 and 4 of %s, got %+v", result.BankFile, result)
+		}
+	}
+
+	// Every subsong filtered out skips the bank
+	minDuration = time.Hour
+	for _, result := range processBankFilesConcurrently(bankFiles, 2) {
+		if result.Error != "" || !result.Skipped || result.Extracted != 0 {
+			t.Errorf("Expected %s to be skipped, got %+v", result.BankFile, result)
+		}
+	}
+}
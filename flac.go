@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5" // #nosec G501 -- FLAC's STREAMINFO defines an MD5 of the audio
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// flacBlockSize is the number of samples per channel in each frame
+	flacBlockSize = 4096
+
+	// flacMaxPartitionOrder bounds the Rice partition search
+	flacMaxPartitionOrder = 8
+
+	// flacMaxFixedOrder is the highest fixed predictor FLAC defines
+	flacMaxFixedOrder = 4
+
+	flacVendor = "sky-fsbext " + version
+)
+
+// FLAC channel assignments for stereo decorrelation
+const (
+	flacLeftSide  = 8
+	flacRightSide = 9
+	flacMidSide   = 10
+)
+
+// flacTag is one Vorbis comment, e.g. TITLE=...
+type flacTag struct {
+	Name  string
+	Value string
+}
+
+// bitWriter packs big-endian bit fields as FLAC frames need them
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// write appends the low n bits of value
+func (w *bitWriter) write(value uint64, n uint) {
+	if n > 32 {
+		w.write(value>>32, n-32)
+		n = 32
+	}
+	w.acc = w.acc<<n | value&(1<<n-1)
+	w.nbits += n
+	w.flush()
+}
+
+// flush moves completed bytes from the accumulator to the buffer
+func (w *bitWriter) flush() {
+	for w.nbits >= 8 {
+		w.nbits -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.nbits))
+	}
+	w.acc &= 1<<w.nbits - 1
+}
+
+// writeSigned appends value as an n-bit two's complement number
+func (w *bitWriter) writeSigned(value int64, n uint) {
+	w.write(uint64(value)&(1<<n-1), n)
+}
+
+// writeUnary appends value zero bits followed by a one
+func (w *bitWriter) writeUnary(value uint64) {
+	for value >= 32 {
+		w.write(0, 32)
+		value -= 32
+	}
+	w.write(1, uint(value)+1)
+}
+
+// align pads with zero bits to the next byte boundary
+func (w *bitWriter) align() {
+	if w.nbits%8 != 0 {
+		w.write(0, 8-w.nbits%8)
+	}
+}
+
+// crc8 is FLAC's frame header checksum (polynomial 0x07)
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crc16 is FLAC's frame checksum (polynomial 0x8005)
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encodeFLAC writes audio as a FLAC stream with the given Vorbis comments
+func encodeFLAC(w io.Writer, audio *pcmAudio, tags []flacTag) error {
+	if audio.Channels < 1 || audio.Channels > 8 {
+		return fmt.Errorf("FLAC supports 1 to 8 channels, got %d", audio.Channels)
+	}
+	if audio.BitsPerSample < 4 || audio.BitsPerSample > 24 {
+		return fmt.Errorf("unsupported bit depth %d for FLAC", audio.BitsPerSample)
+	}
+	if audio.SampleRate < 1 || audio.SampleRate >= 1<<20 {
+		return fmt.Errorf("unsupported sample rate %d for FLAC", audio.SampleRate)
+	}
+
+	frames := audio.frames()
+	var encoded [][]byte
+	minFrame, maxFrame := math.MaxInt, 0
+	for start, number := 0, 0; start < frames; start, number = start+flacBlockSize, number+1 {
+		frame := encodeFLACFrame(audio, start, min(flacBlockSize, frames-start), number)
+		minFrame = min(minFrame, len(frame))
+		maxFrame = max(maxFrame, len(frame))
+		encoded = append(encoded, frame)
+	}
+	if len(encoded) == 0 {
+		minFrame = 0
+	}
+
+	if _, err := w.Write([]byte("fLaC")); err != nil {
+		return err
+	}
+	if _, err := w.Write(flacStreamInfo(audio, minFrame, maxFrame)); err != nil {
+		return err
+	}
+	if _, err := w.Write(flacMetadataBlock(4, true, vorbisComment(tags))); err != nil {
+		return err
+	}
+	for _, frame := range encoded {
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flacMetadataBlock wraps a metadata block body in its header
+func flacMetadataBlock(blockType byte, last bool, body []byte) []byte {
+	header := []byte{blockType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	if last {
+		header[0] |= 0x80
+	}
+	return append(header, body...)
+}
+
+// flacStreamBlockSize returns the block size STREAMINFO records: the fixed
+// size, or the size of the only block of a shorter stream, kept to the 16
+// samples the format allows at least
+func flacStreamBlockSize(frames int) int {
+	if frames >= flacBlockSize {
+		return flacBlockSize
+	}
+	return max(frames, 16)
+}
+
+// flacStreamInfo builds the STREAMINFO block with the MD5 of the audio
+func flacStreamInfo(audio *pcmAudio, minFrame, maxFrame int) []byte {
+	frames := audio.frames()
+	blockSize := uint64(flacStreamBlockSize(frames))
+	var w bitWriter
+	w.write(blockSize, 16)
+	w.write(blockSize, 16)
+	w.write(uint64(minFrame), 24)
+	w.write(uint64(maxFrame), 24)
+	w.write(uint64(audio.SampleRate), 20)
+	w.write(uint64(audio.Channels-1), 3)
+	w.write(uint64(audio.BitsPerSample-1), 5)
+	w.write(uint64(frames), 36)
+
+	// The MD5 covers the samples as signed little-endian integers
+	width := (audio.BitsPerSample + 7) / 8
+	hash := md5.New() // #nosec G401
+	sample := make([]byte, 4)
+	for _, s := range audio.Samples {
+		binary.LittleEndian.PutUint32(sample, uint32(s))
+		hash.Write(sample[:width])
+	}
+	return flacMetadataBlock(0, false, append(w.buf, hash.Sum(nil)...))
+}
+
+// vorbisComment builds the body of a VORBIS_COMMENT block
+func vorbisComment(tags []flacTag) []byte {
+	var body []byte
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(flacVendor)))
+	body = append(body, flacVendor...)
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(tags)))
+	for _, tag := range tags {
+		comment := tag.Name + "=" + tag.Value
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(comment)))
+		body = append(body, comment...)
+	}
+	return body
+}
+
+// flacSampleRateCode returns the frame header code for common sample rates,
+// or 0 to take the rate from STREAMINFO
+func flacSampleRateCode(rate int) uint64 {
+	codes := map[int]uint64{
+		88200: 1, 176400: 2, 192000: 3, 8000: 4, 16000: 5, 22050: 6,
+		24000: 7, 32000: 8, 44100: 9, 48000: 10, 96000: 11,
+	}
+	return codes[rate]
+}
+
+// flacSampleSizeCode returns the frame header code for the bit depth, or 0
+// to take it from STREAMINFO
+func flacSampleSizeCode(bitsPerSample int) uint64 {
+	codes := map[int]uint64{8: 1, 12: 2, 16: 4, 20: 5, 24: 6}
+	return codes[bitsPerSample]
+}
+
+// encodeFLACFrame encodes one block of samples
+func encodeFLACFrame(audio *pcmAudio, start, size, number int) []byte {
+	channels := make([][]int64, audio.Channels)
+	for ch := range channels {
+		channels[ch] = make([]int64, size)
+		for i := 0; i < size; i++ {
+			channels[ch][i] = int64(audio.Samples[(start+i)*audio.Channels+ch])
+		}
+	}
+
+	bps := uint(audio.BitsPerSample)
+	assignment := uint64(audio.Channels - 1)
+	subframes := make([]*subframeBits, audio.Channels)
+	if audio.Channels == 2 {
+		assignment, subframes = encodeStereo(channels[0], channels[1], bps)
+	} else {
+		for ch, samples := range channels {
+			subframes[ch] = buildSubframe(samples, bps)
+		}
+	}
+
+	var w bitWriter
+	w.write(0xFFF8, 16) // sync code, fixed block size
+
+	blockSizeCode := uint64(12) // 4096
+	if size != flacBlockSize {
+		blockSizeCode = 7 // 16-bit size at the end of the header
+	}
+	w.write(blockSizeCode, 4)
+	w.write(flacSampleRateCode(audio.SampleRate), 4)
+	w.write(assignment, 4)
+	w.write(flacSampleSizeCode(audio.BitsPerSample), 3)
+	w.write(0, 1)
+	for _, b := range utf8FrameNumber(uint64(number)) {
+		w.write(uint64(b), 8)
+	}
+	if blockSizeCode == 7 {
+		w.write(uint64(size-1), 16)
+	}
+	w.write(uint64(crc8(w.buf)), 8)
+
+	// Subframes follow each other bit by bit; only the frame is byte aligned
+	for _, subframe := range subframes {
+		appendBits(&w, subframe)
+	}
+	w.align()
+	return binary.BigEndian.AppendUint16(w.buf, crc16(w.buf))
+}
+
+// utf8FrameNumber codes a frame number the way FLAC extends UTF-8
+func utf8FrameNumber(n uint64) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	// Each continuation byte carries 6 bits and takes one from the lead byte
+	extra := 1
+	for n >= 1<<(5*extra+6) {
+		extra++
+	}
+	coded := make([]byte, extra+1)
+	for i := extra; i > 0; i-- {
+		coded[i] = 0x80 | byte(n&0x3F)
+		n >>= 6
+	}
+	coded[0] = byte(0xFF<<(7-extra)) | byte(n)
+	return coded
+}
+
+// subframeBits is an encoded subframe whose length isn't byte aligned
+type subframeBits struct {
+	w bitWriter
+}
+
+// bitLength returns the number of bits written so far
+func (s *subframeBits) bitLength() int {
+	return len(s.w.buf)*8 + int(s.w.nbits)
+}
+
+// encodeStereo tries the four stereo channel assignments and keeps the smallest
+func encodeStereo(left, right []int64, bps uint) (uint64, []*subframeBits) {
+	side := make([]int64, len(left))
+	mid := make([]int64, len(left))
+	for i := range left {
+		side[i] = left[i] - right[i]
+		mid[i] = (left[i] + right[i]) >> 1
+	}
+
+	type candidate struct {
+		assignment uint64
+		subframes  []*subframeBits
+	}
+	l, r := buildSubframe(left, bps), buildSubframe(right, bps)
+	s, m := buildSubframe(side, bps+1), buildSubframe(mid, bps)
+	candidates := []candidate{
+		{1, []*subframeBits{l, r}},
+		{flacLeftSide, []*subframeBits{l, s}},
+		{flacRightSide, []*subframeBits{s, r}},
+		{flacMidSide, []*subframeBits{m, s}},
+	}
+	size := func(c candidate) int {
+		return c.subframes[0].bitLength() + c.subframes[1].bitLength()
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if size(c) < size(best) {
+			best = c
+		}
+	}
+	return best.assignment, best.subframes
+}
+
+// appendBits copies an unaligned subframe into w
+func appendBits(w *bitWriter, s *subframeBits) {
+	for _, b := range s.w.buf {
+		w.write(uint64(b), 8)
+	}
+	if s.w.nbits > 0 {
+		w.write(s.w.acc, s.w.nbits)
+	}
+}
+
+// buildSubframe picks the smallest of the constant, verbatim and fixed
+// predictor encodings of a channel
+func buildSubframe(samples []int64, bps uint) *subframeBits {
+	constant := true
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		sub := &subframeBits{}
+		sub.w.write(0, 8) // CONSTANT
+		sub.w.writeSigned(samples[0], bps)
+		return sub
+	}
+
+	best := &subframeBits{}
+	best.w.write(0x02, 8) // VERBATIM
+	for _, s := range samples {
+		best.w.writeSigned(s, bps)
+	}
+
+	for order := 0; order <= flacMaxFixedOrder && order < len(samples); order++ {
+		residual := fixedResidual(samples, order)
+		sub := &subframeBits{}
+		sub.w.write(uint64(0x08|order)<<1, 8) // FIXED with the order
+		for _, s := range samples[:order] {
+			sub.w.writeSigned(s, bps)
+		}
+		writeResidual(&sub.w, residual, len(samples), order)
+		if sub.bitLength() < best.bitLength() {
+			best = sub
+		}
+	}
+	return best
+}
+
+// fixedResidual applies FLAC's fixed polynomial predictor of the given order
+func fixedResidual(samples []int64, order int) []int64 {
+	residual := make([]int64, len(samples)-order)
+	for i := order; i < len(samples); i++ {
+		var prediction int64
+		switch order {
+		case 1:
+			prediction = samples[i-1]
+		case 2:
+			prediction = 2*samples[i-1] - samples[i-2]
+		case 3:
+			prediction = 3*samples[i-1] - 3*samples[i-2] + samples[i-3]
+		case 4:
+			prediction = 4*samples[i-1] - 6*samples[i-2] + 4*samples[i-3] - samples[i-4]
+		}
+		residual[i-order] = samples[i] - prediction
+	}
+	return residual
+}
+
+// zigzag folds a signed residual into the unsigned value Rice coding uses
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// riceCost returns the best Rice parameter for the values and the bits it takes
+func riceCost(values []uint64) (uint, int) {
+	var sum uint64
+	for _, v := range values {
+		sum += v
+	}
+	// Start from the estimate log2(mean) and check its neighbours
+	guess := uint(0)
+	if n := uint64(len(values)); n > 0 && sum > n {
+		guess = uint(bits.Len64(sum/n)) - 1
+	}
+
+	guess = min(guess, 29)
+
+	bestParam, bestBits := uint(0), math.MaxInt
+	for param := guess; param <= guess+1; param++ {
+		total := len(values) * int(param+1)
+		for _, v := range values {
+			total += int(v >> param)
+		}
+		if total < bestBits {
+			bestParam, bestBits = param, total
+		}
+	}
+	if guess > 0 {
+		total := len(values) * int(guess)
+		for _, v := range values {
+			total += int(v >> (guess - 1))
+		}
+		if total < bestBits {
+			bestParam, bestBits = guess-1, total
+		}
+	}
+	return bestParam, bestBits
+}
+
+// writeResidual Rice-codes the residual with the partition order that gives
+// the fewest bits
+func writeResidual(w *bitWriter, residual []int64, blockSize, order int) {
+	folded := make([]uint64, len(residual))
+	for i, r := range residual {
+		folded[i] = zigzag(r)
+	}
+
+	bestOrder, bestBits := 0, math.MaxInt
+	var bestParams []uint
+	for partitionOrder := 0; partitionOrder <= flacMaxPartitionOrder; partitionOrder++ {
+		partitions := 1 << partitionOrder
+		if blockSize%partitions != 0 || blockSize>>partitionOrder <= order {
+			break
+		}
+		params := make([]uint, partitions)
+		total := 0
+		for p, offset := 0, 0; p < partitions; p++ {
+			count := blockSize >> partitionOrder
+			if p == 0 {
+				count -= order
+			}
+			param, cost := riceCost(folded[offset : offset+count])
+			params[p] = param
+			total += cost + 5
+			offset += count
+		}
+		if total < bestBits {
+			bestOrder, bestBits, bestParams = partitionOrder, total, params
+		}
+	}
+
+	// 4-bit parameters go up to 14, larger ones need the 5-bit method
+	method, paramBits := uint64(0), uint(4)
+	for _, param := range bestParams {
+		if param >= 15 {
+			method, paramBits = 1, 5
+		}
+	}
+	w.write(method, 2)
+	w.write(uint64(bestOrder), 4)
+	offset := 0
+	for p, param := range bestParams {
+		count := blockSize >> bestOrder
+		if p == 0 {
+			count -= order
+		}
+		w.write(uint64(param), paramBits)
+		for _, v := range folded[offset : offset+count] {
+			w.writeUnary(v >> param)
+			if param > 0 {
+				w.write(v, param)
+			}
+		}
+		offset += count
+	}
+}
+
+const (
+	formatWAV  = "wav"
+	formatFLAC = "flac"
+
+	// flacSizeRatio is roughly how much smaller FLAC is than the WAV it
+	// replaces, used for the disk space check
+	flacSizeRatio = 0.6
+)
+
+// outputFormat is the audio format of the extracted files
+var outputFormat = formatWAV
+
+// validateOutputFormat checks the --format option
+func validateOutputFormat(format string) error {
+	if format != formatWAV && format != formatFLAC {
+		return fmt.Errorf("unknown format %q, expected %s or %s", format, formatWAV, formatFLAC)
+	}
+	return nil
+}
+
+// flacTags builds the Vorbis comments of an output file from its track
+// mapping and the bank and subsong metadata
+func flacTags(result bankResult, file outputFile) []flacTag {
+	bankName := strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile))
+	subsongName := streamName(result, file.Subsong)
+
+	media := describeOutput(result, file)
+	tags := []flacTag{{"TITLE", media.Title}, {"ALBUM", media.Album}}
+	if media.Track > 0 {
+		tags = append(tags, flacTag{"TRACKNUMBER", strconv.Itoa(media.Track)})
+	}
+	if media.Artist != "" {
+		tags = append(tags, flacTag{"COMPOSER", media.Artist}, flacTag{"ARTIST", media.Artist})
+	}
+	if media.Genre != "" {
+		tags = append(tags, flacTag{"GENRE", media.Genre})
+	}
+	tags = append(tags, flacTag{"COMMENT", media.Comment})
+
+	if stream, ok := findStream(result, file.Subsong); ok {
+		tags = append(tags, loopTags(convertedStream(stream))...)
+	}
+	tags = append(tags, flacTag{"SKY_BANK", bankName})
+	if file.Subsong > 0 {
+		tags = append(tags, flacTag{"SKY_SUBSONG", strconv.Itoa(file.Subsong)})
+	}
+	if subsongName != "" {
+		tags = append(tags, flacTag{"SKY_STREAM", subsongName})
+	}
+	for _, tag := range []flacTag{
+		{"SKY_CATEGORY", result.Category},
+		{"SKY_REALM", file.Tags.Realm},
+		{"SKY_SEASON", file.Tags.Season},
+		{"SKY_TYPE", file.Tags.Type},
+	} {
+		if tag.Value != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// encodeOutputFiles replaces the decoded WAV files in dir with FLAC files
+// when --format flac is set. The hash of the decoded audio is kept so track
+// mappings by hash work for both formats.
+func encodeOutputFiles(result bankResult, dir string, files []outputFile) error {
+	if outputFormat != formatFLAC {
+		return nil
+	}
+	for i := range files {
+		if !strings.EqualFold(filepath.Ext(files[i].Name), ".wav") {
+			continue
+		}
+		wavPath := filepath.Join(dir, files[i].Name)
+		name := strings.TrimSuffix(files[i].Name, filepath.Ext(files[i].Name)) + ".flac"
+		if err := transcodeToFLAC(wavPath, filepath.Join(dir, name), flacTags(result, files[i])); err != nil {
+			return fmt.Errorf("failed to encode %s: %v", wavPath, err)
+		}
+		if err := os.Remove(wavPath); err != nil {
+			return err
+		}
+
+		files[i].Name = name
+		if err := files[i].rehash(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transcodeToFLAC encodes a WAV file as a FLAC file
+func transcodeToFLAC(wavPath, flacPath string, tags []flacTag) error {
+	audio, _, err := readWAVFile(wavPath)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Clean(flacPath), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := encodeFLAC(writer, audio, tags); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeFLACStream encodes a subsong decoded for stdout, tagged the same way
+// as extracted files
+func writeFLACStream(w io.Writer, bankFile string, streams []streamInfo, subsong int, wav []byte) error {
+	audio, _, err := parseWAV(wav)
+	if err != nil {
+		return err
+	}
+	bankName := strings.TrimSuffix(filepath.Base(bankFile), filepath.Ext(bankFile))
+	result := bankResult{BankFile: bankFile, Category: classifyBank(bankName), Streams: streams}
+	result.Tags = bankTags(bankName, result.Category)
+
+	sum := sha256.Sum256(wav)
+	subsongName := streamName(result, subsong)
+	file := outputFile{
+		Subsong: subsong,
+		Tags:    tagSubsong(result.Tags, subsongName),
+		Track:   lookupTrack(bankName, subsongName, hex.EncodeToString(sum[:])),
+	}
+	return encodeFLAC(w, audio, flacTags(result, file))
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec G501
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bitReader reads the big-endian bit fields of a FLAC stream
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) read(n int) (uint64, error) {
+	if r.pos+n > len(r.data)*8 {
+		return 0, errors.New("unexpected end of stream")
+	}
+	var value uint64
+	for i := 0; i < n; i++ {
+		bit := r.data[(r.pos+i)/8] >> (7 - (r.pos+i)%8) & 1
+		value = value<<1 | uint64(bit)
+	}
+	r.pos += n
+	return value, nil
+}
+
+func (r *bitReader) readSigned(n int) (int64, error) {
+	value, err := r.read(n)
+	if err != nil {
+		return 0, err
+	}
+	return int64(value<<(64-n)) >> (64 - n), nil
+}
+
+func (r *bitReader) readUnary() (uint64, error) {
+	var count uint64
+	for {
+		bit, err := r.read(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			return count, nil
+		}
+		count++
+	}
+}
+
+// decodedFLAC is what decodeFLAC recovers from a stream
+type decodedFLAC struct {
+	audio    pcmAudio
+	comments []string
+	md5      []byte
+}
+
+// decodeFLAC is a minimal decoder covering what encodeFLAC writes, used to
+// check the encoder independently of external tools
+func decodeFLAC(data []byte) (*decodedFLAC, error) {
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		return nil, errors.New("missing fLaC marker")
+	}
+	decoded := &decodedFLAC{}
+	var totalFrames uint64
+	pos := 4
+	for last := false; !last; {
+		header := data[pos : pos+4]
+		last = header[0]&0x80 != 0
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		body := data[pos+4 : pos+4+size]
+		switch header[0] & 0x7F {
+		case 0:
+			r := &bitReader{data: body}
+			_, _ = r.read(16 + 16 + 24 + 24)
+			rate, _ := r.read(20)
+			channels, _ := r.read(3)
+			bps, _ := r.read(5)
+			totalFrames, _ = r.read(36)
+			decoded.audio = pcmAudio{SampleRate: int(rate), Channels: int(channels) + 1, BitsPerSample: int(bps) + 1}
+			decoded.md5 = body[18:34]
+		case 4:
+			vendorLength := int(binary.LittleEndian.Uint32(body))
+			rest := body[4+vendorLength:]
+			count := int(binary.LittleEndian.Uint32(rest))
+			rest = rest[4:]
+			for i := 0; i < count; i++ {
+				length := int(binary.LittleEndian.Uint32(rest))
+				decoded.comments = append(decoded.comments, string(rest[4:4+length]))
+				rest = rest[4+length:]
+			}
+		}
+		pos += 4 + size
+	}
+
+	audio := &decoded.audio
+	for pos < len(data) {
+		frameSize, err := decodeFLACFrame(data[pos:], audio)
+		if err != nil {
+			return nil, fmt.Errorf("frame at byte %d: %v", pos, err)
+		}
+		pos += frameSize
+	}
+	if uint64(audio.frames()) != totalFrames {
+		return nil, fmt.Errorf("decoded %d samples, STREAMINFO says %d", audio.frames(), totalFrames)
+	}
+	return decoded, nil
+}
+
+// decodeFLACFrame decodes one frame, appends its samples to audio and returns
+// the frame size
+func decodeFLACFrame(data []byte, audio *pcmAudio) (int, error) {
+	r := &bitReader{data: data}
+	if sync, _ := r.read(16); sync != 0xFFF8 {
+		return 0, fmt.Errorf("bad sync code %x", sync)
+	}
+	blockSizeCode, _ := r.read(4)
+	_, _ = r.read(4) // sample rate code
+	assignment, _ := r.read(4)
+	_, _ = r.read(4) // sample size code and reserved bit
+	lead, _ := r.read(8)
+	for extra := 0; lead&(0x80>>extra) != 0 && extra < 7; extra++ {
+		if extra > 0 {
+			_, _ = r.read(8)
+		}
+	}
+	blockSize := flacBlockSize
+	if blockSizeCode == 7 {
+		size, _ := r.read(16)
+		blockSize = int(size) + 1
+	} else if blockSizeCode != 12 {
+		return 0, fmt.Errorf("unexpected block size code %d", blockSizeCode)
+	}
+	headerEnd := r.pos / 8
+	if crc, _ := r.read(8); byte(crc) != crc8(data[:headerEnd]) {
+		return 0, errors.New("header CRC mismatch")
+	}
+
+	bps := audio.BitsPerSample
+	channels := make([][]int64, audio.Channels)
+	for ch := range channels {
+		channelBps := bps
+		if (assignment == flacLeftSide && ch == 1) || (assignment == flacRightSide && ch == 0) || (assignment == flacMidSide && ch == 1) {
+			channelBps++
+		}
+		samples, err := decodeSubframe(r, blockSize, channelBps)
+		if err != nil {
+			return 0, fmt.Errorf("channel %d: %v", ch, err)
+		}
+		channels[ch] = samples
+	}
+	for i := 0; i < blockSize; i++ {
+		switch assignment {
+		case flacLeftSide:
+			channels[1][i] = channels[0][i] - channels[1][i]
+		case flacRightSide:
+			channels[0][i] += channels[1][i]
+		case flacMidSide:
+			mid, side := channels[0][i]<<1|channels[1][i]&1, channels[1][i]
+			channels[0][i], channels[1][i] = (mid+side)>>1, (mid-side)>>1
+		}
+		for ch := range channels {
+			audio.Samples = append(audio.Samples, int32(channels[ch][i]))
+		}
+	}
+
+	if r.pos%8 != 0 {
+		r.pos += 8 - r.pos%8
+	}
+	end := r.pos / 8
+	if crc, _ := r.read(16); uint16(crc) != crc16(data[:end]) {
+		return 0, errors.New("frame CRC mismatch")
+	}
+	return end + 2, nil
+}
+
+// decodeSubframe decodes the constant, verbatim and fixed subframes
+func decodeSubframe(r *bitReader, blockSize, bps int) ([]int64, error) {
+	header, err := r.read(8)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]int64, blockSize)
+	kind := header >> 1
+	switch {
+	case kind == 0:
+		value, err := r.readSigned(bps)
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i] = value
+		}
+	case kind == 1:
+		for i := range samples {
+			if samples[i], err = r.readSigned(bps); err != nil {
+				return nil, err
+			}
+		}
+	case kind&0x38 == 0x08:
+		order := int(kind & 0x07)
+		for i := 0; i < order; i++ {
+			if samples[i], err = r.readSigned(bps); err != nil {
+				return nil, err
+			}
+		}
+		if err := decodeResidual(r, samples, order); err != nil {
+			return nil, err
+		}
+		for i := order; i < blockSize; i++ {
+			switch order {
+			case 1:
+				samples[i] += samples[i-1]
+			case 2:
+				samples[i] += 2*samples[i-1] - samples[i-2]
+			case 3:
+				samples[i] += 3*samples[i-1] - 3*samples[i-2] + samples[i-3]
+			case 4:
+				samples[i] += 4*samples[i-1] - 6*samples[i-2] + 4*samples[i-3] - samples[i-4]
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected subframe header %x", header)
+	}
+	return samples, nil
+}
+
+// decodeResidual reads the Rice-coded residual into samples[order:]
+func decodeResidual(r *bitReader, samples []int64, order int) error {
+	method, _ := r.read(2)
+	paramBits := 4
+	if method == 1 {
+		paramBits = 5
+	}
+	partitionOrder, _ := r.read(4)
+	partitions := 1 << partitionOrder
+	i := order
+	for p := 0; p < partitions; p++ {
+		count := len(samples) >> partitionOrder
+		if p == 0 {
+			count -= order
+		}
+		param, err := r.read(paramBits)
+		if err != nil {
+			return err
+		}
+		for n := 0; n < count; n++ {
+			high, err := r.readUnary()
+			if err != nil {
+				return err
+			}
+			low, err := r.read(int(param))
+			if err != nil {
+				return err
+			}
+			folded := high<<param | low
+			samples[i] = int64(folded>>1) ^ -int64(folded&1)
+			i++
+		}
+	}
+	return nil
+}
+
+// testAudio generates a deterministic signal with some noise
+func testAudio(rate, channels, bps, frames int) *pcmAudio {
+	audio := &pcmAudio{SampleRate: rate, Channels: channels, BitsPerSample: bps}
+	peak := float64(int64(1)<<(bps-1) - 1)
+	seed := uint32(1)
+	for i := 0; i < frames; i++ {
+		for ch := 0; ch < channels; ch++ {
+			seed = seed*1664525 + 1013904223
+			noise := float64(int32(seed)>>24) / 128 * 0.01
+			value := 0.6*math.Sin(float64(i)*0.03*float64(ch+1)) + noise
+			audio.Samples = append(audio.Samples, int32(math.Round(value*peak)))
+		}
+	}
+	return audio
+}
+
+func TestEncodeFLACRoundTrip(t *testing.T) {
+	silence := &pcmAudio{SampleRate: 22050, Channels: 2, BitsPerSample: 16, Samples: make([]int32, 2*5000)}
+	fullScale := &pcmAudio{SampleRate: 48000, Channels: 2, BitsPerSample: 16}
+	for i := 0; i < 3000; i++ {
+		fullScale.Samples = append(fullScale.Samples, math.MaxInt16, math.MinInt16)
+	}
+
+	tests := []struct {
+		name  string
+		audio *pcmAudio
+	}{
+		{"mono 16-bit", testAudio(44100, 1, 16, 10000)},
+		{"stereo 16-bit", testAudio(48000, 2, 16, 9000)},
+		{"stereo 24-bit", testAudio(96000, 2, 24, 5000)},
+		{"8-bit", testAudio(8000, 1, 8, 300)},
+		{"5.1 at an odd rate", testAudio(37800, 6, 16, 4100)},
+		{"silence", silence},
+		{"full scale", fullScale},
+		{"many frames", testAudio(48000, 1, 16, 140*flacBlockSize+7)},
+		{"single sample", testAudio(48000, 2, 16, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encoded bytes.Buffer
+			if err := encodeFLAC(&encoded, tt.audio, []flacTag{{"TITLE", "Test"}}); err != nil {
+				t.Fatalf("encodeFLAC returned an error: %v", err)
+			}
+			decoded, err := decodeFLAC(encoded.Bytes())
+			if err != nil {
+				t.Fatalf("Failed to decode the encoded stream: %v", err)
+			}
+
+			got := decoded.audio
+			if got.SampleRate != tt.audio.SampleRate || got.Channels != tt.audio.Channels || got.BitsPerSample != tt.audio.BitsPerSample {
+				t.Errorf("Expected %d Hz, %d channels, %d bits, got %d Hz, %d channels, %d bits",
+					tt.audio.SampleRate, tt.audio.Channels, tt.audio.BitsPerSample, got.SampleRate, got.Channels, got.BitsPerSample)
+			}
+			if len(got.Samples) != len(tt.audio.Samples) {
+				t.Fatalf("Expected %d samples, got %d", len(tt.audio.Samples), len(got.Samples))
+			}
+			for i := range got.Samples {
+				if got.Samples[i] != tt.audio.Samples[i] {
+					t.Fatalf("Sample %d differs: expected %d, got %d", i, tt.audio.Samples[i], got.Samples[i])
+				}
+			}
+
+			hash := md5.New() // #nosec G401
+			width := (tt.audio.BitsPerSample + 7) / 8
+			for _, s := range tt.audio.Samples {
+				var b [4]byte
+				binary.LittleEndian.PutUint32(b[:], uint32(s))
+				hash.Write(b[:width])
+			}
+			if !bytes.Equal(hash.Sum(nil), decoded.md5) {
+				t.Errorf("STREAMINFO MD5 doesn't match the samples")
+			}
+			if len(decoded.comments) != 1 || decoded.comments[0] != "TITLE=Test" {
+				t.Errorf("Expected the TITLE comment, got %v", decoded.comments)
+			}
+		})
+	}
+
+	noisy := testAudio(48000, 2, 16, 20000)
+	var encoded bytes.Buffer
+	if err := encodeFLAC(&encoded, noisy, nil); err != nil {
+		t.Fatalf("encodeFLAC returned an error: %v", err)
+	}
+	if wavSize := len(noisy.Samples) * 2; encoded.Len() > wavSize*3/4 {
+		t.Errorf("Expected a tonal signal to compress well, got %d bytes from %d", encoded.Len(), wavSize)
+	}
+}
+
+func TestFLACStreamInfoBlockSize(t *testing.T) {
+	for _, tt := range []struct {
+		frames, blockSize int
+	}{
+		{0, 16},
+		{1, 16},
+		{1000, 1000},
+		{flacBlockSize, flacBlockSize},
+		{3*flacBlockSize + 5, flacBlockSize},
+	} {
+		var encoded bytes.Buffer
+		if err := encodeFLAC(&encoded, testAudio(48000, 2, 16, tt.frames), nil); err != nil {
+			t.Fatalf("encodeFLAC returned an error: %v", err)
+		}
+		// STREAMINFO starts after the marker and its block header
+		data := encoded.Bytes()
+		minBlock, maxBlock := binary.BigEndian.Uint16(data[8:10]), binary.BigEndian.Uint16(data[10:12])
+		if int(minBlock) != tt.blockSize || int(maxBlock) != tt.blockSize {
+			t.Errorf("%d frames: expected block sizes of %d, got %d and %d", tt.frames, tt.blockSize, minBlock, maxBlock)
+		}
+	}
+}
+
+// TestEncodeFLACReferenceDecoder checks the encoder against the reference
+// flac tool, which the decoder in these tests can't stand in for
+func TestEncodeFLACReferenceDecoder(t *testing.T) {
+	flacPath, err := exec.LookPath("flac")
+	if err != nil {
+		t.Skip("flac is not installed")
+	}
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	tests := []struct {
+		name  string
+		audio *pcmAudio
+	}{
+		{"mono 16-bit", testAudio(44100, 1, 16, 10000)},
+		{"stereo 24-bit", testAudio(96000, 2, 24, 5000)},
+		{"8-bit", testAudio(8000, 1, 8, 300)},
+		{"5.1 at an odd rate", testAudio(37800, 6, 16, 4100)},
+		{"one short block", testAudio(48000, 2, 16, 1000)},
+		{"single sample", testAudio(48000, 2, 16, 1)},
+		{"many frames", testAudio(48000, 2, 16, 40*flacBlockSize+7)},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flacFile := filepath.Join(tempDir, fmt.Sprintf("%d.flac", i))
+			wavFile := filepath.Join(tempDir, fmt.Sprintf("%d.wav", i))
+			var encoded bytes.Buffer
+			if err := encodeFLAC(&encoded, tt.audio, []flacTag{{"TITLE", "Test"}}); err != nil {
+				t.Fatalf("encodeFLAC returned an error: %v", err)
+			}
+			if err := os.WriteFile(flacFile, encoded.Bytes(), 0600); err != nil {
+				t.Fatalf("Failed to write FLAC: %v", err)
+			}
+
+			// -t checks the frames, their CRCs and the MD5 in STREAMINFO
+			if output, err := exec.Command(flacPath, "-t", "-s", flacFile).CombinedOutput(); err != nil {
+				t.Fatalf("flac -t rejected the stream: %v\n%s", err, output)
+			}
+			if output, err := exec.Command(flacPath, "-d", "-s", "-f", "-o", wavFile, flacFile).CombinedOutput(); err != nil {
+				t.Fatalf("flac -d failed: %v\n%s", err, output)
+			}
+			got, _, err := readWAVFile(wavFile)
+			if err != nil {
+				t.Fatalf("Failed to read the decoded WAV: %v", err)
+			}
+			if got.SampleRate != tt.audio.SampleRate || got.Channels != tt.audio.Channels || got.BitsPerSample != tt.audio.BitsPerSample {
+				t.Errorf("Expected %d Hz, %d channels, %d bits, got %d Hz, %d channels, %d bits",
+					tt.audio.SampleRate, tt.audio.Channels, tt.audio.BitsPerSample, got.SampleRate, got.Channels, got.BitsPerSample)
+			}
+			if len(got.Samples) != len(tt.audio.Samples) {
+				t.Fatalf("Expected %d samples, got %d", len(tt.audio.Samples), len(got.Samples))
+			}
+			for j := range got.Samples {
+				if got.Samples[j] != tt.audio.Samples[j] {
+					t.Fatalf("Sample %d differs: expected %d, got %d", j, tt.audio.Samples[j], got.Samples[j])
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeFLACRejectsUnsupportedAudio(t *testing.T) {
+	for _, audio := range []*pcmAudio{
+		{SampleRate: 48000, Channels: 2, BitsPerSample: 32},
+		{SampleRate: 48000, Channels: 9, BitsPerSample: 16},
+		{SampleRate: 0, Channels: 2, BitsPerSample: 16},
+	} {
+		if err := encodeFLAC(&bytes.Buffer{}, audio, nil); err == nil {
+			t.Errorf("Expected an error for %+v", audio)
+		}
+	}
+}
+
+func TestUTF8FrameNumber(t *testing.T) {
+	tests := map[uint64][]byte{
+		0:       {0x00},
+		0x7F:    {0x7F},
+		0x80:    {0xC2, 0x80},
+		0x7FF:   {0xDF, 0xBF},
+		0x800:   {0xE0, 0xA0, 0x80},
+		0xFFFF:  {0xEF, 0xBF, 0xBF},
+		0x10000: {0xF0, 0x90, 0x80, 0x80},
+	}
+	for n, expected := range tests {
+		if got := utf8FrameNumber(n); !bytes.Equal(got, expected) {
+			t.Errorf("utf8FrameNumber(%#x) = % x, expected % x", n, got, expected)
+		}
+	}
+}
+
+func TestEncodeOutputFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalFormat := outputFormat
+	defer func() { outputFormat = originalFormat }()
+	outputFormat = formatFLAC
+
+	audio := testAudio(48000, 2, 16, 6000)
+	var wav bytes.Buffer
+	if err := writeWAV(&wav, audio, nil); err != nil {
+		t.Fatalf("writeWAV returned an error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "00001_mus_theme.wav"), wav.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write WAV: %v", err)
+	}
+
+	result := bankResult{
+		BankFile: filepath.Join("in", "Music_Prairie.bank"),
+		Category: "Music",
+		Streams:  []streamInfo{{Index: 1, Name: "mus_theme"}},
+	}
+	files := []outputFile{{
+		Subsong: 1,
+		Name:    "00001_mus_theme.wav",
+		SHA256:  "wavhash",
+		Tags:    areaTags{Realm: "Prairie", Type: "Music"},
+		Track:   &trackInfo{Title: "Prairie Theme", Album: "Sky OST", Track: 3, Composer: "Vincent Diamante"},
+	}}
+	if err := encodeOutputFiles(result, tempDir, files); err != nil {
+		t.Fatalf("encodeOutputFiles returned an error: %v", err)
+	}
+
+	if files[0].Name != "00001_mus_theme.flac" || files[0].DecodedSHA256 != "wavhash" || files[0].SHA256 == "wavhash" {
+		t.Errorf("Unexpected output file after encoding: %+v", files[0])
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "00001_mus_theme.wav")); !os.IsNotExist(err) {
+		t.Errorf("Expected the WAV to be replaced")
+	}
+	data, err := os.ReadFile(filepath.Join(tempDir, files[0].Name))
+	if err != nil {
+		t.Fatalf("Failed to read FLAC: %v", err)
+	}
+	if int64(len(data)) != files[0].Size {
+		t.Errorf("Expected size %d, got %d", len(data), files[0].Size)
+	}
+	decoded, err := decodeFLAC(data)
+	if err != nil {
+		t.Fatalf("Failed to decode the FLAC file: %v", err)
+	}
+	if len(decoded.audio.Samples) != len(audio.Samples) {
+		t.Errorf("Expected %d samples, got %d", len(audio.Samples), len(decoded.audio.Samples))
+	}
+	comments := strings.Join(decoded.comments, "\n")
+	for _, expected := range []string{"TITLE=Prairie Theme", "ALBUM=Sky OST", "TRACKNUMBER=3", "COMPOSER=Vincent Diamante", "SKY_BANK=Music_Prairie", "SKY_SUBSONG=1", "SKY_STREAM=mus_theme", "SKY_REALM=Prairie"} {
+		if !strings.Contains(comments, expected) {
+			t.Errorf("Expected comment %s, got:\n%s", expected, comments)
+		}
+	}
+}
+
+func TestValidateOutputFormat(t *testing.T) {
+	for _, format := range []string{formatWAV, formatFLAC} {
+		if err := validateOutputFormat(format); err != nil {
+			t.Errorf("Expected %s to be valid: %v", format, err)
+		}
+	}
+	if err := validateOutputFormat("mp3"); err == nil {
+		t.Errorf("Expected an error for mp3")
+	}
+}
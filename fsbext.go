@@ -1,31 +1,45 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	author  = "Tibik"
 	version = "1.0.11"
+
+	// outputPattern names the files vgmstream writes into the staging directory:
+	// zero-padded subsong index and stream name. They are renamed according to
+	// the name template afterwards.
+	outputPattern = "?05s_?n.wav"
 )
 
 var (
-	verbose                bool
-	inputDir               string
-	outputDir              string
-	vgmstreamPath          string
-	compressionRatio       float64
-	maxWorkers             int
-	extractAndMoveFileFunc = extractAndMoveFile
+	verbose           bool
+	inputDir          string
+	outputDir         string
+	vgmstreamPath     string
+	compressionRatio  float64
+	maxWorkers        = 4
+	autoWorkers       bool
+	noSplit           bool
+	throttleWrites    bool
+	resume            bool
+	lockWait          time.Duration
+	staleLockAge      time.Duration
+	explicitBankFiles map[string]bool
+	prepareBankFunc   = prepareBank
+	decodeJobFunc     = runDecodeJob
 )
 
 var (
@@ -33,46 +47,205 @@ var (
 	summaryLogger *log.Logger
 )
 
-func init() {
-	flag.StringVar(&inputDir, "i", "in", "Path to the input directory.")
-	flag.StringVar(&inputDir, "input-dir", "in", "Path to the input directory.")
-	flag.StringVar(&outputDir, "o", "out", "Path to the output directory.")
-	flag.StringVar(&outputDir, "output-dir", "out", "Path to the output directory.")
-	flag.StringVar(&vgmstreamPath, "p", filepath.Join("vgmstream-win64", "vgmstream-cli.exe"), "Path to vgmstream-cli executable.")
-	flag.StringVar(&vgmstreamPath, "vgmstream-path", filepath.Join("vgmstream-win64", "vgmstream-cli.exe"), "Path to vgmstream-cli executable.")
-	flag.Float64Var(&compressionRatio, "c", 8.0, "Compression ratio used for calculating disk space requirements.")
-	flag.Float64Var(&compressionRatio, "compression-ratio", 8.0, "Compression ratio used for calculating disk space requirements.")
-	flag.BoolVar(&verbose, "v", false, "Enable verbose output.")
-	flag.BoolVar(&verbose, "verbose", false, "Enable verbose output.")
-	flag.IntVar(&maxWorkers, "w", 4, "Number of concurrent workers.")
-	flag.IntVar(&maxWorkers, "workers", 4, "Number of concurrent workers.")
+// registerExtractFlags registers the options of the extract command
+func registerExtractFlags(fs *flag.FlagSet) {
+	fs.StringVar(&inputDir, "i", "in", "Path to the input directory.")
+	fs.StringVar(&inputDir, "input-dir", "in", "Path to the input directory.")
+	fs.StringVar(&outputDir, "o", "out", "Path to the output directory, or - to write a single subsong to stdout.")
+	fs.StringVar(&outputDir, "output-dir", "out", "Path to the output directory, or - to write a single subsong to stdout.")
+	fs.StringVar(&vgmstreamPath, "p", filepath.Join("vgmstream-win64", "vgmstream-cli.exe"), "Path to vgmstream-cli executable.")
+	fs.StringVar(&vgmstreamPath, "vgmstream-path", filepath.Join("vgmstream-win64", "vgmstream-cli.exe"), "Path to vgmstream-cli executable.")
+	fs.Float64Var(&compressionRatio, "c", 8.0, "Compression ratio used for calculating disk space requirements.")
+	fs.Float64Var(&compressionRatio, "compression-ratio", 8.0, "Compression ratio used for calculating disk space requirements.")
+	fs.BoolVar(&verbose, "v", false, "Enable verbose output.")
+	fs.BoolVar(&verbose, "verbose", false, "Enable verbose output.")
+	fs.Var(workersValue{}, "w", "Number of concurrent workers, or \"auto\" to derive it from the CPU count and available memory.")
+	fs.StringVar(&subsongSpec, "subsongs", "", "Only extract these subsongs: comma-separated indices (3), ranges (4-7) and name globs or re: regular expressions.")
+	fs.Var(&includePatterns, "include", "Only extract banks matching this glob or re: regular expression; with a subsong: prefix, only subsongs whose name matches. Can be repeated.")
+	fs.Var(&excludePatterns, "exclude", "Skip banks matching this glob or re: regular expression; with a subsong: prefix, skip subsongs whose name matches. Can be repeated.")
+	fs.DurationVar(&minDuration, "min-duration", 0, "Skip subsongs shorter than this (e.g. 1s).")
+	fs.DurationVar(&maxDuration, "max-duration", 0, "Skip subsongs longer than this (e.g. 10m). 0 means no limit.")
+	fs.Var(workersValue{}, "workers", "Number of concurrent workers, or \"auto\" to derive it from the CPU count and available memory.")
+	fs.StringVar(&outputFormat, "format", formatWAV, "Audio format of the extracted files: wav, or flac to encode losslessly with the built-in encoder.")
+	fs.BoolVar(&noLoopPoints, "no-loop-points", false, "Don't write loop points into the output files (smpl and cue chunks in WAV, LOOPSTART and LOOPLENGTH comments in FLAC).")
+	fs.IntVar(&renderLoops, "render-loops", 0, "Render looping subsongs as their intro plus the loop body repeated this many times, followed by a fade-out. Other subsongs are left as decoded.")
+	fs.DurationVar(&renderDuration, "render-duration", 0, "Render looping subsongs to exactly this length (e.g. 3m), repeating the loop body as needed and fading out at the end. Can't be combined with --render-loops.")
+	fs.DurationVar(&renderFade, "render-fade", 10*time.Second, "Length of the fade-out of rendered loops.")
+	fs.DurationVar(&renderSilence, "render-silence", 0, "Silence added after the fade-out of rendered loops.")
+	fs.StringVar(&gameBuild, "game-build", "", "Sky build the banks come from, recorded in the comment of the output files' metadata.")
+	fs.BoolVar(&noWAVMetadata, "no-wav-metadata", false, "Don't embed a LIST/INFO chunk with title, album, genre, comment and track number in WAV files.")
+	fs.BoolVar(&writeID3, "id3", false, "Also embed the metadata of WAV files as an id3 chunk.")
+	fs.BoolVar(&measureLoudness, "loudness", false, "Measure the integrated loudness, loudness range and true peak of every subsong and record them in the manifests.")
+	fs.StringVar(&normalizeSpec, "normalize", "", "Normalise every subsong to this integrated loudness (e.g. -16LUFS), limiting true peaks to --true-peak. Implies --loudness.")
+	fs.StringVar(&truePeakSpec, "true-peak", "-1dBTP", "True peak ceiling for --normalize.")
+	fs.Float64Var(&silenceThreshold, "silence-threshold", -60, "Level in dBFS below which audio counts as silence. Subsongs that never rise above it are flagged as silent.")
+	fs.BoolVar(&trimSilence, "trim-silence", false, "Trim leading and trailing silence from subsongs that don't loop.")
+	fs.DurationVar(&trimPadding, "trim-padding", 20*time.Millisecond, "Silence kept before and after the audio when trimming.")
+	fs.BoolVar(&dropSilent, "drop-silent", false, "Don't keep the files of silent subsongs.")
+	fs.IntVar(&targetSampleRate, "sample-rate", 0, "Resample the output to this rate in Hz. By default the decoded rate is kept.")
+	fs.IntVar(&targetChannels, "channels", 0, "Mix the output to mono (1) or stereo (2), downmixing multichannel audio with the ITU-R BS.775 coefficients. By default the channels are kept.")
+	fs.StringVar(&targetBitDepth, "bit-depth", "", "Bit depth of the output: 16, 24 or 32f for 32-bit float WAV. By default the decoded depth is kept.")
+	fs.StringVar(&ditherMode, "dither", ditherTPDF, "Dither applied when converting to integer samples: tpdf or none.")
+	fs.StringVar(&stemSplit, "split-stems", "", "Split subsongs with more than two channels into one file per channel (channels) or per channel pair (pairs).")
+	fs.BoolVar(&renderWaveform, "waveform", false, "Render a PNG image of the waveform of every subsong.")
+	fs.BoolVar(&renderSpectrogram, "spectrogram", false, "Render a PNG spectrogram of every subsong.")
+	fs.StringVar(&imageSize, "image-size", "1200x300", "Size of the waveform and spectrogram images in pixels, as WIDTHxHEIGHT.")
+	fs.StringVar(&colormapName, "colormap", "magma", "Colour map of the images: magma, inferno, viridis or gray.")
+	fs.IntVar(&fftSize, "fft-size", 2048, "FFT size of the spectrogram in samples, a power of two.")
+	fs.IntVar(&fftHop, "fft-hop", 0, "Distance between the spectrogram's FFT frames in samples. By default a quarter of --fft-size.")
+	fs.StringVar(&fftWindow, "fft-window", windowHann, "Window function of the spectrogram: hann, hamming or blackman.")
+	fs.Float64Var(&spectrogramFloor, "spectrogram-floor", -120, "Level in dB shown as the darkest colour of the spectrogram.")
+	fs.BoolVar(&imagesTree, "images-tree", false, "Write the images into an images directory in the output directory, mirroring the audio tree, instead of next to the audio files.")
+	fs.BoolVar(&htmlReport, "html-report", false, "Write a static HTML report of the output directory into its report directory, with the banks by category, a search and audio players.")
+	fs.BoolVar(&noSplit, "no-split", false, "Decode every bank as a single job instead of splitting large banks into subsong ranges.")
+	fs.StringVar(&rulesPath, "rules", "", "Path to a JSON file with ordered rules that sort banks and subsongs into categories. By default banks are sorted into Music, SFX and Other by name prefix.")
+	fs.StringVar(&realmMapPath, "realm-map", "", "Path to a JSON file overriding the built-in realm, season and type tables.")
+	fs.StringVar(&layout, "layout", defaultLayout, "Template for the directory of each bank below the output directory. Placeholders: {category}, {bank}, {realm}, {season}, {type}; must contain {bank}.")
+	fs.StringVar(&nameTemplate, "name-template", defaultNameTemplate, "Template for output file names. Placeholders: {bank}, {category}, {index}, {name}, {channels}, {rate}, {duration}, {realm}, {season}, {type}, {title}, {album}, {track}, {composer}; numbers can be zero-padded as in {index:03}.")
+	fs.StringVar(&trackMapPath, "track-map", "", "Path to a JSON file mapping music subsongs to soundtrack titles, checked before the built-in mapping.")
+	fs.StringVar(&titleTemplate, "title-template", defaultTitleTemplate, "Template for the file names of mapped music tracks. Takes the --name-template placeholders plus {title}, {album}, {track}, {composer}.")
+	fs.BoolVar(&resume, "resume", false, "Continue an interrupted run, skipping banks the previous run completed.")
+	fs.DurationVar(&lockWait, "lock-wait", 0, "How long to wait for another run using the same output directory to finish (e.g. 10m). By default the run fails immediately.")
+	fs.DurationVar(&staleLockAge, "stale-lock-age", 24*time.Hour, "Age after which a lock on the output directory is considered stale even if its owner can't be checked. 0 disables this.")
+	fs.StringVar(&configPath, "config", "", "Path to a JSON config file. By default sky-fsbext.json in the working directory or sky-fsbext/config.json in the user config directory is used if present.")
+	fs.BoolVar(&printConfig, "print-config", false, "Print the effective configuration as JSON and exit.")
+	fs.BoolVar(&throttleWrites, "throttle", false, "Reduce concurrency when the output disk's write throughput saturates.")
 }
 
-func main() {
+// runExtract extracts every bank in the input directory, or the Steam
+// installation, into the output directory
+func runExtract(fs *flag.FlagSet) error {
+	if err := applyConfig(fs); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
 	setupLogging()
+	if printConfig {
+		// Keep stdout clean so the output can be saved as a config file
+		summaryLogger.SetOutput(fileLogger.Writer())
+	} else if outputDir == "-" {
+		// Stdout carries the audio
+		summaryLogger.SetOutput(io.MultiWriter(os.Stderr, fileLogger.Writer()))
+	}
 	defer summaryLogger.Println("========== Done, program exiting. ==========")
+	if configPath != "" {
+		log.Printf("Using config file %s\n", configPath)
+	}
+
+	summaryLogger.Printf("========== SKY-FSBEXT version: %s by %s ==========\n", version, author)
 
-	flag.Usage = func() {
-		_, err := fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	if err := validateNameTemplate(nameTemplate, nameTemplateKeys); err != nil {
+		summaryLogger.Fatalf("Invalid name template: %v\n", err)
+	}
+
+	if err := validateNameTemplate(titleTemplate, nameTemplateKeys); err != nil {
+		summaryLogger.Fatalf("Invalid title template: %v\n", err)
+	}
+
+	if trackMapPath != "" {
+		tracks, err := loadTrackMap(trackMapPath)
 		if err != nil {
-			log.Printf("Error writing usage: %v", err)
+			summaryLogger.Fatalf("Failed to load track map: %v\n", err)
 		}
-		flag.PrintDefaults()
+		trackMap = tracks
 	}
-	flag.Parse()
 
-	summaryLogger.Printf("========== SKY-FSBEXT version: %s by %s ==========\n", version, author)
+	if err := validateOutputFormat(outputFormat); err != nil {
+		summaryLogger.Fatalf("Invalid output format: %v\n", err)
+	}
+
+	if err := validateLoopRender(); err != nil {
+		summaryLogger.Fatalf("Invalid loop rendering options: %v\n", err)
+	}
+
+	if err := validateLoudnessOptions(); err != nil {
+		summaryLogger.Fatalf("Invalid loudness options: %v\n", err)
+	}
+
+	if err := validateSilenceOptions(); err != nil {
+		summaryLogger.Fatalf("Invalid silence options: %v\n", err)
+	}
+
+	if err := validateConversionOptions(); err != nil {
+		summaryLogger.Fatalf("Invalid conversion options: %v\n", err)
+	}
+
+	if err := validateStemSplit(); err != nil {
+		summaryLogger.Fatalf("Invalid stem split: %v\n", err)
+	}
+
+	if err := validateImageOptions(); err != nil {
+		summaryLogger.Fatalf("Invalid image options: %v\n", err)
+	}
+
+	if err := validateLayout(layout); err != nil {
+		summaryLogger.Fatalf("Invalid layout: %v\n", err)
+	}
+
+	if realmMapPath != "" {
+		tags, err := loadRealmMap(realmMapPath)
+		if err != nil {
+			summaryLogger.Fatalf("Failed to load realm map: %v\n", err)
+		}
+		realmTags = tags
+	}
+
+	if rulesPath != "" {
+		rules, err := loadClassificationRules(rulesPath)
+		if err != nil {
+			summaryLogger.Fatalf("Failed to load classification rules: %v\n", err)
+		}
+		classificationRules = rules
+		log.Printf("Loaded %d classification rule(s) from %s\n", len(rules), rulesPath)
+	} else if configRules != nil {
+		classificationRules = configRules
+		log.Printf("Loaded %d classification rule(s) from %s\n", len(configRules), configPath)
+	}
+
+	if printConfig {
+		return writeEffectiveConfig(fs, os.Stdout)
+	}
 
 	osVersion := getOSVersion()
 	summaryLogger.Printf("Operating system: %s\n", osVersion)
 
-	if flag.Arg(0) == "--version" {
-		fmt.Printf("SKY-FSBEXT version: %s by %s\n", version, author)
-		return
+	if err := validateDurationFilters(); err != nil {
+		summaryLogger.Fatalf("Invalid duration filter: %v\n", err)
+	}
+
+	if subsongSpec != "" {
+		selection, err := parseSubsongSelection(subsongSpec)
+		if err != nil {
+			summaryLogger.Fatalf("Invalid subsong selection: %v\n", err)
+		}
+		selectedSubsongs = selection
+	}
+
+	// Banks named on the command line are extracted on their own, without
+	// searching the input directory or setting up the category directories
+	bankFiles := fs.Args()
+	explicitBanks := len(bankFiles) > 0
+	if outputDir == "-" {
+		return extractToWriter(bankFiles, os.Stdout)
 	}
 
-	inputDirSizeGB := float64(getSizeOfDir(inputDir)) / (1024 * 1024 * 1024)
+	var inputSize int64
+	if explicitBanks {
+		explicitBankFiles = make(map[string]bool)
+		for _, bankFile := range bankFiles {
+			explicitBankFiles[filepath.Clean(bankFile)] = true
+			if info, err := os.Stat(bankFile); err == nil {
+				inputSize += info.Size()
+			}
+		}
+	} else {
+		inputSize = getSizeOfDir(inputDir)
+	}
+	inputDirSizeGB := float64(inputSize) / (1024 * 1024 * 1024)
 	expectedSizeGB := inputDirSizeGB * compressionRatio
+	if outputFormat == formatFLAC {
+		expectedSizeGB *= flacSizeRatio
+	}
 	expectedSizeBytes := uint64(expectedSizeGB * 1024 * 1024 * 1024)
 
 	CheckDiskSpace(outputDir, expectedSizeBytes)
@@ -80,6 +253,107 @@ func main() {
 	log.Printf("Input directory: %s\n", inputDir)
 	log.Printf("Output directory: %s\n", outputDir)
 
+	if explicitBanks {
+		log.Printf("Extracting %d sound bank(s) given on the command line", len(bankFiles))
+	} else if bankFiles = findBankFiles(); len(bankFiles) == 0 {
+		fs.Usage()
+		return nil
+	}
+
+	if found := len(bankFiles); found > 0 {
+		if bankFiles = filterBanks(bankFiles); len(bankFiles) < found {
+			summaryLogger.Printf("Skipping %d of %d sound bank(s) excluded by --include/--exclude\n", found-len(bankFiles), found)
+		}
+	}
+
+	if _, err := os.Stat(vgmstreamPath); os.IsNotExist(err) {
+		log.Fatalf("vgmstream-cli executable not found at %s\n", vgmstreamPath)
+	}
+
+	// Take the output lock before touching anything in the output directory.
+	// From here on errors are returned rather than fatal, so the deferred
+	// release still removes the lock file.
+	if err := os.MkdirAll(outputDir, 0750); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+	lock, err := acquireOutputLock(outputDir, lockWait, staleLockAge)
+	if err != nil {
+		summaryLogger.Printf("%v\n", err)
+		return fmt.Errorf("failed to lock output directory: %v", err)
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			log.Printf("Error releasing output lock: %v", err)
+		}
+	}()
+
+	if !explicitBanks {
+		createDirectoryStructure(outputDir)
+	}
+
+	if autoWorkers {
+		maxWorkers = autoWorkerCount()
+		log.Printf("Using %d worker(s)\n", maxWorkers)
+	}
+
+	if len(bankFiles) > 0 {
+		runJournal, err = openJournal(outputDir, resume)
+		if err != nil {
+			return fmt.Errorf("failed to open run journal: %v", err)
+		}
+		defer func() {
+			if err := runJournal.Close(); err != nil {
+				log.Printf("Error closing run journal: %v", err)
+			}
+		}()
+
+		results := processBankFilesConcurrently(bankFiles, maxWorkers)
+
+		extractedFiles := 0
+		for _, result := range results {
+			extractedFiles += result.Extracted
+			for _, failure := range result.Failed {
+				summaryLogger.Printf("Failed to extract subsong %d (%s) of %s: %s\n",
+					failure.Subsong, failure.Name, result.BankFile, failure.Reason)
+			}
+			if result.Mismatch && len(result.Failed) == 0 {
+				summaryLogger.Printf("Stream count mismatch in %s: %d of %d streams extracted\n",
+					result.BankFile, result.Extracted, result.expectedCount())
+			}
+		}
+
+		if unmapped := unmappedTracks(results); len(unmapped) > 0 {
+			if err := writeUnmappedTracks(outputDir, unmapped); err != nil {
+				log.Printf("Failed to write %s: %v\n", unmappedTracksFileName, err)
+			} else {
+				summaryLogger.Printf("%d music track(s) have no title mapping, see %s\n", len(unmapped), filepath.Join(outputDir, unmappedTracksFileName))
+			}
+		}
+
+		if extractedFiles > 0 {
+			log.Printf("Successfully extracted %d bank file(s)\n", extractedFiles)
+		} else {
+			log.Println("No sound banks were extracted")
+		}
+
+		if err := removeEmptyDirectories(outputDir); err != nil {
+			log.Printf("Failed to remove empty directories: %v\n", err)
+		}
+	}
+
+	if htmlReport {
+		if err := writeHTMLReport(outputDir); err != nil {
+			log.Printf("Failed to write the HTML report: %v\n", err)
+		} else {
+			summaryLogger.Printf("HTML report written to %s\n", filepath.Join(outputDir, reportDirName, "index.html"))
+		}
+	}
+	return nil
+}
+
+// findBankFiles returns the banks in the input directory, or those of the
+// Steam installation if the input directory has none
+func findBankFiles() []string {
 	if _, err := os.Stat(inputDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(inputDir, 0750); err != nil {
 			log.Fatalf("Failed to create input directory: %v\n", err)
@@ -98,22 +372,19 @@ func main() {
 
 		if runtime.GOOS != "windows" {
 			log.Println("Steam auto-detection is only supported on Windows")
-			flag.Usage()
-			return
+			return nil
 		}
 
 		steamBankFiles, err := getSteamBankFiles()
 		if err != nil {
 			log.Printf("Steam auto-detection failed: %v", err)
 			log.Println("Please manually place .bank files in the input directory")
-			flag.Usage()
-			return
+			return nil
 		}
 
 		if len(steamBankFiles) == 0 {
 			log.Println("No sound banks found in Steam installation")
-			flag.Usage()
-			return
+			return nil
 		}
 
 		bankFiles = steamBankFiles
@@ -121,24 +392,7 @@ func main() {
 	} else {
 		log.Printf("Found %d sound bank(s) in input directory", len(bankFiles))
 	}
-
-	createDirectoryStructure(outputDir)
-
-	if _, err := os.Stat(vgmstreamPath); os.IsNotExist(err) {
-		log.Fatalf("vgmstream-cli executable not found at %s\n", vgmstreamPath)
-	}
-
-	if len(bankFiles) > 0 {
-		extractedFiles := processBankFilesConcurrently(bankFiles, maxWorkers)
-
-		if extractedFiles > 0 {
-			log.Printf("Successfully extracted %d bank file(s)\n", extractedFiles)
-		} else {
-			log.Println("No sound banks were extracted")
-		}
-
-		removeEmptyDirectories(outputDir)
-	}
+	return bankFiles
 }
 
 func setupLogging() {
@@ -177,9 +431,9 @@ func getSizeOfDir(directory string) int64 {
 }
 
 func createDirectoryStructure(outputDir string) {
-	directories := []string{"Music", "SFX", "Other"}
+	directories := ruleCategories()
 	for _, dirName := range directories {
-		dirPath := filepath.Join(outputDir, dirName)
+		dirPath := filepath.Join(outputDir, filepath.FromSlash(dirName))
 		if err := os.MkdirAll(dirPath, 0750); err != nil {
 			log.Printf("Failed to create directory %s: %v\n", dirName, err)
 		} else {
@@ -188,7 +442,7 @@ func createDirectoryStructure(outputDir string) {
 	}
 }
 
-func removeEmptyDirectories(outputDir string) {
+func removeEmptyDirectories(outputDir string) error {
 	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -208,9 +462,7 @@ func removeEmptyDirectories(outputDir string) {
 		}
 		return nil
 	})
-	if err != nil {
-		log.Fatalf("Failed to remove empty directories: %v\n", err)
-	}
+	return err
 }
 
 func isDirEmpty(name string) (bool, error) {
@@ -244,116 +496,258 @@ func getOSVersion() string {
 	return fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH)
 }
 
-func processBankFilesConcurrently(bankFiles []string, maxWorkers int) int {
-	var wg sync.WaitGroup
-	bankFileChan := make(chan string)
-	var totalExtractedFiles int
-	var mu sync.Mutex
-	var printMutex sync.Mutex // To synchronize console output
-
-	// Start worker goroutines
-	for i := 0; i < maxWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for bankFile := range bankFileChan {
-				// Use the mockable function variable here
-				extractedCount := extractAndMoveFileFunc(bankFile, &printMutex)
-				mu.Lock()
-				totalExtractedFiles += extractedCount
-				mu.Unlock()
-			}
-		}()
-	}
-
-	// Send bank files to the channel
-	go func() {
-		for _, bankFile := range bankFiles {
-			bankFileChan <- bankFile
-		}
-		close(bankFileChan)
-	}()
-
-	// Wait for all workers to finish
-	wg.Wait()
-	return totalExtractedFiles
-}
-
-func extractAndMoveFile(bankFile string, printMutex *sync.Mutex) int {
-	var outputMessage strings.Builder
-	outputMessage.WriteString(fmt.Sprintf("Processing file: %s", bankFile))
+// prepareBank validates a bank, creates its output directory and queries the
+// subsong metadata needed to schedule its decode
+func prepareBank(bankFile string) *bankTask {
+	task := &bankTask{result: bankResult{BankFile: bankFile}}
 
 	// Check if the bank file exists
 	if _, err := os.Stat(bankFile); os.IsNotExist(err) {
-		fileLogger.Printf("Bank file does not exist: %s\n", bankFile)
-		outputMessage.WriteString(": FAIL\n")
-		// Print the message
-		safePrintf(printMutex, outputMessage.String())
-		return 0
+		task.fail("Bank file does not exist: %s\n", bankFile)
+		return task
 	}
 
 	if !isValidBankFile(bankFile) {
-		fileLogger.Printf("Invalid bank file: %s\n", bankFile)
-		outputMessage.WriteString(": FAIL\n")
-		// Print the message
-		safePrintf(printMutex, outputMessage.String())
-		return 0
+		task.fail("Invalid bank file: %s\n", bankFile)
+		return task
 	}
 
-	// Proceed with extraction (do not lock the mutex here)
 	baseName := filepath.Base(bankFile)
 	baseNameWithoutExt := strings.TrimSuffix(baseName, filepath.Ext(baseName))
-	var bankDir string
-	if strings.HasPrefix(baseName, "Music_") {
-		bankDir = filepath.Join(outputDir, "Music", baseNameWithoutExt)
-	} else if strings.HasPrefix(baseName, "SFX_") {
-		bankDir = filepath.Join(outputDir, "SFX", baseNameWithoutExt)
+	task.result.Category = classifyBank(baseNameWithoutExt)
+	task.result.Tags = bankTags(baseNameWithoutExt, task.result.Category)
+	bankRel, err := layoutDir(task.result.Category, baseNameWithoutExt, task.result.Tags)
+	if err != nil {
+		task.fail("Failed to lay out %s: %v\n", bankFile, err)
+		return task
+	}
+	bankDir := filepath.Join(outputDir, filepath.FromSlash(bankRel))
+	task.result.OutputDir = bankDir
+
+	// A selection only extracts part of the bank, so the journal doesn't apply
+	if entry, ok := runJournal.completed(bankFile); ok && selectedSubsongs == nil {
+		task.result.Skipped = true
+		task.result.Extracted = entry.Extracted
+		return task
+	}
+
+	// Extract into a staging directory, clearing whatever an interrupted run left there
+	task.stageDir = stagingDir(bankDir)
+	if err := os.RemoveAll(task.stageDir); err != nil {
+		task.fail("Failed to clear staging directory %s: %v\n", task.stageDir, err)
+		return task
+	}
+	if err := os.MkdirAll(task.stageDir, 0750); err != nil {
+		task.fail("Failed to create or access directory %s: %v\n", task.stageDir, err)
+		return task
+	}
+
+	if info, err := os.Stat(bankFile); err == nil {
+		task.size = info.Size()
+	}
+
+	// Query the subsong metadata up front; a failure here is not fatal since
+	// the decode itself may still succeed, we just lose the mismatch check
+	streams, err := queryBankInfo(bankFile)
+	if err != nil {
+		fileLogger.Printf("Failed to query stream info for %s: %v\n", bankFile, err)
 	} else {
-		bankDir = filepath.Join(outputDir, "Other", baseNameWithoutExt)
+		task.result.Streams = streams
+		task.result.StreamCount = len(streams)
 	}
 
-	if err := os.MkdirAll(bankDir, 0750); err != nil {
-		fileLogger.Printf("Failed to create or access directory %s: %v\n", bankDir, err)
-		outputMessage.WriteString(": FAIL\n")
-		// Print the message
-		safePrintf(printMutex, outputMessage.String())
-		return 0
+	if selectedSubsongs != nil {
+		selected, err := selectedSubsongs.resolve(task.result.Streams)
+		if err == nil && len(selected) == 0 {
+			err = fmt.Errorf("no subsongs match %q", selectedSubsongs)
+		}
+		if err != nil {
+			task.fail("Failed to select subsongs of %s: %v\n", bankFile, err)
+			discardStaging(task)
+			return task
+		}
+		task.result.Selected = selected
 	}
 
-	outputPattern := filepath.Join(bankDir, "?02s_?n.wav")
-	// #nosec G204
-	cmd := exec.Command(vgmstreamPath, "-v", "-S", "0", "-o", outputPattern, bankFile)
+	if subsongFiltersActive() {
+		if len(task.result.Streams) == 0 {
+			fileLogger.Printf("Can't filter the subsongs of %s without stream metadata, extracting all of them\n", bankFile)
+		} else {
+			task.result.Filtered = filterSubsongs(task.result.Streams)
+		}
+		if wanted := task.result.wantedSubsongs(); wanted != nil && len(wanted) == 0 {
+			discardStaging(task)
+			task.result.Skipped = true
+		}
+	}
+	return task
+}
 
-	// Run the command without holding the mutex
-	output, err := cmd.CombinedOutput()
+// runDecodeJob runs vgmstream for a whole bank or for each subsong in the job's
+// range. When a whole-bank decode fails or comes up short, the missing subsongs
+// are retried one by one so a single corrupt stream doesn't cost the others.
+func runDecodeJob(job decodeJob) error {
+	task := job.task
+	bankFile := task.result.BankFile
+
+	if !job.whole() {
+		var subsongs []int
+		for subsong := job.first; subsong <= job.last; subsong++ {
+			subsongs = append(subsongs, subsong)
+		}
+		return decodeSubsongs(task, subsongs)
+	}
+
+	output, err := runVgmstream(bankFile, task.workDir(), "-S", "0")
+	if len(task.result.Streams) == 0 {
+		// Without metadata we can't tell which subsongs are missing
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %v\nCommand output: %s", bankFile, err, string(output))
+		}
+		return nil
+	}
 	if err != nil {
-		outputMessage.WriteString(": FAIL\n")
-		fileLogger.Printf("Failed to extract %s: %v\nCommand output: %s\n", bankFile, err, string(output))
-		// Print the message
-		safePrintf(printMutex, outputMessage.String())
-		return 0
+		fileLogger.Printf("Whole-bank decode of %s failed, retrying missing subsongs individually: %v\nCommand output: %s\n", bankFile, err, string(output))
 	}
 
-	extractedCount, err := countFilesInDir(bankDir)
+	var subsongs []int
+	for _, stream := range task.result.Streams {
+		subsongs = append(subsongs, stream.Index)
+	}
+	missing, err := missingSubsongs(task.workDir(), subsongs)
 	if err != nil {
-		outputMessage.WriteString(": FAIL\n")
-		fileLogger.Printf("Error counting files in %s: %v\n", bankDir, err)
-		// Print the message
-		safePrintf(printMutex, outputMessage.String())
-		return 0
-	} else if extractedCount == 0 {
-		outputMessage.WriteString(": FAIL\n")
-		fileLogger.Printf("No files were extracted to %s\n", bankDir)
-		// Print the message
-		safePrintf(printMutex, outputMessage.String())
-		return 0
+		return fmt.Errorf("failed to check the output of %s: %v", bankFile, err)
+	}
+	if len(missing) > 0 {
+		fileLogger.Printf("Retrying %d missing subsong(s) of %s: %v\n", len(missing), bankFile, missing)
+	}
+	return decodeSubsongs(task, missing)
+}
+
+// decodeSubsongs decodes the given subsongs one at a time, recording a failure
+// with vgmstream's reason for each one that could not be written
+func decodeSubsongs(task *bankTask, subsongs []int) error {
+	failed := make(map[int]bool)
+	for _, subsong := range subsongs {
+		output, err := runVgmstream(task.result.BankFile, task.workDir(), "-s", fmt.Sprint(subsong))
+		if err != nil {
+			task.addFailure(subsong, failureReason(output, err))
+			failed[subsong] = true
+		}
+	}
+
+	// vgmstream occasionally exits cleanly without writing anything
+	missing, err := missingSubsongs(task.workDir(), subsongs)
+	if err != nil {
+		return fmt.Errorf("failed to check the output of %s: %v", task.result.BankFile, err)
+	}
+	for _, subsong := range missing {
+		if !failed[subsong] {
+			task.addFailure(subsong, "vgmstream wrote no output")
+		}
+	}
+	return nil
+}
+
+// runVgmstream decodes the bank into dir using the given subsong selection arguments
+func runVgmstream(bankFile, dir string, selection ...string) ([]byte, error) {
+	args := append([]string{"-v"}, selection...)
+	args = append(args, loopArgs()...)
+	args = append(args, "-o", filepath.Join(dir, outputPattern), bankFile)
+	// #nosec G204
+	cmd := execCommand(vgmstreamPath, args...)
+	return cmd.CombinedOutput()
+}
+
+// extractToWriter decodes the one selected subsong of a single bank as WAV to w
+func extractToWriter(bankFiles []string, w io.Writer) error {
+	if len(bankFiles) != 1 {
+		return fmt.Errorf("writing to stdout needs exactly one bank file, got %d", len(bankFiles))
+	}
+	bankFile := filepath.Clean(bankFiles[0])
+	explicitBankFiles = map[string]bool{bankFile: true}
+	if !isValidBankFile(bankFile) {
+		return fmt.Errorf("invalid bank file: %s", bankFile)
+	}
+	if _, err := os.Stat(vgmstreamPath); os.IsNotExist(err) {
+		return fmt.Errorf("vgmstream-cli executable not found at %s", vgmstreamPath)
+	}
+
+	streams, err := queryBankInfo(bankFile)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %v", bankFile, err)
+	}
+	var subsongs []int
+	if selectedSubsongs != nil {
+		if subsongs, err = selectedSubsongs.resolve(streams); err != nil {
+			return err
+		}
 	} else {
-		outputMessage.WriteString(fmt.Sprintf(": OK (%d files extracted)\n", extractedCount))
-		fileLogger.Printf("Successfully extracted %d files from %s to %s\n", extractedCount, bankFile, bankDir)
-		// Print the message
-		safePrintf(printMutex, outputMessage.String())
-		return extractedCount
+		for _, stream := range streams {
+			subsongs = append(subsongs, stream.Index)
+		}
+	}
+	if len(subsongs) != 1 {
+		return fmt.Errorf("writing to stdout needs exactly one subsong, but %d are selected; narrow it down with --subsongs", len(subsongs))
 	}
+
+	args := []string{"-p", "-s", fmt.Sprint(subsongs[0])}
+	if outputFormat == formatFLAC {
+		// Only the FLAC stream carries loop points
+		args = append(args, loopArgs()...)
+	}
+	// #nosec G204
+	cmd := execCommand(vgmstreamPath, append(args, bankFile)...)
+	var stderr, wav bytes.Buffer
+	cmd.Stdout = w
+	if outputFormat == formatFLAC {
+		// The encoder needs the whole stream, so collect it first
+		cmd.Stdout = &wav
+	}
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to decode subsong %d of %s: %s", subsongs[0], bankFile, failureReason(stderr.Bytes(), err))
+	}
+	if outputFormat == formatFLAC {
+		if err := writeFLACStream(w, bankFile, streams, subsongs[0], wav.Bytes()); err != nil {
+			return fmt.Errorf("failed to encode subsong %d of %s: %v", subsongs[0], bankFile, err)
+		}
+	}
+	log.Printf("Wrote subsong %d of %s to stdout\n", subsongs[0], bankFile)
+	return nil
+}
+
+// failureReason condenses vgmstream's output into a one-line reason
+func failureReason(output []byte, err error) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return fmt.Sprintf("%s (%v)", line, err)
+		}
+	}
+	return err.Error()
+}
+
+// missingSubsongs returns the subsongs that have no output file in dir
+func missingSubsongs(dir string, subsongs []int) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[int]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			present[subsongFromName(entry.Name())] = true
+		}
+	}
+
+	var missing []int
+	for _, subsong := range subsongs {
+		if !present[subsong] {
+			missing = append(missing, subsong)
+		}
+	}
+	return missing, nil
 }
 
 func isValidBankFile(filePath string) bool {
@@ -364,7 +758,7 @@ func isValidBankFile(filePath string) bool {
 	steamPath, steamErr := findSteamGamePath()
 	isFromSteam := steamErr == nil && strings.HasPrefix(cleanPath, filepath.Clean(steamPath))
 
-	if !strings.HasPrefix(cleanPath, baseDir) && !isFromSteam {
+	if !strings.HasPrefix(cleanPath, baseDir) && !isFromSteam && !explicitBankFiles[cleanPath] {
 		fileLogger.Printf("Attempted access outside base directory: %s\n", filePath)
 		return false
 	}
@@ -399,7 +793,7 @@ func countFilesInDir(dir string) (int, error) {
 	}
 	count := 0
 	for _, file := range files {
-		if !file.IsDir() {
+		if !file.IsDir() && file.Name() != manifestFileName {
 			count++
 		}
 	}
@@ -411,3 +805,12 @@ func safePrintf(mutex *sync.Mutex, message string) {
 	defer mutex.Unlock()
 	fmt.Print(message)
 }
+
+// dirExists checks if a directory exists
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.IsDir()
+}
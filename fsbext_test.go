@@ -1,11 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -123,7 +129,9 @@ func TestRemoveEmptyDirectories(t *testing.T) {
 	}
 
 	// Remove empty directories
-	removeEmptyDirectories(tempDir)
+	if err := removeEmptyDirectories(tempDir); err != nil {
+		t.Fatalf("removeEmptyDirectories returned an error: %v", err)
+	}
 
 	// Check if emptyDir was removed
 	if _, err := os.Stat(emptyDir); !os.IsNotExist(err) {
@@ -269,6 +277,43 @@ func TestCountFilesInDir(t *testing.T) {
 	}
 }
 
+func TestMissingSubsongs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	for _, name := range []string{"01_a.wav", "03_c.wav", manifestFileName} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("RIFF"), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	missing, err := missingSubsongs(tempDir, []int{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("Error checking missing subsongs: %v", err)
+	}
+	if len(missing) != 2 || missing[0] != 2 || missing[1] != 4 {
+		t.Errorf("Expected subsongs 2 and 4 to be missing, got %v", missing)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	err := fmt.Errorf("exit status 1")
+	reason := failureReason([]byte("decoding\nerror: bad frame\n\n"), err)
+	if reason != "error: bad frame (exit status 1)" {
+		t.Errorf("Unexpected reason: %q", reason)
+	}
+	if reason := failureReason(nil, err); reason != "exit status 1" {
+		t.Errorf("Unexpected reason without output: %q", reason)
+	}
+}
+
 func TestGetOSVersion(t *testing.T) {
 	osVersion := getOSVersion()
 	expected := runtime.GOOS + "/" + runtime.GOARCH
@@ -281,72 +326,386 @@ func TestProcessBankFilesConcurrently(t *testing.T) {
 	// Initialize loggers to avoid nil pointer dereference
 	setupLogging()
 
-	// Mock the extractAndMoveFile function
-	originalExtractAndMoveFile := extractAndMoveFileFunc
-	defer func() { extractAndMoveFileFunc = originalExtractAndMoveFile }()
+	// Mock the per-bank preparation and decode steps
+	originalPrepareBank, originalDecodeJob := prepareBankFunc, decodeJobFunc
+	defer func() { prepareBankFunc, decodeJobFunc = originalPrepareBank, originalDecodeJob }()
 
-	extractAndMoveFileFunc = func(bankFile string, printMutex *sync.Mutex) int {
-		return 1
+	prepareBankFunc = func(bankFile string) *bankTask {
+		task := &bankTask{result: bankResult{BankFile: bankFile}}
+		task.fail("mock failure for %s", bankFile)
+		return task
+	}
+	decodeJobFunc = func(job decodeJob) error {
+		t.Errorf("Unexpected decode of %s", job.task.result.BankFile)
+		return nil
 	}
 
 	// Mock bank files
 	bankFiles := []string{"bank1.bank", "bank2.bank", "bank3.bank"}
 	maxWorkers := 2
 
-	count := processBankFilesConcurrently(bankFiles, maxWorkers)
-	if count != len(bankFiles) {
-		t.Errorf("Expected %d extracted files, got %d", len(bankFiles), count)
+	results := processBankFilesConcurrently(bankFiles, maxWorkers)
+	if len(results) != len(bankFiles) {
+		t.Fatalf("Expected %d results, got %d", len(bankFiles), len(results))
+	}
+	for i, result := range results {
+		if result.BankFile != bankFiles[i] || result.Error == "" {
+			t.Errorf("Unexpected result: %+v", result)
+		}
 	}
 }
 
-func TestExtractAndMoveFile(t *testing.T) {
-	// Mock the extractAndMoveFile function
-	originalExtractAndMoveFile := extractAndMoveFileFunc
-	defer func() { extractAndMoveFileFunc = originalExtractAndMoveFile }()
+func TestProcessBankFilesRetriesMissingSubsongs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalInputDir, originalOutputDir := inputDir, outputDir
+	inputDir, outputDir = filepath.Join(tempDir, "in"), filepath.Join(tempDir, "out")
+	defer func() { inputDir, outputDir = originalInputDir, originalOutputDir }()
 
-	extractAndMoveFileFunc = func(bankFile string, printMutex *sync.Mutex) int {
-		return 1
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+
+	// Decode the bank in one vgmstream call that stops after two of four streams
+	originalNoSplit := noSplit
+	noSplit = true
+	defer func() { noSplit = originalNoSplit }()
+
+	if err := os.MkdirAll(inputDir, 0750); err != nil {
+		t.Fatalf("Failed to create input dir: %v", err)
+	}
+	bankFile := filepath.Join(inputDir, "Music_Test.bank")
+	if err := os.WriteFile(bankFile, []byte("FSB5"), 0600); err != nil {
+		t.Fatalf("Failed to write bank file: %v", err)
+	}
+
+	// The third stream decodes fine on its own, the fourth is corrupt
+	execCommand = fakeExecCommand("HELPER_STREAM_TOTAL=4", "HELPER_WRITE_FILES=2", "HELPER_FAIL_SUBSONGS=4")
+
+	result := processBankFilesConcurrently([]string{bankFile}, 2)[0]
+	if result.Error != "" {
+		t.Fatalf("Unexpected error: %s", result.Error)
 	}
+	if result.Category != "Music" || result.StreamCount != 4 || result.Extracted != 3 || !result.Mismatch {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if len(result.Failed) != 1 {
+		t.Fatalf("Expected one failed subsong, got %+v", result.Failed)
+	}
+	failure := result.Failed[0]
+	if failure.Subsong != 4 || failure.Name != "stream4" || !strings.Contains(failure.Reason, "corrupt stream data") {
+		t.Errorf("Unexpected failure: %+v", failure)
+	}
+	if _, err := os.Stat(filepath.Join(result.OutputDir, manifestFileName)); err != nil {
+		t.Errorf("Expected manifest to be written: %v", err)
+	}
+}
 
-	// Create a temporary bank file
-	bankFile, err := os.CreateTemp("", "test.bank")
+func TestProcessBankFilesResume(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
 	if err != nil {
-		t.Fatalf("Failed to create temp bank file: %v", err)
+		t.Fatalf("Failed to create temp dir: %v", err)
 	}
 	defer func() {
-		if err := os.Remove(bankFile.Name()); err != nil {
-			t.Logf("Error removing bank file: %v", err)
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
 		}
 	}()
 
-	// Write valid header
-	if _, err := bankFile.Write([]byte("RIFF")); err != nil {
-		t.Fatalf("Failed to write to bank file: %v", err)
+	originalInputDir, originalOutputDir := inputDir, outputDir
+	inputDir, outputDir = filepath.Join(tempDir, "in"), filepath.Join(tempDir, "out")
+	defer func() { inputDir, outputDir = originalInputDir, originalOutputDir }()
+
+	originalExecCommand, originalJournal := execCommand, runJournal
+	defer func() { execCommand, runJournal = originalExecCommand, originalJournal }()
+	execCommand = fakeExecCommand("HELPER_STREAM_TOTAL=2", "HELPER_WRITE_FILES=2")
+
+	for _, dir := range []string{inputDir, outputDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
 	}
-	if err := bankFile.Close(); err != nil {
-		t.Fatalf("Failed to close bank file: %v", err)
+	bankFiles := []string{filepath.Join(inputDir, "SFX_Done.bank"), filepath.Join(inputDir, "SFX_Todo.bank")}
+	for _, bankFile := range bankFiles {
+		if err := os.WriteFile(bankFile, []byte("FSB5"), 0600); err != nil {
+			t.Fatalf("Failed to write bank file: %v", err)
+		}
 	}
 
-	// Create temporary output directory
-	outputDir, err := os.MkdirTemp("", "output")
+	// First run only gets through one bank
+	runJournal, err = openJournal(outputDir, false)
 	if err != nil {
-		t.Fatalf("Failed to create temp output dir: %v", err)
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	processBankFilesConcurrently(bankFiles[:1], 2)
+	if err := runJournal.Close(); err != nil {
+		t.Fatalf("Failed to close journal: %v", err)
+	}
+
+	runJournal, err = openJournal(outputDir, true)
+	if err != nil {
+		t.Fatalf("Failed to resume journal: %v", err)
+	}
+	defer func() {
+		if err := runJournal.Close(); err != nil {
+			t.Logf("Error closing journal: %v", err)
+		}
+	}()
+	results := processBankFilesConcurrently(bankFiles, 2)
+
+	if !results[0].Skipped || results[0].Extracted != 2 {
+		t.Errorf("Expected the completed bank to be skipped, got %+v", results[0])
+	}
+	if results[1].Skipped || results[1].Extracted != 2 || results[1].Error != "" {
+		t.Errorf("Expected the remaining bank to be extracted, got %+v", results[1])
+	}
+	if dirExists(stagingDir(results[1].OutputDir)) {
+		t.Errorf("Expected the staging directory to be gone after commit")
+	}
+}
+
+func TestProcessBankFilesResumeAfterFilter(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
 	}
 	defer func() {
-		if err := os.RemoveAll(outputDir); err != nil {
+		if err := os.RemoveAll(tempDir); err != nil {
 			t.Logf("Error removing temp directory: %v", err)
 		}
 	}()
 
-	// Set global outputDir for the test
-	originalOutputDir := outputDir
-	defer func() { outputDir = originalOutputDir }()
+	originalInputDir, originalOutputDir := inputDir, outputDir
+	inputDir, outputDir = filepath.Join(tempDir, "in"), filepath.Join(tempDir, "out")
+	defer func() { inputDir, outputDir = originalInputDir, originalOutputDir }()
+
+	originalExecCommand, originalJournal, originalExclude := execCommand, runJournal, excludePatterns
+	defer func() {
+		execCommand, runJournal, excludePatterns = originalExecCommand, originalJournal, originalExclude
+	}()
+	execCommand = fakeExecCommand("HELPER_STREAM_TOTAL=3")
+
+	for _, dir := range []string{inputDir, outputDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	bankFile := filepath.Join(inputDir, "SFX_Filtered.bank")
+	if err := os.WriteFile(bankFile, []byte("FSB5"), 0600); err != nil {
+		t.Fatalf("Failed to write bank file: %v", err)
+	}
+
+	// A filtered run only extracts part of the bank, so it isn't journaled
+	excludePatterns = patternList{}
+	if err := excludePatterns.Set("subsong:stream2"); err != nil {
+		t.Fatalf("Failed to set exclude pattern: %v", err)
+	}
+	runJournal, err = openJournal(outputDir, false)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	if result := processBankFilesConcurrently([]string{bankFile}, 2)[0]; result.Extracted != 2 || len(result.Filtered) != 1 {
+		t.Fatalf("Expected subsong 2 to be filtered out, got %+v", result)
+	}
+	if err := runJournal.Close(); err != nil {
+		t.Fatalf("Failed to close journal: %v", err)
+	}
+
+	excludePatterns = patternList{}
+	runJournal, err = openJournal(outputDir, true)
+	if err != nil {
+		t.Fatalf("Failed to resume journal: %v", err)
+	}
+	defer func() {
+		if err := runJournal.Close(); err != nil {
+			t.Logf("Error closing journal: %v", err)
+		}
+	}()
+	if result := processBankFilesConcurrently([]string{bankFile}, 2)[0]; result.Skipped || result.Extracted != 3 {
+		t.Errorf("Expected the resumed run to extract the whole bank, got %+v", result)
+	}
+}
+
+func TestProcessBankFilesSplitBank(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalInputDir, originalOutputDir := inputDir, outputDir
+	inputDir, outputDir = filepath.Join(tempDir, "in"), filepath.Join(tempDir, "out")
+	defer func() { inputDir, outputDir = originalInputDir, originalOutputDir }()
+
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+	execCommand = fakeExecCommand("HELPER_STREAM_TOTAL=5")
+
+	if err := os.MkdirAll(inputDir, 0750); err != nil {
+		t.Fatalf("Failed to create input dir: %v", err)
+	}
+	bankFiles := []string{filepath.Join(inputDir, "Music_Big.bank"), filepath.Join(inputDir, "SFX_Small.bank")}
+	if err := os.WriteFile(bankFiles[0], []byte("FSB5"+strings.Repeat("x", 4096)), 0600); err != nil {
+		t.Fatalf("Failed to write bank file: %v", err)
+	}
+	if err := os.WriteFile(bankFiles[1], []byte("FSB5"), 0600); err != nil {
+		t.Fatalf("Failed to write bank file: %v", err)
+	}
 
-	// Perform the test
-	var printMutex sync.Mutex
-	count := extractAndMoveFileFunc(bankFile.Name(), &printMutex)
-	if count != 1 {
-		t.Errorf("Expected 1 extracted file, got %d", count)
+	results := processBankFilesConcurrently(bankFiles, 2)
+	big := results[0]
+	if big.Error != "" || big.Extracted != 5 || big.Mismatch {
+		t.Errorf("Expected all 5 subsongs of the split bank, got %+v", big)
+	}
+	if results[1].Category != "SFX" {
+		t.Errorf("Expected SFX category, got %s", results[1].Category)
+	}
+}
+
+func TestProcessBankFilesSelection(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalInputDir, originalOutputDir := inputDir, outputDir
+	inputDir, outputDir = filepath.Join(tempDir, "in"), filepath.Join(tempDir, "out")
+	defer func() { inputDir, outputDir = originalInputDir, originalOutputDir }()
+
+	originalExecCommand, originalSelection := execCommand, selectedSubsongs
+	defer func() { execCommand, selectedSubsongs = originalExecCommand, originalSelection }()
+	execCommand = fakeExecCommand("HELPER_STREAM_TOTAL=6")
+
+	// Bank files named on the command line may live outside the input directory
+	bankFile := filepath.Join(tempDir, "Music_Test.bank")
+	if err := os.WriteFile(bankFile, []byte("FSB5"), 0600); err != nil {
+		t.Fatalf("Failed to write bank file: %v", err)
+	}
+	originalExplicit := explicitBankFiles
+	explicitBankFiles = map[string]bool{bankFile: true}
+	defer func() { explicitBankFiles = originalExplicit }()
+
+	// A full extraction first, which the selection must not wipe out
+	selectedSubsongs = nil
+	if result := processBankFilesConcurrently([]string{bankFile}, 2)[0]; result.Error != "" || result.Extracted != 6 {
+		t.Fatalf("Expected all 6 subsongs, got %+v", result)
+	}
+
+	selectedSubsongs, err = parseSubsongSelection("2,stream5")
+	if err != nil {
+		t.Fatalf("Failed to parse selection: %v", err)
+	}
+	result := processBankFilesConcurrently([]string{bankFile}, 2)[0]
+	if result.Error != "" {
+		t.Fatalf("Unexpected error: %s", result.Error)
+	}
+	if result.Extracted != 2 || result.Mismatch || len(result.Selected) != 2 {
+		t.Errorf("Expected subsongs 2 and 5 only, got %+v", result)
+	}
+	for _, file := range result.Files {
+		if file.Subsong != 2 && file.Subsong != 5 {
+			t.Errorf("Unexpected output file %+v", file)
+		}
+	}
+
+	entries, err := os.ReadDir(result.OutputDir)
+	if err != nil {
+		t.Fatalf("Failed to read bank directory: %v", err)
+	}
+	if len(entries) != 7 {
+		t.Errorf("Expected the 6 files of the full run and the manifest to be kept, got %d entries", len(entries))
+	}
+	data, err := os.ReadFile(filepath.Join(result.OutputDir, manifestFileName))
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var manifest bankResult
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if len(manifest.Files) != 6 || manifest.Selected != nil || manifest.Extracted != 6 {
+		t.Errorf("Expected the manifest to list all 6 files, got %d files, selection %v", len(manifest.Files), manifest.Selected)
+	}
+
+	var out strings.Builder
+	if err := extractToWriter([]string{bankFile}, &out); err == nil {
+		t.Errorf("Expected an error when writing two subsongs to stdout")
+	}
+	selectedSubsongs, _ = parseSubsongSelection("stream3")
+	if err := extractToWriter([]string{bankFile}, &out); err != nil || out.String() != "RIFF subsong 3" {
+		t.Errorf("Expected subsong 3 on stdout, got %q (err %v)", out.String(), err)
+	}
+}
+
+func TestRunVgmstreamLoopArgs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalExecCommand, originalNoLoop, originalLoops := execCommand, noLoopPoints, renderLoops
+	defer func() {
+		execCommand, noLoopPoints, renderLoops = originalExecCommand, originalNoLoop, originalLoops
+	}()
+	var args []string
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		args = arg
+		return fakeExecCommand("HELPER_STREAM_TOTAL=1")(name, arg...)
+	}
+
+	for _, tt := range []struct {
+		name             string
+		noLoop           bool
+		loops            int
+		ignoresLoopPoint bool
+	}{
+		{"loop points", false, 0, true},
+		{"--no-loop-points", true, 0, false},
+		{"--render-loops", false, 2, false},
+	} {
+		noLoopPoints, renderLoops = tt.noLoop, tt.loops
+		if _, err := runVgmstream("Music_Test.bank", tempDir, "-s", "1"); err != nil {
+			t.Fatalf("%s: runVgmstream returned an error: %v", tt.name, err)
+		}
+		if slices.Contains(args, "-i") != tt.ignoresLoopPoint {
+			t.Errorf("%s: expected -i to be passed %v, got %v", tt.name, tt.ignoresLoopPoint, args)
+		}
+		if len(args) < 3 || args[0] != "-v" || args[1] != "-s" || args[2] != "1" || args[len(args)-1] != "Music_Test.bank" {
+			t.Errorf("%s: unexpected arguments %v", tt.name, args)
+		}
+	}
+}
+
+// fakeExecCommand returns an exec.Command replacement that re-runs the test
+// binary as TestHelperProcess with the given extra environment
+func fakeExecCommand(env ...string) func(string, ...string) *exec.Cmd {
+	return func(name string, args ...string) *exec.Cmd {
+		cs := append([]string{"-test.run=TestHelperProcess", "--", name}, args...)
+		// #nosec G204
+		cmd := exec.Command(os.Args[0], cs...)
+		cmd.Env = append(append(os.Environ(), "GO_WANT_HELPER_PROCESS=1"), env...)
+		return cmd
 	}
 }
 
@@ -355,6 +714,59 @@ func TestHelperProcess(t *testing.T) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
 		return
 	}
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		args = args[2:]
+	}
+
+	// Mock `vgmstream-cli -m -I -s N` metadata queries
+	if len(args) > 0 && args[0] == "-m" {
+		subsong, _ := strconv.Atoi(args[3])
+		total, _ := strconv.Atoi(os.Getenv("HELPER_STREAM_TOTAL"))
+		fmt.Printf(`{"sampleRate":48000,"channels":2,"loopingInfo":{"start":100,"end":48000},`+
+			`"numberOfSamples":96000,"encoding":"Vorbis",`+
+			`"streamInfo":{"index":%d,"name":"stream%d","total":%d}}`, subsong, subsong, total)
+		os.Exit(0)
+	}
+
+	// Mock `vgmstream-cli -p -s N` decoding to stdout
+	if len(args) > 0 && args[0] == "-p" {
+		fmt.Printf("RIFF subsong %s", args[2])
+		os.Exit(0)
+	}
+
+	// Mock decoding by writing HELPER_WRITE_FILES files for the -o pattern,
+	// or just the requested one when a single subsong is selected with -s
+	written, _ := strconv.Atoi(os.Getenv("HELPER_WRITE_FILES"))
+	first := 1
+	if args[1] == "-s" {
+		first, _ = strconv.Atoi(args[2])
+		written = first
+		for _, failing := range strings.Split(os.Getenv("HELPER_FAIL_SUBSONGS"), ",") {
+			if failing == args[2] {
+				fmt.Println("decoding subsong", first)
+				fmt.Println("error: corrupt stream data")
+				os.Exit(1)
+			}
+		}
+	}
+	for i, arg := range args {
+		if arg != "-o" || i+1 >= len(args) {
+			continue
+		}
+		for n := first; n <= written; n++ {
+			name := strings.ReplaceAll(args[i+1], "?05s", fmt.Sprintf("%05d", n))
+			name = strings.ReplaceAll(name, "?n", fmt.Sprintf("stream%d", n))
+			if err := os.WriteFile(name, []byte("RIFF"), 0600); err != nil {
+				os.Exit(1)
+			}
+		}
+	}
+
 	// Mock successful command
 	os.Exit(0)
 }
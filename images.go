@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/cmplx"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	windowHann     = "hann"
+	windowHamming  = "hamming"
+	windowBlackman = "blackman"
+
+	// imagesDirName is the tree below the output directory that holds the
+	// images with --images-tree
+	imagesDirName = "images"
+)
+
+var (
+	renderWaveform    bool
+	renderSpectrogram bool
+	imageSize         = "1200x300"
+	colormapName      = "magma"
+	fftSize           = 2048
+	fftHop            int
+	fftWindow         = windowHann
+	spectrogramFloor  = -120.0
+	imagesTree        bool
+
+	imageWidth, imageHeight int
+)
+
+// colormaps are sampled at evenly spaced points and interpolated between them
+var colormaps = map[string][]color.RGBA{
+	"gray": {{0, 0, 0, 255}, {255, 255, 255, 255}},
+	"magma": {
+		{0, 0, 4, 255}, {28, 16, 68, 255}, {79, 18, 123, 255}, {129, 37, 129, 255},
+		{181, 54, 122, 255}, {229, 80, 100, 255}, {251, 135, 97, 255}, {254, 194, 135, 255},
+		{252, 253, 191, 255},
+	},
+	"inferno": {
+		{0, 0, 4, 255}, {31, 12, 72, 255}, {85, 15, 109, 255}, {136, 34, 106, 255},
+		{186, 54, 85, 255}, {227, 89, 51, 255}, {249, 140, 10, 255}, {249, 201, 50, 255},
+		{252, 255, 164, 255},
+	},
+	"viridis": {
+		{68, 1, 84, 255}, {71, 45, 123, 255}, {59, 82, 139, 255}, {44, 114, 142, 255},
+		{33, 145, 140, 255}, {40, 174, 128, 255}, {94, 201, 98, 255}, {173, 220, 48, 255},
+		{253, 231, 37, 255},
+	},
+}
+
+// renderedImage is a PNG rendered from an output file, kept until the file
+// has been moved to its final directory
+type renderedImage struct {
+	Kind string // waveform or spectrogram
+	Data []byte
+}
+
+// renderingImages reports whether any image is rendered
+func renderingImages() bool {
+	return renderWaveform || renderSpectrogram
+}
+
+// validateImageOptions checks the image options and parses --image-size
+func validateImageOptions() error {
+	width, height, ok := strings.Cut(imageSize, "x")
+	var err error
+	if ok {
+		if imageWidth, err = strconv.Atoi(width); err == nil {
+			imageHeight, err = strconv.Atoi(height)
+		}
+	}
+	if !ok || err != nil || imageWidth < 16 || imageHeight < 16 || imageWidth > 16384 || imageHeight > 16384 {
+		return fmt.Errorf("invalid image size %q, expected WIDTHxHEIGHT between 16 and 16384 pixels", imageSize)
+	}
+	if _, ok := colormaps[colormapName]; !ok {
+		return fmt.Errorf("unknown colour map %q, expected gray, inferno, magma or viridis", colormapName)
+	}
+	if fftSize < 64 || fftSize > 65536 || fftSize&(fftSize-1) != 0 {
+		return fmt.Errorf("--fft-size %d must be a power of two from 64 to 65536", fftSize)
+	}
+	if fftHop < 0 || fftHop > fftSize {
+		return fmt.Errorf("--fft-hop %d must be between 1 and --fft-size", fftHop)
+	}
+	if windowFunction(fftWindow) == nil {
+		return fmt.Errorf("unknown FFT window %q, expected %s, %s or %s", fftWindow, windowHann, windowHamming, windowBlackman)
+	}
+	if spectrogramFloor >= 0 {
+		return fmt.Errorf("--spectrogram-floor must be below 0 dB")
+	}
+	return nil
+}
+
+// colormapColor returns the colour of the map at a position from 0 to 1
+func colormapColor(colormap []color.RGBA, position float64) color.RGBA {
+	position = max(0, min(1, position)) * float64(len(colormap)-1)
+	index := min(int(position), len(colormap)-2)
+	fraction := position - float64(index)
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + fraction*(float64(b)-float64(a))))
+	}
+	a, b := colormap[index], colormap[index+1]
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
+
+// drawWaveform draws the peak and RMS envelope of every channel in its own
+// lane, with time running from left to right
+func drawWaveform(audio *pcmAudio, width, height int, colormap []color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	background := colormapColor(colormap, 0)
+	peakColor := colormapColor(colormap, 0.55)
+	rmsColor := colormapColor(colormap, 0.85)
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = background.R, background.G, background.B, 255
+	}
+
+	frames := audio.frames()
+	if frames == 0 || audio.Channels == 0 {
+		return img
+	}
+	channels := splitChannels(audio)
+	lane := float64(height) / float64(audio.Channels)
+	for ch, signal := range channels {
+		top := float64(ch) * lane
+		centre := top + lane/2
+		row := func(value float64) int {
+			return max(int(top), min(int(math.Round(top+lane)-1), int(math.Round(centre-value*lane/2))))
+		}
+		for x := 0; x < width; x++ {
+			first := x * frames / width
+			last := max((x+1)*frames/width, first+1)
+			low, high, sum := 1.0, -1.0, 0.0
+			for i := first; i < last; i++ {
+				value := signal[i]
+				low, high = min(low, value), max(high, value)
+				sum += value * value
+			}
+			level := math.Sqrt(sum / float64(last-first))
+			for y := row(high); y <= row(low); y++ {
+				img.SetRGBA(x, y, peakColor)
+			}
+			for y := row(min(level, high)); y <= row(max(-level, low)); y++ {
+				img.SetRGBA(x, y, rmsColor)
+			}
+		}
+	}
+	return img
+}
+
+// windowFunction returns the FFT window of the given name, or nil
+func windowFunction(name string) func(i, n int) float64 {
+	switch name {
+	case windowHann:
+		return func(i, n int) float64 { return 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n)) }
+	case windowHamming:
+		return func(i, n int) float64 { return 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/float64(n)) }
+	case windowBlackman:
+		return func(i, n int) float64 {
+			x := 2 * math.Pi * float64(i) / float64(n)
+			return 0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2*x)
+		}
+	}
+	return nil
+}
+
+// fft transforms the values in place with the iterative radix-2 algorithm;
+// the length must be a power of two
+func fft(values []complex128) {
+	n := len(values)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := values[start+k], w*values[start+k+size/2]
+				values[start+k], values[start+k+size/2] = even+odd, even-odd
+				w *= step
+			}
+		}
+	}
+}
+
+// spectrumColumns returns the average power spectrum of the channels mixed to
+// mono for each of width columns, in dB relative to a full scale sine
+func spectrumColumns(audio *pcmAudio, width, size, hop int, window func(i, n int) float64) [][]float64 {
+	channels := splitChannels(audio)
+	frames := audio.frames()
+	mono := make([]float64, frames)
+	for _, signal := range channels {
+		for i, s := range signal {
+			mono[i] += s / float64(len(channels))
+		}
+	}
+
+	coefficients := make([]float64, size)
+	var gain float64
+	for i := range coefficients {
+		coefficients[i] = window(i, size)
+		gain += coefficients[i]
+	}
+
+	bins := size/2 + 1
+	power := make([][]float64, width)
+	counts := make([]int, width)
+	buffer := make([]complex128, size)
+	for start := -size / 2; start < frames-size/2 || start == -size/2; start += hop {
+		for i := range buffer {
+			var s float64
+			if at := start + i; at >= 0 && at < frames {
+				s = mono[at]
+			}
+			buffer[i] = complex(s*coefficients[i], 0)
+		}
+		fft(buffer)
+		column := min(max((start+size/2)*width/max(frames, 1), 0), width-1)
+		if power[column] == nil {
+			power[column] = make([]float64, bins)
+		}
+		for bin := range power[column] {
+			// A full scale sine peaks at half the window's gain
+			magnitude := cmplx.Abs(buffer[bin]) / (gain / 2)
+			power[column][bin] += magnitude * magnitude
+		}
+		counts[column]++
+	}
+
+	// Columns between two analysis frames repeat the one before
+	levels := make([][]float64, width)
+	for x := range levels {
+		if power[x] == nil {
+			if x > 0 {
+				levels[x] = levels[x-1]
+			}
+			continue
+		}
+		levels[x] = make([]float64, bins)
+		for bin, p := range power[x] {
+			levels[x][bin] = 10 * math.Log10(p/float64(counts[x])+1e-30)
+		}
+	}
+	for x := width - 1; x >= 0; x-- {
+		if levels[x] == nil && x+1 < width {
+			levels[x] = levels[x+1]
+		}
+	}
+	return levels
+}
+
+// drawSpectrogram draws the spectrum over time with the frequency rising
+// linearly from 0 Hz at the bottom to the Nyquist frequency at the top
+func drawSpectrogram(audio *pcmAudio, width, height int, colormap []color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	hop := fftHop
+	if hop == 0 {
+		hop = fftSize / 4
+	}
+	levels := spectrumColumns(audio, width, fftSize, hop, windowFunction(fftWindow))
+	for x, column := range levels {
+		for y := 0; y < height; y++ {
+			position := 0.0
+			if column != nil {
+				bin := (height - 1 - y) * (len(column) - 1) / max(height-1, 1)
+				position = 1 - column[bin]/spectrogramFloor
+			}
+			img.SetRGBA(x, y, colormapColor(colormap, position))
+		}
+	}
+	return img
+}
+
+// encodePNG compresses an image
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderImages draws the images requested for decoded audio
+func renderImages(audio *pcmAudio) ([]renderedImage, error) {
+	colormap := colormaps[colormapName]
+	var images []renderedImage
+	if renderWaveform {
+		data, err := encodePNG(drawWaveform(audio, imageWidth, imageHeight, colormap))
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, renderedImage{Kind: "waveform", Data: data})
+	}
+	if renderSpectrogram {
+		data, err := encodePNG(drawSpectrogram(audio, imageWidth, imageHeight, colormap))
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, renderedImage{Kind: "spectrogram", Data: data})
+	}
+	return images, nil
+}
+
+// renderOutputImages renders the images of the WAV files in dir. They are
+// kept with the files until writeOutputImages, once the files have their
+// final names.
+func renderOutputImages(dir string, files []outputFile) error {
+	if !renderingImages() {
+		return nil
+	}
+	var firstErr error
+	for i := range files {
+		if !strings.EqualFold(filepath.Ext(files[i].Name), ".wav") {
+			continue
+		}
+		audio, _, err := readWAVFile(filepath.Join(dir, files[i].Name))
+		if err == nil {
+			files[i].images, err = renderImages(audio)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	return firstErr
+}
+
+// imageDir returns the directory below the output directory that holds the
+// images of files in dir
+func imageDir(dir string) string {
+	if imagesTree {
+		return path.Join(imagesDirName, dir)
+	}
+	return dir
+}
+
+// writeOutputImages writes the rendered images next to their files, or into
+// the images tree, and records their paths below the output directory
+func writeOutputImages(task *bankTask, files []outputFile) error {
+	var firstErr error
+	for i := range files {
+		for _, rendered := range files[i].images {
+			dir := imageDir(files[i].Dir)
+			name := strings.TrimSuffix(files[i].Name, filepath.Ext(files[i].Name)) + "." + rendered.Kind + ".png"
+			target := filepath.Join(outputDir, filepath.FromSlash(dir))
+			if task.stageDir != "" {
+				target = stagingDir(target)
+			}
+			err := os.MkdirAll(target, 0750)
+			if err == nil {
+				err = os.WriteFile(filepath.Join(target, name), rendered.Data, 0600)
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %v", files[i].Name, err)
+				}
+				continue
+			}
+			switch rendered.Kind {
+			case "waveform":
+				files[i].Waveform = path.Join(dir, name)
+			case "spectrogram":
+				files[i].Spectrogram = path.Join(dir, name)
+			}
+		}
+		files[i].images = nil
+	}
+	return firstErr
+}
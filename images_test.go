@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFFT(t *testing.T) {
+	values := make([]complex128, 64)
+	for i := range values {
+		values[i] = complex(math.Cos(2*math.Pi*5*float64(i)/64), 0)
+	}
+	fft(values)
+	for bin, value := range values {
+		expected := 0.0
+		if bin == 5 || bin == 59 {
+			expected = 32
+		}
+		if math.Abs(cmplx.Abs(value)-expected) > 1e-9 {
+			t.Errorf("Bin %d has magnitude %f, expected %f", bin, cmplx.Abs(value), expected)
+		}
+	}
+}
+
+func TestValidateImageOptions(t *testing.T) {
+	defer func(size string, fft, hop int, window string) {
+		imageSize, fftSize, fftHop, fftWindow = size, fft, hop, window
+	}(imageSize, fftSize, fftHop, fftWindow)
+
+	imageSize = "640x120"
+	if err := validateImageOptions(); err != nil || imageWidth != 640 || imageHeight != 120 {
+		t.Errorf("Expected 640x120, got %dx%d (%v)", imageWidth, imageHeight, err)
+	}
+	for _, size := range []string{"640", "640x", "8x8", "x120"} {
+		imageSize = size
+		if err := validateImageOptions(); err == nil {
+			t.Errorf("Expected an error for image size %q", size)
+		}
+	}
+	imageSize = "640x120"
+	fftSize = 1000
+	if err := validateImageOptions(); err == nil {
+		t.Errorf("Expected an error for an FFT size that isn't a power of two")
+	}
+	fftSize, fftWindow = 1024, "kaiser"
+	if err := validateImageOptions(); err == nil {
+		t.Errorf("Expected an error for an unknown window")
+	}
+}
+
+func TestDrawWaveform(t *testing.T) {
+	// The left channel is silent, the right one at full scale
+	audio := sineAudio(8000, 2, 100, 1, 1)
+	for i := 0; i < len(audio.Samples); i += 2 {
+		audio.Samples[i] = 0
+	}
+	colormap := colormaps["gray"]
+	img := drawWaveform(audio, 100, 100, colormap)
+
+	background := colormapColor(colormap, 0)
+	if img.RGBAAt(50, 5) != background || img.RGBAAt(50, 50) == background {
+		t.Errorf("Expected the silent left channel to show only a centre line")
+	}
+	if img.RGBAAt(50, 51) == background || img.RGBAAt(50, 98) == background {
+		t.Errorf("Expected the right channel to fill its lane")
+	}
+}
+
+func TestDrawSpectrogram(t *testing.T) {
+	defer func(hop int, window string, floor float64) {
+		fftHop, fftWindow, spectrogramFloor = hop, window, floor
+	}(fftHop, fftWindow, spectrogramFloor)
+	fftHop, fftWindow, spectrogramFloor = 0, windowHann, -120
+
+	// A 6 kHz tone sits at three quarters of the height below the top
+	audio := sineAudio(48000, 1, 6000, 0.5, 1)
+	img := drawSpectrogram(audio, 50, 101, colormaps["gray"])
+	brightest, level := 0, uint8(0)
+	for y := 0; y < 101; y++ {
+		if value := img.RGBAAt(25, y).R; value > level {
+			brightest, level = y, value
+		}
+	}
+	if brightest != 75 {
+		t.Errorf("Expected the tone at row 75, found it at row %d", brightest)
+	}
+}
+
+func TestWriteOutputImages(t *testing.T) {
+	defer func(dir, size string, waveform, spectrogram, tree bool) {
+		outputDir, imageSize, renderWaveform, renderSpectrogram, imagesTree = dir, size, waveform, spectrogram, tree
+	}(outputDir, imageSize, renderWaveform, renderSpectrogram, imagesTree)
+
+	dir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("Failed to remove temp directory: %v", err)
+		}
+	}()
+	outputDir, renderWaveform, renderSpectrogram, imagesTree = dir, true, true, true
+	imageSize = "64x32"
+	if err := validateImageOptions(); err != nil {
+		t.Fatalf("validateImageOptions returned an error: %v", err)
+	}
+
+	bankDir := filepath.Join(dir, "Music", "Music_Bank")
+	if err := os.MkdirAll(bankDir, 0750); err != nil {
+		t.Fatalf("Failed to create bank directory: %v", err)
+	}
+	if err := writeWAVFile(filepath.Join(bankDir, "00001_theme.wav"), sineAudio(8000, 1, 440, 0.5, 0.5), nil); err != nil {
+		t.Fatalf("Failed to write WAV: %v", err)
+	}
+	files := []outputFile{{Subsong: 1, Name: "00001_theme.wav", Dir: "Music/Music_Bank"}}
+	if err := renderOutputImages(bankDir, files); err != nil {
+		t.Fatalf("renderOutputImages returned an error: %v", err)
+	}
+	task := &bankTask{result: bankResult{OutputDir: bankDir, Files: files}}
+	if err := writeOutputImages(task, files); err != nil {
+		t.Fatalf("writeOutputImages returned an error: %v", err)
+	}
+
+	if files[0].Waveform != "images/Music/Music_Bank/00001_theme.waveform.png" || files[0].Spectrogram != "images/Music/Music_Bank/00001_theme.spectrogram.png" {
+		t.Errorf("Unexpected image paths %q and %q", files[0].Waveform, files[0].Spectrogram)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(files[0].Waveform)))
+	if err != nil {
+		t.Fatalf("Failed to read waveform: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil || img.Bounds().Dx() != 64 || img.Bounds().Dy() != 32 {
+		t.Errorf("Expected a 64x32 PNG, got %v (%v)", img.Bounds(), err)
+	}
+	if dirs := outputDirs(task); len(dirs) != 2 || dirs[1] != "images/Music/Music_Bank" {
+		t.Errorf("Expected the images directory to be committed with the bank, got %v", dirs)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// journalFileName records the banks a run has completed so --resume can skip them
+	journalFileName = ".fsbext-journal.jsonl"
+
+	// stagingDirName holds banks while they are being extracted; a bank is
+	// only renamed into place once its decode and post-processing succeeded
+	stagingDirName = ".fsbext-staging"
+)
+
+// journalEntry is one line of the run journal
+type journalEntry struct {
+	BankFile  string    `json:"bankFile"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	OutputDir string    `json:"outputDir"`
+	Extracted int       `json:"extracted"`
+	Completed time.Time `json:"completed"`
+}
+
+// journal is an append-only record of completed banks. A nil journal records
+// nothing and reports nothing as completed.
+type journal struct {
+	mu   sync.Mutex
+	file *os.File
+	done map[string]journalEntry
+}
+
+// runJournal is the journal of the current run, if any
+var runJournal *journal
+
+// openJournal opens the journal in outputDir. When resuming, the entries of the
+// previous run are loaded and appended to; otherwise the journal starts over.
+func openJournal(outputDir string, resume bool) (*journal, error) {
+	path := filepath.Join(outputDir, journalFileName)
+	j := &journal{done: make(map[string]journalEntry)}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		if err := j.load(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(filepath.Clean(path), flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.file = file
+	return j, nil
+}
+
+// load reads the entries of an existing journal. A line cut short by a crash
+// is skipped rather than treated as an error.
+func (j *journal) load(path string) error {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fileLogger.Printf("Error closing file: %v", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			fileLogger.Printf("Skipping unreadable journal line: %v\n", err)
+			continue
+		}
+		j.done[entry.BankFile] = entry
+	}
+	return scanner.Err()
+}
+
+// completed reports whether the bank was extracted by a previous run and is
+// unchanged since, and its output is still in place
+func (j *journal) completed(bankFile string) (journalEntry, bool) {
+	if j == nil {
+		return journalEntry{}, false
+	}
+	j.mu.Lock()
+	entry, ok := j.done[bankFile]
+	j.mu.Unlock()
+	if !ok {
+		return entry, false
+	}
+
+	info, err := os.Stat(bankFile)
+	if err != nil || info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime) {
+		return entry, false
+	}
+	if !dirExists(entry.OutputDir) {
+		return entry, false
+	}
+	return entry, true
+}
+
+// record appends a completed bank to the journal and syncs it to disk
+func (j *journal) record(result bankResult) error {
+	if j == nil {
+		return nil
+	}
+	info, err := os.Stat(result.BankFile)
+	if err != nil {
+		return err
+	}
+	entry := journalEntry{
+		BankFile:  result.BankFile,
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		OutputDir: result.OutputDir,
+		Extracted: result.Extracted,
+		Completed: time.Now(),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.done[entry.BankFile] = entry
+	return j.file.Sync()
+}
+
+// Close closes the journal file
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// stagingDir returns where a bank is extracted before being moved to bankDir
+func stagingDir(bankDir string) string {
+	rel, err := filepath.Rel(outputDir, bankDir)
+	if err != nil {
+		rel = filepath.Base(bankDir)
+	}
+	return filepath.Join(outputDir, stagingDirName, rel)
+}
+
+// commitBank replaces each of the bank's output directories with its staging
+// directory. A run that only extracted some subsongs keeps what an earlier run
+// extracted of the others.
+func commitBank(task *bankTask) error {
+	if task.stageDir == "" {
+		return nil
+	}
+	dirs := outputDirs(task)
+	if err := carryOverPrevious(task, dirs); err != nil {
+		return fmt.Errorf("failed to keep the previous output of %s: %v", task.result.BankFile, err)
+	}
+	for _, dir := range dirs {
+		target := filepath.Join(outputDir, filepath.FromSlash(dir))
+		staged := stagingDir(target)
+		if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to remove previous output %s: %v", target, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return err
+		}
+		if err := os.Rename(staged, target); err != nil {
+			return fmt.Errorf("failed to move %s into place: %v", staged, err)
+		}
+	}
+	task.stageDir = ""
+	return nil
+}
+
+// carryOverPrevious merges the bank's previous output into its staging
+// directories when this run only extracted some of its subsongs. The files of
+// the other subsongs are moved into staging so they survive the directories
+// being replaced, and the staged manifest is merged with the previous one.
+// Previous files of the subsongs this run extracted again are dropped.
+func carryOverPrevious(task *bankTask, dirs []string) error {
+	result := task.result
+	wanted := result.wantedSubsongs()
+	if wanted == nil {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(result.OutputDir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var previous bankResult
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", filepath.Join(result.OutputDir, manifestFileName), err)
+	}
+
+	redone := make(map[int]bool, len(wanted))
+	for _, subsong := range wanted {
+		redone[subsong] = true
+	}
+	replaced := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		replaced[dir] = true
+	}
+	bankRel := relOutputDir(result.OutputDir)
+
+	merged := result
+	merged.Files = nil
+	for _, file := range previous.Files {
+		for _, rel := range outputFilePaths(file, bankRel) {
+			current := filepath.Join(outputDir, filepath.FromSlash(rel))
+			staged := stagingDir(current)
+			switch {
+			case redone[file.Subsong]:
+				// Directories being replaced drop the file anyway
+				if !replaced[path.Dir(rel)] {
+					if err := os.Remove(current); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			case !replaced[path.Dir(rel)]:
+			default:
+				if _, err := os.Stat(staged); err == nil {
+					return fmt.Errorf("%s of subsong %d has the same name as a file of this run", rel, file.Subsong)
+				}
+				if err := os.Rename(current, staged); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		if !redone[file.Subsong] {
+			merged.Files = append(merged.Files, file)
+			merged.Extracted++
+		}
+	}
+	merged.Files = append(merged.Files, result.Files...)
+	sort.SliceStable(merged.Files, func(a, b int) bool {
+		return merged.Files[a].Subsong < merged.Files[b].Subsong
+	})
+
+	merged.Failed = nil
+	for _, failure := range previous.Failed {
+		if !redone[failure.Subsong] {
+			merged.Failed = append(merged.Failed, failure)
+		}
+	}
+	merged.Failed = append(merged.Failed, result.Failed...)
+	sort.Slice(merged.Failed, func(a, b int) bool {
+		return merged.Failed[a].Subsong < merged.Failed[b].Subsong
+	})
+	merged.Silent = nil
+	for _, subsong := range previous.Silent {
+		if !redone[subsong] {
+			merged.Silent = append(merged.Silent, subsong)
+		}
+	}
+	merged.Silent = append(merged.Silent, result.Silent...)
+	sort.Ints(merged.Silent)
+
+	// The directory now holds what either run extracted
+	merged.Filtered = nil
+	merged.Selected = nil
+	if before := previous.wantedSubsongs(); before != nil {
+		merged.Selected = mergeSubsongs(before, wanted)
+	}
+	merged.Mismatch = merged.expectedCount() > 0 && len(merged.Files) < merged.expectedCount()
+	return writeBankManifest(merged, task.stageDir)
+}
+
+// outputFilePaths returns the audio and image files of an output file,
+// relative to the output directory with forward slashes
+func outputFilePaths(file outputFile, bankRel string) []string {
+	dir := file.Dir
+	if dir == "" {
+		dir = bankRel
+	}
+	paths := []string{path.Join(dir, file.Name)}
+	for _, image := range []string{file.Waveform, file.Spectrogram} {
+		if image != "" {
+			paths = append(paths, image)
+		}
+	}
+	return paths
+}
+
+// mergeSubsongs returns the sorted union of two subsong lists
+func mergeSubsongs(a, b []int) []int {
+	seen := make(map[int]bool, len(a)+len(b))
+	union := []int{}
+	for _, subsong := range append(append([]int{}, a...), b...) {
+		if !seen[subsong] {
+			seen[subsong] = true
+			union = append(union, subsong)
+		}
+	}
+	sort.Ints(union)
+	return union
+}
+
+// discardStaging removes whatever a failed bank left in its staging directories
+func discardStaging(task *bankTask) {
+	if task.stageDir == "" {
+		return
+	}
+	for _, dir := range outputDirs(task) {
+		staged := stagingDir(filepath.Join(outputDir, filepath.FromSlash(dir)))
+		if err := os.RemoveAll(staged); err != nil {
+			fileLogger.Printf("Failed to remove staging directory %s: %v\n", staged, err)
+		}
+	}
+}
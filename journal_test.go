@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalResume(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "output")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	bankFile := filepath.Join(tempDir, "Music_Test.bank")
+	if err := os.WriteFile(bankFile, []byte("FSB5"), 0600); err != nil {
+		t.Fatalf("Failed to write bank file: %v", err)
+	}
+	bankDir := filepath.Join(tempDir, "Music", "Music_Test")
+	if err := os.MkdirAll(bankDir, 0750); err != nil {
+		t.Fatalf("Failed to create bank dir: %v", err)
+	}
+
+	j, err := openJournal(tempDir, false)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	if err := j.record(bankResult{BankFile: bankFile, OutputDir: bankDir, Extracted: 3}); err != nil {
+		t.Fatalf("Failed to record bank: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Failed to close journal: %v", err)
+	}
+
+	// Simulate a crash in the middle of writing the next entry
+	path := filepath.Join(tempDir, journalFileName)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("Failed to open journal file: %v", err)
+	}
+	if _, err := f.WriteString(`{"bankFile":"trunc`); err != nil {
+		t.Fatalf("Failed to append to journal: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Failed to close journal file: %v", err)
+	}
+
+	resumed, err := openJournal(tempDir, true)
+	if err != nil {
+		t.Fatalf("Failed to resume journal: %v", err)
+	}
+	entry, ok := resumed.completed(bankFile)
+	if !ok || entry.Extracted != 3 {
+		t.Errorf("Expected the bank to be completed, got %+v (%v)", entry, ok)
+	}
+
+	// A changed bank has to be extracted again
+	if err := os.WriteFile(bankFile, []byte("FSB5 updated"), 0600); err != nil {
+		t.Fatalf("Failed to update bank file: %v", err)
+	}
+	if _, ok := resumed.completed(bankFile); ok {
+		t.Errorf("Expected a modified bank not to count as completed")
+	}
+	if err := resumed.Close(); err != nil {
+		t.Fatalf("Failed to close journal: %v", err)
+	}
+
+	// Without --resume the journal starts over
+	fresh, err := openJournal(tempDir, false)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer func() {
+		if err := fresh.Close(); err != nil {
+			t.Logf("Error closing journal: %v", err)
+		}
+	}()
+	if _, ok := fresh.completed(bankFile); ok {
+		t.Errorf("Expected a fresh journal to have no completed banks")
+	}
+
+	// A nil journal is a no-op
+	var disabled *journal
+	if _, ok := disabled.completed(bankFile); ok {
+		t.Errorf("Expected a nil journal to report nothing as completed")
+	}
+}
+
+func TestCommitBank(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "output")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalOutputDir := outputDir
+	outputDir = tempDir
+	defer func() { outputDir = originalOutputDir }()
+
+	bankDir := filepath.Join(tempDir, "SFX", "SFX_Test")
+	task := &bankTask{result: bankResult{OutputDir: bankDir}, stageDir: stagingDir(bankDir)}
+	if task.stageDir != filepath.Join(tempDir, stagingDirName, "SFX", "SFX_Test") {
+		t.Errorf("Unexpected staging dir: %s", task.stageDir)
+	}
+
+	// A stale file from an earlier run must not survive the commit
+	if err := os.MkdirAll(bankDir, 0750); err != nil {
+		t.Fatalf("Failed to create bank dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(bankDir, "stale.wav"), []byte("old"), 0600); err != nil {
+		t.Fatalf("Failed to write stale file: %v", err)
+	}
+	if err := os.MkdirAll(task.stageDir, 0750); err != nil {
+		t.Fatalf("Failed to create staging dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(task.stageDir, "01_new.wav"), []byte("new"), 0600); err != nil {
+		t.Fatalf("Failed to write staged file: %v", err)
+	}
+
+	if err := commitBank(task); err != nil {
+		t.Fatalf("Failed to commit bank: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bankDir, "01_new.wav")); err != nil {
+		t.Errorf("Expected the staged file in the bank dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bankDir, "stale.wav")); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale file to be gone")
+	}
+	if dirExists(stagingDir(bankDir)) {
+		t.Errorf("Expected the staging dir to be moved away")
+	}
+	if task.workDir() != bankDir {
+		t.Errorf("Expected the work dir to be the bank dir after commit, got %s", task.workDir())
+	}
+}
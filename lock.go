@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// lockFileName marks an output directory as in use by a running extraction
+	lockFileName = ".fsbext.lock"
+
+	// lockPollInterval is how often a waiting run checks whether the lock is free
+	lockPollInterval = time.Second
+)
+
+// lockInfo is written into the lock file to identify the run holding it
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// outputLock is an advisory lock on an output directory
+type outputLock struct {
+	path string
+	info lockInfo
+}
+
+// acquireOutputLock takes the lock on dir. If another run holds it, we wait up
+// to wait for it to be released before giving up. Locks left behind by a
+// process that no longer runs on this host, or older than staleAge, are taken over.
+func acquireOutputLock(dir string, wait, staleAge time.Duration) (*outputLock, error) {
+	path := filepath.Join(dir, lockFileName)
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	lock := &outputLock{path: path, info: lockInfo{PID: os.Getpid(), Host: host, Started: time.Now()}}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := lock.create()
+		if err == nil {
+			return lock, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file %s: %v", path, err)
+		}
+
+		holder, data, stale := inspectLock(path, host, staleAge)
+		if stale {
+			fileLogger.Printf("Removing stale lock %s held by PID %d on %s since %s\n",
+				path, holder.PID, holder.Host, holder.Started.Format(time.RFC3339))
+			if err := removeStaleLock(path, data); err != nil {
+				return nil, fmt.Errorf("failed to remove stale lock file %s: %v", path, err)
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("output directory %s is in use by PID %d on %s since %s (remove %s if that run is gone)",
+				dir, holder.PID, holder.Host, holder.Started.Format(time.RFC3339), path)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// create writes the lock file, failing with os.ErrExist if it is already there
+func (l *outputLock) create() error {
+	file, err := os.OpenFile(filepath.Clean(l.path), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(l.info)
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if removeErr := os.Remove(l.path); removeErr != nil {
+			fileLogger.Printf("Failed to remove lock file %s: %v\n", l.path, removeErr)
+		}
+		// Don't wrap the error so a write failure can't look like a lock held by someone else
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	return nil
+}
+
+// removeStaleLock takes a stale lock file out of the way. The file is first
+// renamed to a name of our own, which only one waiting run can do, and then
+// deleted only if it still holds the data judged stale. A fresh lock another
+// waiting run created in the meantime is put back.
+func removeStaleLock(path string, stale []byte) error {
+	moved := fmt.Sprintf("%s.%d.stale", path, os.Getpid())
+	if err := os.Rename(path, moved); err != nil {
+		if os.IsNotExist(err) {
+			// Another run took the stale lock out of the way first
+			return nil
+		}
+		return err
+	}
+	data, err := os.ReadFile(filepath.Clean(moved))
+	if err != nil || !bytes.Equal(data, stale) {
+		// Link fails rather than replace a lock yet another run created since
+		if err := os.Link(moved, path); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return os.Remove(moved)
+}
+
+// inspectLock reads the lock file and decides whether its holder is gone. It
+// also returns the lock file's data so a takeover can check it is unchanged.
+func inspectLock(path, host string, staleAge time.Duration) (lockInfo, []byte, bool) {
+	var holder lockInfo
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		// The lock was released between our create attempt and now
+		return holder, nil, os.IsNotExist(err)
+	}
+
+	if err := json.Unmarshal(data, &holder); err != nil {
+		// A lock cut short by a crash; fall back on the file's age
+		if info, err := os.Stat(path); err == nil {
+			holder.Started = info.ModTime()
+		}
+		return holder, data, staleAge > 0 && time.Since(holder.Started) > staleAge
+	}
+
+	if holder.Host == host && !processExists(holder.PID) {
+		return holder, data, true
+	}
+	return holder, data, staleAge > 0 && time.Since(holder.Started) > staleAge
+}
+
+// Release removes the lock file if it is still ours
+func (l *outputLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	var holder lockInfo
+	data, err := os.ReadFile(filepath.Clean(l.path))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &holder); err != nil || holder.PID != l.info.PID || holder.Host != l.info.Host {
+		return fmt.Errorf("lock file %s is no longer ours", l.path)
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireOutputLock(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "output")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	lock, err := acquireOutputLock(tempDir, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	// A second run fails fast and names the holder
+	if _, err := acquireOutputLock(tempDir, 0, time.Hour); err == nil {
+		t.Errorf("Expected the second lock attempt to fail")
+	} else if !strings.Contains(err.Error(), "in use by PID") {
+		t.Errorf("Expected the error to name the holder, got %v", err)
+	}
+
+	// A waiting run gets the lock once the first one releases it
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := lock.Release(); err != nil {
+			t.Errorf("Failed to release lock: %v", err)
+		}
+	}()
+	waiting, err := acquireOutputLock(tempDir, 5*time.Second, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected the waiting run to get the lock: %v", err)
+	}
+	if err := waiting.Release(); err != nil {
+		t.Errorf("Failed to release lock: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, lockFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the lock file to be removed")
+	}
+}
+
+func TestAcquireOutputLockStale(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "output")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+	path := filepath.Join(tempDir, lockFileName)
+
+	// Get the PID of a process that has already exited
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to run helper process: %v", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Failed to get hostname: %v", err)
+	}
+	data, err := json.Marshal(lockInfo{PID: cmd.Process.Pid, Host: host, Started: time.Now()})
+	if err != nil {
+		t.Fatalf("Failed to marshal lock info: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+
+	lock, err := acquireOutputLock(tempDir, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected a lock of a dead process to be taken over: %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("Failed to release lock: %v", err)
+	}
+
+	// A live holder on another host is only taken over once it is old enough
+	data, err = json.Marshal(lockInfo{PID: os.Getpid(), Host: "elsewhere", Started: time.Now().Add(-2 * time.Hour)})
+	if err != nil {
+		t.Fatalf("Failed to marshal lock info: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	if _, err := acquireOutputLock(tempDir, 0, 0); err == nil {
+		t.Errorf("Expected a remote lock to be respected with age checks disabled")
+	}
+	lock, err = acquireOutputLock(tempDir, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected an old remote lock to be taken over: %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("Failed to release lock: %v", err)
+	}
+}
+
+func TestRemoveStaleLock(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "output")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+	path := filepath.Join(tempDir, lockFileName)
+	stale := []byte(`{"pid":1,"host":"elsewhere"}`)
+	fresh := []byte(`{"pid":2,"host":"elsewhere"}`)
+
+	// Another waiting run already replaced the stale lock with its own
+	if err := os.WriteFile(path, fresh, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	if err := removeStaleLock(path, stale); err != nil {
+		t.Fatalf("removeStaleLock returned an error: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != string(fresh) {
+		t.Errorf("Expected the fresh lock to be kept, got %q (%v)", data, err)
+	}
+
+	if err := os.WriteFile(path, stale, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	if err := removeStaleLock(path, stale); err != nil {
+		t.Fatalf("removeStaleLock returned an error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale lock to be removed")
+	}
+	if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no files left behind, got %v (%v)", entries, err)
+	}
+
+	// A lock that is already gone is nothing to take over
+	if err := removeStaleLock(path, stale); err != nil {
+		t.Errorf("Expected no error for a missing lock, got %v", err)
+	}
+}
+
+func TestProcessExists(t *testing.T) {
+	if !processExists(os.Getpid()) {
+		t.Errorf("Expected the current process to exist")
+	}
+	if processExists(0) {
+		t.Errorf("Expected PID 0 not to count as a running process")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// noLoopPoints leaves the loop metadata out of the output files
+var noLoopPoints bool
+
+// writingLoopPoints reports whether loop metadata goes into the output files.
+// Rendered loops are meant to be played through, so they get none.
+func writingLoopPoints() bool {
+	return !noLoopPoints && !renderingLoops()
+}
+
+// loopArgs returns the vgmstream options for decoding. With loop points
+// written, looping streams are decoded once through with -i instead of
+// looped twice and faded, so the loop points and the manifest's sample count
+// describe the file.
+func loopArgs() []string {
+	if writingLoopPoints() {
+		return []string{"-i"}
+	}
+	return nil
+}
+
+// Cue point IDs of the loop markers
+const (
+	loopStartCue = 1
+	loopEndCue   = 2
+)
+
+// hasLoop reports whether a stream has usable loop points. vgmstream's loop
+// end is exclusive.
+func hasLoop(stream streamInfo) bool {
+	return stream.Looping && stream.LoopStart >= 0 && stream.LoopEnd > stream.LoopStart &&
+		stream.LoopEnd < 1<<32
+}
+
+// loopChunks builds the smpl chunk with a forward loop and the cue chunk
+// marking its start and end
+func loopChunks(stream streamInfo) []wavChunk {
+	// smpl: manufacturer, product, sample period in ns, MIDI unity note, pitch
+	// fraction, SMPTE format and offset, loop count, sampler data, then the loop
+	smpl := make([]byte, 36+24)
+	if stream.SampleRate > 0 {
+		binary.LittleEndian.PutUint32(smpl[8:12], uint32(1_000_000_000/stream.SampleRate))
+	}
+	binary.LittleEndian.PutUint32(smpl[12:16], 60)
+	binary.LittleEndian.PutUint32(smpl[28:32], 1)
+	loop := smpl[36:]
+	binary.LittleEndian.PutUint32(loop[0:4], loopStartCue)
+	binary.LittleEndian.PutUint32(loop[4:8], 0) // forward
+	binary.LittleEndian.PutUint32(loop[8:12], uint32(stream.LoopStart))
+	// The smpl loop end is the last sample played, so inclusive
+	binary.LittleEndian.PutUint32(loop[12:16], uint32(stream.LoopEnd-1))
+	// Fraction 0 and play count 0, which loops forever
+
+	cue := binary.LittleEndian.AppendUint32(nil, 2)
+	for _, point := range []struct {
+		id       uint32
+		position int64
+	}{{loopStartCue, stream.LoopStart}, {loopEndCue, stream.LoopEnd}} {
+		cue = binary.LittleEndian.AppendUint32(cue, point.id)
+		cue = binary.LittleEndian.AppendUint32(cue, uint32(point.position))
+		cue = append(cue, "data"...)
+		cue = binary.LittleEndian.AppendUint32(cue, 0)
+		cue = binary.LittleEndian.AppendUint32(cue, 0)
+		cue = binary.LittleEndian.AppendUint32(cue, uint32(point.position))
+	}
+
+	return []wavChunk{{ID: "smpl", Data: smpl}, {ID: "cue ", Data: cue}}
+}
+
+// loopTags returns the LOOPSTART and LOOPLENGTH comments players use for
+// looping FLAC and Ogg files
+func loopTags(stream streamInfo) []flacTag {
+	if !writingLoopPoints() || !hasLoop(stream) {
+		return nil
+	}
+	return []flacTag{
+		{"LOOPSTART", strconv.FormatInt(stream.LoopStart, 10)},
+		{"LOOPLENGTH", strconv.FormatInt(stream.LoopEnd-stream.LoopStart, 10)},
+	}
+}
+
+// writeLoopPoints adds the loop points of looping subsongs to their WAV files
+func writeLoopPoints(result bankResult, dir string, files []outputFile) error {
+	if !writingLoopPoints() {
+		return nil
+	}
+	for i := range files {
+		stream, ok := findStream(result, files[i].Subsong)
+		if !ok || !hasLoop(stream) || !strings.EqualFold(filepath.Ext(files[i].Name), ".wav") {
+			continue
+		}
+		path := filepath.Join(dir, files[i].Name)
+		if err := rewriteWAVChunks(path, loopChunks(stream)); err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+		if err := files[i].rehash(path); err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteLoopPoints(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	audio := testAudio(48000, 2, 16, 1000)
+	var wav bytes.Buffer
+	// An existing smpl chunk, e.g. from vgmstream -L, is replaced
+	if err := writeWAV(&wav, audio, []wavChunk{{ID: "smpl", Data: make([]byte, 36)}, {ID: "note", Data: []byte("x")}}); err != nil {
+		t.Fatalf("writeWAV returned an error: %v", err)
+	}
+	for _, name := range []string{"00001_loop.wav", "00002_once.wav"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), wav.Bytes(), 0600); err != nil {
+			t.Fatalf("Failed to write WAV: %v", err)
+		}
+	}
+
+	result := bankResult{Streams: []streamInfo{
+		{Index: 1, Name: "loop", SampleRate: 48000, Looping: true, LoopStart: 100, LoopEnd: 900},
+		{Index: 2, Name: "once", SampleRate: 48000},
+	}}
+	files := []outputFile{{Subsong: 1, Name: "00001_loop.wav"}, {Subsong: 2, Name: "00002_once.wav"}}
+	if err := hashOutputFiles(tempDir, files); err != nil {
+		t.Fatalf("hashOutputFiles returned an error: %v", err)
+	}
+	decoded := files[0].SHA256
+	if err := writeLoopPoints(result, tempDir, files); err != nil {
+		t.Fatalf("writeLoopPoints returned an error: %v", err)
+	}
+	// The hash of the decoded audio stays the same with or without loop points
+	if files[0].DecodedSHA256 != decoded || files[0].SHA256 == decoded || files[1].DecodedSHA256 != "" {
+		t.Errorf("Expected the decoded hash to be kept, got %+v", files)
+	}
+	if sum, size, err := hashFile(filepath.Join(tempDir, "00001_loop.wav")); err != nil || sum != files[0].SHA256 || size != files[0].Size {
+		t.Errorf("Expected the hash of the rewritten file, got %s (%v)", sum, err)
+	}
+
+	got, chunks, err := readWAVFile(filepath.Join(tempDir, "00001_loop.wav"))
+	if err != nil {
+		t.Fatalf("Failed to read the looped WAV: %v", err)
+	}
+	if len(got.Samples) != len(audio.Samples) {
+		t.Errorf("Expected the audio to be kept, got %d samples", len(got.Samples))
+	}
+	byID := make(map[string][]byte)
+	for _, chunk := range chunks {
+		if _, ok := byID[chunk.ID]; ok {
+			t.Errorf("Duplicate %q chunk", chunk.ID)
+		}
+		byID[chunk.ID] = chunk.Data
+	}
+	if string(byID["note"]) != "x" {
+		t.Errorf("Expected other chunks to be kept, got %v", chunks)
+	}
+	smpl := byID["smpl"]
+	if len(smpl) != 60 || binary.LittleEndian.Uint32(smpl[28:32]) != 1 {
+		t.Fatalf("Expected a smpl chunk with one loop, got % x", smpl)
+	}
+	if start, end := binary.LittleEndian.Uint32(smpl[44:48]), binary.LittleEndian.Uint32(smpl[48:52]); start != 100 || end != 899 {
+		t.Errorf("Expected the loop 100-899, got %d-%d", start, end)
+	}
+	if period := binary.LittleEndian.Uint32(smpl[8:12]); period != 20833 {
+		t.Errorf("Expected a sample period of 20833 ns, got %d", period)
+	}
+	cue := byID["cue "]
+	if len(cue) != 4+2*24 || binary.LittleEndian.Uint32(cue[8:12]) != 100 || binary.LittleEndian.Uint32(cue[32:36]) != 900 {
+		t.Errorf("Expected cue points at 100 and 900, got % x", cue)
+	}
+
+	unchanged, err := os.ReadFile(filepath.Join(tempDir, "00002_once.wav"))
+	if err != nil {
+		t.Fatalf("Failed to read WAV: %v", err)
+	}
+	if !bytes.Equal(unchanged, wav.Bytes()) {
+		t.Errorf("Expected the non-looping subsong to be left alone")
+	}
+}
+
+func TestLoopTags(t *testing.T) {
+	originalNoLoopPoints := noLoopPoints
+	defer func() { noLoopPoints = originalNoLoopPoints }()
+
+	stream := streamInfo{Index: 1, Looping: true, LoopStart: 2000, LoopEnd: 50000}
+	tags := flacTags(bankResult{BankFile: "Music_Dawn.bank", Streams: []streamInfo{stream}}, outputFile{Subsong: 1})
+	found := map[string]string{}
+	for _, tag := range tags {
+		found[tag.Name] = tag.Value
+	}
+	if found["LOOPSTART"] != "2000" || found["LOOPLENGTH"] != "48000" {
+		t.Errorf("Expected LOOPSTART 2000 and LOOPLENGTH 48000, got %v", tags)
+	}
+
+	for _, s := range []streamInfo{
+		{Looping: false, LoopStart: 0, LoopEnd: 100},
+		{Looping: true, LoopStart: 100, LoopEnd: 100},
+	} {
+		if tags := loopTags(s); tags != nil {
+			t.Errorf("Expected no loop tags for %+v, got %v", s, tags)
+		}
+	}
+	noLoopPoints = true
+	if tags := loopTags(stream); tags != nil {
+		t.Errorf("Expected --no-loop-points to leave the tags out, got %v", tags)
+	}
+}
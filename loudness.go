@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// loudnessFloor is the absolute gate of BS.1770; quieter audio is
+	// reported at this level
+	loudnessFloor = -70.0
+
+	// truePeakFloor is reported for digital silence
+	truePeakFloor = -120.0
+
+	// Limiter look-ahead and release
+	limiterAttack  = 0.005
+	limiterRelease = 0.05
+)
+
+var (
+	measureLoudness bool
+	normalizeSpec   string
+	truePeakSpec    = "-1dBTP"
+
+	// normalizeTarget and truePeakCeiling are parsed from the options above
+	normalizeTarget *float64
+	truePeakCeiling = -1.0
+)
+
+// loudnessInfo is the EBU R128 measurement of an output file as decoded,
+// and the gain applied to it by --normalize
+type loudnessInfo struct {
+	Integrated float64 `json:"integratedLufs"`
+	Range      float64 `json:"rangeLu"`
+	TruePeak   float64 `json:"truePeakDbtp"`
+	Gain       float64 `json:"gainDb,omitempty"`
+}
+
+// parseLevel parses a level such as "-16LUFS" or "-16", with the unit optional
+func parseLevel(spec, unit string) (float64, error) {
+	value := strings.TrimSpace(spec)
+	if len(value) >= len(unit) && strings.EqualFold(value[len(value)-len(unit):], unit) {
+		value = strings.TrimSpace(value[:len(value)-len(unit)])
+	}
+	level, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(level) || math.IsInf(level, 0) {
+		return 0, fmt.Errorf("invalid level %q, expected a number of %s", spec, unit)
+	}
+	return level, nil
+}
+
+// validateLoudnessOptions parses --normalize and --true-peak
+func validateLoudnessOptions() error {
+	ceiling, err := parseLevel(truePeakSpec, "dBTP")
+	if err != nil {
+		return err
+	}
+	if ceiling > 0 {
+		return fmt.Errorf("--true-peak %s is above full scale", truePeakSpec)
+	}
+	truePeakCeiling = ceiling
+
+	if normalizeSpec != "" {
+		target, err := parseLevel(normalizeSpec, "LUFS")
+		if err != nil {
+			return err
+		}
+		if target >= 0 || target <= loudnessFloor {
+			return fmt.Errorf("--normalize %s is outside %g to 0 LUFS", normalizeSpec, loudnessFloor)
+		}
+		normalizeTarget = &target
+	}
+	return nil
+}
+
+// biquad is a second order IIR filter
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+// apply filters the signal
+func (f biquad) apply(x []float64) []float64 {
+	y := make([]float64, len(x))
+	var x1, x2, y1, y2 float64
+	for i, in := range x {
+		out := f.b0*in + f.b1*x1 + f.b2*x2 - f.a1*y1 - f.a2*y2
+		x2, x1 = x1, in
+		y2, y1 = y1, out
+		y[i] = out
+	}
+	return y
+}
+
+// kWeighting returns the two stages of the BS.1770 K-weighting filter for
+// the sample rate, derived from the analogue prototypes so any rate works
+func kWeighting(rate int) (biquad, biquad) {
+	// High shelf modelling the acoustic effect of the head
+	k := math.Tan(math.Pi * 1681.974450955533 / float64(rate))
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// RLB high-pass
+	k = math.Tan(math.Pi * 38.13547087602444 / float64(rate))
+	q = 0.5003270373238773
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return shelf, highPass
+}
+
+// channelWeights returns the BS.1770 weight of each channel: surround
+// channels of 5.1 and 7.1 count 1.41 times and the LFE not at all
+func channelWeights(channels int) []float64 {
+	weights := make([]float64, channels)
+	for ch := range weights {
+		weights[ch] = 1
+	}
+	if channels == 6 || channels == 8 {
+		weights[3] = 0
+		for ch := 4; ch < channels; ch++ {
+			weights[ch] = 1.41
+		}
+	}
+	return weights
+}
+
+// splitChannels converts interleaved PCM to a float signal per channel with
+// full scale at -1 and 1
+func splitChannels(audio *pcmAudio) [][]float64 {
+	scale := 1 / float64(int64(1)<<(audio.BitsPerSample-1))
+	frames := audio.frames()
+	channels := make([][]float64, audio.Channels)
+	for ch := range channels {
+		channels[ch] = make([]float64, frames)
+		for i := 0; i < frames; i++ {
+			if audio.Float != nil {
+				channels[ch][i] = float64(audio.Float[i*audio.Channels+ch])
+			} else {
+				channels[ch][i] = float64(audio.Samples[i*audio.Channels+ch]) * scale
+			}
+		}
+	}
+	return channels
+}
+
+// blockLoudness returns the loudness of each window of the given length,
+// taken every hop samples, from the cumulative weighted energy
+func blockLoudness(energy []float64, length, hop int) []float64 {
+	frames := len(energy) - 1
+	if frames <= 0 {
+		return nil
+	}
+	// Audio shorter than a window is measured as a whole
+	length = min(length, frames)
+	var powers []float64
+	for start := 0; start+length <= frames; start += hop {
+		powers = append(powers, (energy[start+length]-energy[start])/float64(length))
+	}
+	return powers
+}
+
+// powerToLoudness converts a weighted mean square to LUFS
+func powerToLoudness(power float64) float64 {
+	if power <= 0 {
+		return math.Inf(-1)
+	}
+	return -0.691 + 10*math.Log10(power)
+}
+
+// gatedPowers applies the absolute gate and a relative gate the given number
+// of LU below the gated mean
+func gatedPowers(powers []float64, relative float64) []float64 {
+	var absolute []float64
+	var sum float64
+	for _, power := range powers {
+		if powerToLoudness(power) > loudnessFloor {
+			absolute = append(absolute, power)
+			sum += power
+		}
+	}
+	if len(absolute) == 0 {
+		return nil
+	}
+	threshold := powerToLoudness(sum/float64(len(absolute))) - relative
+	var gated []float64
+	for _, power := range absolute {
+		if powerToLoudness(power) > threshold {
+			gated = append(gated, power)
+		}
+	}
+	return gated
+}
+
+// measureProgramLoudness returns the integrated loudness and the loudness
+// range as defined by BS.1770 and EBU Tech 3342
+func measureProgramLoudness(channels [][]float64, rate int) (float64, float64) {
+	if len(channels) == 0 || len(channels[0]) == 0 {
+		return loudnessFloor, 0
+	}
+	shelf, highPass := kWeighting(rate)
+	weights := channelWeights(len(channels))
+	energy := make([]float64, len(channels[0])+1)
+	for ch, signal := range channels {
+		if weights[ch] == 0 {
+			continue
+		}
+		filtered := highPass.apply(shelf.apply(signal))
+		for i, s := range filtered {
+			energy[i+1] += weights[ch] * s * s
+		}
+	}
+	for i := 1; i < len(energy); i++ {
+		energy[i] += energy[i-1]
+	}
+
+	// 400 ms momentary blocks with 75% overlap
+	hop := max(rate/10, 1)
+	integrated := loudnessFloor
+	if gated := gatedPowers(blockLoudness(energy, 4*hop, hop), 10); len(gated) > 0 {
+		var sum float64
+		for _, power := range gated {
+			sum += power
+		}
+		integrated = max(powerToLoudness(sum/float64(len(gated))), loudnessFloor)
+	}
+
+	// 3 s short-term blocks, the spread between the 10th and 95th percentile
+	var loudnessRange float64
+	if len(channels[0]) >= 30*hop {
+		gated := gatedPowers(blockLoudness(energy, 30*hop, hop), 20)
+		if len(gated) > 1 {
+			levels := make([]float64, len(gated))
+			for i, power := range gated {
+				levels[i] = powerToLoudness(power)
+			}
+			sort.Float64s(levels)
+			loudnessRange = percentile(levels, 0.95) - percentile(levels, 0.10)
+		}
+	}
+	return integrated, loudnessRange
+}
+
+// percentile interpolates the given fraction of sorted values
+func percentile(sorted []float64, fraction float64) float64 {
+	position := fraction * float64(len(sorted)-1)
+	lower := int(position)
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (position-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// truePeakTaps is the number of samples on each side used to interpolate
+const truePeakTaps = 6
+
+// interpolationKernel returns the Lanczos coefficients for the points a
+// quarter, half and three quarters of the way to the next sample, for 4x
+// oversampling as BS.1770 suggests
+func interpolationKernel() [3][2 * truePeakTaps]float64 {
+	var kernel [3][2 * truePeakTaps]float64
+	sinc := func(x float64) float64 {
+		if x == 0 {
+			return 1
+		}
+		return math.Sin(math.Pi*x) / (math.Pi * x)
+	}
+	for phase := range kernel {
+		offset := float64(phase+1) / 4
+		for k := range kernel[phase] {
+			x := offset - float64(k-truePeakTaps+1)
+			kernel[phase][k] = sinc(x) * sinc(x/truePeakTaps)
+		}
+	}
+	return kernel
+}
+
+// framePeaks returns the largest absolute value of each frame across all
+// channels, including the interpolated values up to the next frame
+func framePeaks(channels [][]float64) []float64 {
+	if len(channels) == 0 {
+		return nil
+	}
+	kernel := interpolationKernel()
+	peaks := make([]float64, len(channels[0]))
+	for _, signal := range channels {
+		for i, s := range signal {
+			peak := math.Abs(s)
+			for phase := range kernel {
+				var value float64
+				for k, coefficient := range kernel[phase] {
+					if j := i + k - truePeakTaps + 1; j >= 0 && j < len(signal) {
+						value += signal[j] * coefficient
+					}
+				}
+				peak = max(peak, math.Abs(value))
+			}
+			peaks[i] = max(peaks[i], peak)
+		}
+	}
+	return peaks
+}
+
+// amplitudeToDB converts a linear level to decibels, floored at truePeakFloor
+func amplitudeToDB(amplitude float64) float64 {
+	if amplitude <= 0 {
+		return truePeakFloor
+	}
+	return max(20*math.Log10(amplitude), truePeakFloor)
+}
+
+// roundLevel keeps two decimals, which is more than the measurement's accuracy
+func roundLevel(level float64) float64 {
+	return math.Round(level*100) / 100
+}
+
+// analyzeLoudness measures an audio signal. It returns the per-frame peaks
+// too since normalisation needs them.
+func analyzeLoudness(audio *pcmAudio) (loudnessInfo, [][]float64, []float64) {
+	channels := splitChannels(audio)
+	integrated, loudnessRange := measureProgramLoudness(channels, audio.SampleRate)
+	peaks := framePeaks(channels)
+	var truePeak float64
+	for _, peak := range peaks {
+		truePeak = max(truePeak, peak)
+	}
+	info := loudnessInfo{
+		Integrated: roundLevel(integrated),
+		Range:      roundLevel(loudnessRange),
+		TruePeak:   roundLevel(amplitudeToDB(truePeak)),
+	}
+	return info, channels, peaks
+}
+
+// limiterGains returns the gain of each frame that keeps the peaks below the
+// ceiling once gain is applied. The gain ramps down ahead of each peak and
+// recovers slowly after it.
+func limiterGains(peaks []float64, gain, ceiling float64, rate int) []float64 {
+	gains := make([]float64, len(peaks))
+	attack := 1 / max(limiterAttack*float64(rate), 1)
+	release := 1 / max(limiterRelease*float64(rate), 1)
+
+	next := 1.0
+	for i := len(peaks) - 1; i >= 0; i-- {
+		required := 1.0
+		if level := peaks[i] * gain; level > ceiling {
+			required = ceiling / level
+		}
+		next = min(required, next+attack)
+		gains[i] = next
+	}
+	previous := 1.0
+	for i := range gains {
+		previous = min(gains[i], previous+release)
+		gains[i] = previous
+	}
+	return gains
+}
+
+// normalizeAudio applies gain in dB to the audio, limiting its true peak to
+// the ceiling in dBTP
+func normalizeAudio(audio *pcmAudio, channels [][]float64, peaks []float64, gainDB, ceilingDB float64) {
+	gain := math.Pow(10, gainDB/20)
+	limiter := limiterGains(peaks, gain, math.Pow(10, ceilingDB/20), audio.SampleRate)
+
+	fullScale := float64(int64(1) << (audio.BitsPerSample - 1))
+	for ch, signal := range channels {
+		for i, s := range signal {
+			if audio.Float != nil {
+				audio.Float[i*audio.Channels+ch] = float32(s * gain * limiter[i])
+				continue
+			}
+			value := math.Round(s * gain * limiter[i] * fullScale)
+			audio.Samples[i*audio.Channels+ch] = int32(max(min(value, fullScale-1), -fullScale))
+		}
+	}
+}
+
+// analyzeOutputFiles measures the loudness of the WAV files in dir and, with
+// --normalize, brings them to the target loudness
+func analyzeOutputFiles(dir string, files []outputFile) error {
+	if !measureLoudness && normalizeTarget == nil {
+		return nil
+	}
+	var firstErr error
+	for i := range files {
+		if !strings.EqualFold(filepath.Ext(files[i].Name), ".wav") {
+			continue
+		}
+		path := filepath.Join(dir, files[i].Name)
+		audio, chunks, err := readWAVFile(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", files[i].Name, err)
+			}
+			continue
+		}
+		info, channels, peaks := analyzeLoudness(audio)
+
+		// Silence has no loudness to normalise. A file that couldn't be
+		// rewritten keeps its measurement without a gain.
+		if normalizeTarget != nil && info.Integrated > loudnessFloor {
+			normalizeAudio(audio, channels, peaks, *normalizeTarget-info.Integrated, truePeakCeiling)
+			err := writeWAVFile(path, audio, chunks)
+			if err == nil {
+				err = files[i].rehash(path)
+			}
+			if err == nil {
+				info.Gain = roundLevel(*normalizeTarget - info.Integrated)
+			} else if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", files[i].Name, err)
+			}
+		}
+		files[i].Loudness = &info
+	}
+	return firstErr
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sineAudio generates a sine of the given frequency and peak amplitude on
+// every channel
+func sineAudio(rate, channels int, frequency, amplitude float64, seconds float64) *pcmAudio {
+	audio := &pcmAudio{SampleRate: rate, Channels: channels, BitsPerSample: 16}
+	frames := int(seconds * float64(rate))
+	for i := 0; i < frames; i++ {
+		value := int32(math.Round(amplitude * 32767 * math.Sin(2*math.Pi*frequency*float64(i)/float64(rate))))
+		for ch := 0; ch < channels; ch++ {
+			audio.Samples = append(audio.Samples, value)
+		}
+	}
+	return audio
+}
+
+func TestAnalyzeLoudness(t *testing.T) {
+	tests := []struct {
+		name       string
+		audio      *pcmAudio
+		integrated float64
+		truePeak   float64
+	}{
+		// A 997 Hz stereo sine reads its peak level in LUFS, mono 3 LU lower
+		{"stereo -20 dBFS", sineAudio(48000, 2, 997, 0.1, 5), -20, -20},
+		{"mono -20 dBFS", sineAudio(48000, 1, 997, 0.1, 5), -23.01, -20},
+		{"44.1 kHz", sineAudio(44100, 2, 997, 0.5, 5), -6.02, -6.02},
+		{"silence", &pcmAudio{SampleRate: 48000, Channels: 2, BitsPerSample: 16, Samples: make([]int32, 96000)}, loudnessFloor, truePeakFloor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, _, _ := analyzeLoudness(tt.audio)
+			if math.Abs(info.Integrated-tt.integrated) > 0.1 {
+				t.Errorf("Expected %.2f LUFS, got %.2f", tt.integrated, info.Integrated)
+			}
+			if math.Abs(info.TruePeak-tt.truePeak) > 0.1 {
+				t.Errorf("Expected a true peak of %.2f dBTP, got %.2f", tt.truePeak, info.TruePeak)
+			}
+			if info.Range > 0.5 {
+				t.Errorf("Expected no loudness range for a steady tone, got %.2f", info.Range)
+			}
+		})
+	}
+
+	// A quiet and a loud half give a loudness range of about the difference
+	audio := sineAudio(48000, 2, 997, 0.05, 10)
+	loud := sineAudio(48000, 2, 997, 0.5, 10)
+	audio.Samples = append(audio.Samples, loud.Samples...)
+	if info, _, _ := analyzeLoudness(audio); info.Range < 15 || info.Range > 20 {
+		t.Errorf("Expected a loudness range around 20 LU, got %.2f", info.Range)
+	}
+
+	// A sine at a quarter of the sample rate peaks between the samples
+	intersample := &pcmAudio{SampleRate: 48000, Channels: 1, BitsPerSample: 16}
+	for i := 0; i < 48000; i++ {
+		intersample.Samples = append(intersample.Samples, int32(math.Round(0.5*32767*math.Sin(math.Pi/2*float64(i)+math.Pi/4))))
+	}
+	if info, _, _ := analyzeLoudness(intersample); info.TruePeak < -6.3 {
+		t.Errorf("Expected the true peak to find the peak between samples, got %.2f dBTP", info.TruePeak)
+	}
+}
+
+func TestNormalizeOutputFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalSpec, originalTarget, originalCeiling := normalizeSpec, normalizeTarget, truePeakCeiling
+	defer func() {
+		normalizeSpec, normalizeTarget, truePeakCeiling = originalSpec, originalTarget, originalCeiling
+	}()
+	quiet := sineAudio(48000, 2, 997, 0.1, 3)
+	// Clicks that would clip once the gain is applied, so the limiter has to
+	// catch them
+	clicks := sineAudio(48000, 2, 997, 0.1, 3)
+	for i := 0; i < len(clicks.Samples); i += 24000 {
+		clicks.Samples[i] = 30000
+	}
+	for name, audio := range map[string]*pcmAudio{"blocked.wav": quiet, "quiet.wav": quiet, "clicks.wav": clicks} {
+		var wav bytes.Buffer
+		if err := writeWAV(&wav, audio, nil); err != nil {
+			t.Fatalf("writeWAV returned an error: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tempDir, name), wav.Bytes(), 0600); err != nil {
+			t.Fatalf("Failed to write WAV: %v", err)
+		}
+	}
+
+	normalizeSpec = "-3LUFS"
+	if err := validateLoudnessOptions(); err != nil {
+		t.Fatalf("validateLoudnessOptions returned an error: %v", err)
+	}
+	// A directory in the way of the rewrite makes the first file fail, which
+	// mustn't stop the others
+	if err := os.MkdirAll(filepath.Join(tempDir, "blocked.wav.tmp", "x"), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	files := []outputFile{{Name: "blocked.wav", SHA256: "blocked"}, {Name: "quiet.wav", SHA256: "quiet"}, {Name: "clicks.wav", SHA256: "clicks"}}
+	if err := analyzeOutputFiles(tempDir, files); err == nil {
+		t.Errorf("Expected an error for the file that couldn't be rewritten")
+	}
+	if blocked := files[0]; blocked.SHA256 != "blocked" || blocked.DecodedSHA256 != "" || blocked.Loudness == nil || blocked.Loudness.Gain != 0 {
+		t.Errorf("Expected the blocked file to keep its hash and record no gain, got %+v", blocked)
+	}
+	files = files[1:]
+
+	for _, file := range files {
+		if file.Loudness == nil || file.DecodedSHA256 == "" || file.SHA256 == file.DecodedSHA256 {
+			t.Fatalf("Expected the measurement and both hashes for %s, got %+v", file.Name, file)
+		}
+		audio, _, err := readWAVFile(filepath.Join(tempDir, file.Name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file.Name, err)
+		}
+		info, _, _ := analyzeLoudness(audio)
+		if info.TruePeak > truePeakCeiling+0.1 {
+			t.Errorf("%s: expected the true peak to stay below %.1f dBTP, got %.2f", file.Name, truePeakCeiling, info.TruePeak)
+		}
+		if math.Abs(file.Loudness.Gain-17) > 0.2 {
+			t.Errorf("%s: expected a gain of about 17 dB, got %.2f", file.Name, file.Loudness.Gain)
+		}
+	}
+	if files[0].Loudness.Integrated != -20 {
+		t.Errorf("Expected the manifest to record the loudness as decoded, got %.2f", files[0].Loudness.Integrated)
+	}
+}
+
+func TestNormalizeConvertedFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalSpec, originalTarget, originalCeiling := normalizeSpec, normalizeTarget, truePeakCeiling
+	originalRate, originalChannels, originalDepth := targetSampleRate, targetChannels, targetBitDepth
+	defer func() {
+		normalizeSpec, normalizeTarget, truePeakCeiling = originalSpec, originalTarget, originalCeiling
+		targetSampleRate, targetChannels, targetBitDepth = originalRate, originalChannels, originalDepth
+	}()
+
+	// Left and right in phase, so the mono mix is louder than either channel
+	var wav bytes.Buffer
+	if err := writeWAV(&wav, sineAudio(48000, 2, 997, 0.3, 3), nil); err != nil {
+		t.Fatalf("writeWAV returned an error: %v", err)
+	}
+	for _, depth := range []string{"16", depthFloat} {
+		if err := os.WriteFile(filepath.Join(tempDir, "music.wav"), wav.Bytes(), 0600); err != nil {
+			t.Fatalf("Failed to write WAV: %v", err)
+		}
+		targetSampleRate, targetChannels, targetBitDepth = 44100, 1, depth
+		normalizeSpec = "-14LUFS"
+		if err := validateLoudnessOptions(); err != nil {
+			t.Fatalf("validateLoudnessOptions returned an error: %v", err)
+		}
+
+		// The order postProcessBank uses: convert first, then normalise
+		files := []outputFile{{Subsong: 1, Name: "music.wav", SHA256: "decoded"}}
+		if err := convertOutputFiles(bankResult{}, tempDir, files); err != nil {
+			t.Fatalf("convertOutputFiles returned an error: %v", err)
+		}
+		if err := analyzeOutputFiles(tempDir, files); err != nil {
+			t.Fatalf("analyzeOutputFiles returned an error: %v", err)
+		}
+
+		audio, _, err := readWAVFile(filepath.Join(tempDir, "music.wav"))
+		if err != nil {
+			t.Fatalf("Failed to read the output: %v", err)
+		}
+		if audio.Channels != 1 || audio.SampleRate != 44100 || (depth == depthFloat) != (audio.Float != nil) {
+			t.Fatalf("%s: expected converted audio, got %d Hz, %d channels, %d bits", depth, audio.SampleRate, audio.Channels, audio.BitsPerSample)
+		}
+		info, _, _ := analyzeLoudness(audio)
+		if math.Abs(info.Integrated-*normalizeTarget) > 0.2 {
+			t.Errorf("%s: expected the shipped file at %.1f LUFS, got %.2f", depth, *normalizeTarget, info.Integrated)
+		}
+		if info.TruePeak > truePeakCeiling+0.1 {
+			t.Errorf("%s: expected the true peak to stay below %.1f dBTP, got %.2f", depth, truePeakCeiling, info.TruePeak)
+		}
+		if files[0].DecodedSHA256 != "decoded" || files[0].Format == nil {
+			t.Errorf("%s: expected the decoded hash and format to be kept, got %+v", depth, files[0])
+		}
+	}
+}
+
+func TestValidateLoudnessOptions(t *testing.T) {
+	originalSpec, originalPeak, originalTarget, originalCeiling := normalizeSpec, truePeakSpec, normalizeTarget, truePeakCeiling
+	defer func() {
+		normalizeSpec, truePeakSpec, normalizeTarget, truePeakCeiling = originalSpec, originalPeak, originalTarget, originalCeiling
+	}()
+
+	normalizeSpec, truePeakSpec = "-23lufs", "-2 dBTP"
+	if err := validateLoudnessOptions(); err != nil {
+		t.Fatalf("validateLoudnessOptions returned an error: %v", err)
+	}
+	if normalizeTarget == nil || *normalizeTarget != -23 || truePeakCeiling != -2 {
+		t.Errorf("Expected -23 LUFS and -2 dBTP, got %v and %v", normalizeTarget, truePeakCeiling)
+	}
+
+	for _, invalid := range [][2]string{{"loud", "-1"}, {"5LUFS", "-1"}, {"-16", "1dBTP"}, {"-16", "NaN"}} {
+		normalizeSpec, truePeakSpec = invalid[0], invalid[1]
+		if err := validateLoudnessOptions(); err == nil {
+			t.Errorf("Expected an error for --normalize %s --true-peak %s", invalid[0], invalid[1])
+		}
+	}
+}
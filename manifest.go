@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// manifestFileName is written into every bank directory next to the extracted audio
+const manifestFileName = "manifest.json"
+
+// bankResult holds everything we learned while extracting a single bank
+type bankResult struct {
+	BankFile    string           `json:"bankFile"`
+	Category    string           `json:"category"`
+	Tags        areaTags         `json:"tags"`
+	OutputDir   string           `json:"outputDir"`
+	StreamCount int              `json:"streamCount"`
+	Selected    []int            `json:"selected,omitempty"`
+	Filtered    []int            `json:"filtered,omitempty"`
+	Streams     []streamInfo     `json:"streams,omitempty"`
+	Extracted   int              `json:"extracted"`
+	Files       []outputFile     `json:"files,omitempty"`
+	Failed      []subsongFailure `json:"failed,omitempty"`
+	Mismatch    bool             `json:"mismatch,omitempty"`
+	Silent      []int            `json:"silent,omitempty"`
+	Skipped     bool             `json:"-"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// wantedSubsongs returns the subsongs to extract when a selection or the
+// filters leave some out, or nil to extract the whole bank
+func (r bankResult) wantedSubsongs() []int {
+	if r.Selected == nil && len(r.Filtered) == 0 {
+		return nil
+	}
+	subsongs := r.Selected
+	if subsongs == nil {
+		for _, stream := range r.Streams {
+			subsongs = append(subsongs, stream.Index)
+		}
+	}
+
+	filtered := make(map[int]bool, len(r.Filtered))
+	for _, subsong := range r.Filtered {
+		filtered[subsong] = true
+	}
+	wanted := []int{}
+	for _, subsong := range subsongs {
+		if !filtered[subsong] {
+			wanted = append(wanted, subsong)
+		}
+	}
+	return wanted
+}
+
+// expectedCount is the number of files the bank should produce: its stream
+// count, or the number of subsongs left by the selection and filters
+func (r bankResult) expectedCount() int {
+	if wanted := r.wantedSubsongs(); wanted != nil {
+		return len(wanted)
+	}
+	return r.StreamCount
+}
+
+// subsongFailure records a subsong that could not be extracted and why
+type subsongFailure struct {
+	Subsong int    `json:"subsong"`
+	Name    string `json:"name,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// writeBankManifest stores the bank result as JSON in dir
+func writeBankManifest(result bankResult, dir string) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, manifestFileName), data, 0600)
+}
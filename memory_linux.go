@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// availableMemory returns the memory available for new work in bytes, as
+// reported by the MemAvailable line of /proc/meminfo
+func availableMemory() (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fileLogger.Printf("Error closing file: %v", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "MemAvailable:") {
+			continue
+		}
+		var kb uint64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(line, "MemAvailable:"), "%d", &kb); err != nil {
+			return 0, fmt.Errorf("failed to parse %q: %v", line, err)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
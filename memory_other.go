@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+)
+
+// availableMemory returns an error on platforms where we don't query memory
+func availableMemory() (uint64, error) {
+	return 0, fmt.Errorf("available memory detection is not supported on this platform")
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// memoryStatusEx mirrors the Win32 MEMORYSTATUSEX structure
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// availableMemory returns the available physical memory in bytes
+func availableMemory() (uint64, error) {
+	h := syscall.MustLoadDLL("kernel32.dll")
+	c := h.MustFindProc("GlobalMemoryStatusEx")
+
+	var status memoryStatusEx
+	status.Length = uint32(unsafe.Sizeof(status))
+
+	ret, _, err := c.Call(uintptr(unsafe.Pointer(&status)))
+	if ret == 0 {
+		return 0, fmt.Errorf("GlobalMemoryStatusEx failed: %v", err)
+	}
+	return status.AvailPhys, nil
+}
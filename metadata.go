@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	gameBuild     string
+	noWAVMetadata bool
+	writeID3      bool
+)
+
+// mediaTags is the descriptive metadata embedded in output files
+type mediaTags struct {
+	Title   string
+	Album   string
+	Artist  string
+	Genre   string
+	Comment string
+	Track   int
+}
+
+// describeOutput returns the metadata of an output file: the subsong name as
+// title and the bank name as album, or the soundtrack details of a mapped
+// track, the category as genre and where the file came from as comment
+func describeOutput(result bankResult, file outputFile) mediaTags {
+	bankName := strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile))
+	tags := mediaTags{
+		Title: streamName(result, file.Subsong),
+		Album: bankName,
+		Genre: result.Category,
+		Track: file.Subsong,
+	}
+	if tags.Title == "" {
+		tags.Title = fmt.Sprintf("%s #%d", bankName, file.Subsong)
+	}
+	if track := file.Track; track != nil {
+		tags.Title = track.Title
+		if track.Album != "" {
+			tags.Album = track.Album
+		}
+		if track.Track > 0 {
+			tags.Track = track.Track
+		}
+		tags.Artist = track.Composer
+	}
+
+	if file.Stem != "" {
+		tags.Title += " (" + file.Stem + ")"
+	}
+
+	tags.Comment = fmt.Sprintf("Extracted with sky-fsbext %s", version)
+	if gameBuild != "" {
+		tags.Comment = fmt.Sprintf("Sky: Children of the Light build %s, extracted with sky-fsbext %s", gameBuild, version)
+	}
+	return tags
+}
+
+// infoChunk builds a LIST/INFO chunk, which most WAV players and editors read
+func infoChunk(tags mediaTags) wavChunk {
+	data := []byte("INFO")
+	for _, field := range []struct{ id, value string }{
+		{"INAM", tags.Title},
+		{"IPRD", tags.Album},
+		{"IART", tags.Artist},
+		{"IGNR", tags.Genre},
+		{"ICMT", tags.Comment},
+		{"ITRK", trackNumber(tags.Track)},
+		{"ISFT", "sky-fsbext " + version},
+	} {
+		if field.value != "" {
+			// INFO strings are NUL terminated
+			data = appendWAVChunk(data, wavChunk{ID: field.id, Data: append([]byte(field.value), 0)})
+		}
+	}
+	return wavChunk{ID: "LIST", Data: data}
+}
+
+// id3Chunk builds an ID3v2.4 tag in an "id3 " chunk for players that don't
+// read LIST/INFO
+func id3Chunk(tags mediaTags) wavChunk {
+	var frames []byte
+	appendFrame := func(id string, body []byte) {
+		frames = append(frames, id...)
+		frames = append(frames, syncsafe(len(body))...)
+		frames = append(frames, 0, 0)
+		frames = append(frames, body...)
+	}
+	for _, field := range []struct{ id, value string }{
+		{"TIT2", tags.Title},
+		{"TALB", tags.Album},
+		{"TPE1", tags.Artist},
+		{"TCON", tags.Genre},
+		{"TRCK", trackNumber(tags.Track)},
+		{"TSSE", "sky-fsbext " + version},
+	} {
+		if field.value != "" {
+			appendFrame(field.id, append([]byte{3}, field.value...)) // UTF-8
+		}
+	}
+	if tags.Comment != "" {
+		// Encoding, language, empty description
+		appendFrame("COMM", append([]byte{3, 'e', 'n', 'g', 0}, tags.Comment...))
+	}
+
+	data := append([]byte{'I', 'D', '3', 4, 0, 0}, syncsafe(len(frames))...)
+	return wavChunk{ID: "id3 ", Data: append(data, frames...)}
+}
+
+// syncsafe encodes a size with 7 bits per byte as ID3v2.4 requires
+func syncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+// trackNumber formats a track number, or returns "" if there is none
+func trackNumber(track int) string {
+	if track <= 0 {
+		return ""
+	}
+	return strconv.Itoa(track)
+}
+
+// writeWAVMetadata embeds the descriptive metadata into the WAV files in dir.
+// The hash of the file as decoded is kept so track mappings by hash don't
+// depend on the metadata.
+func writeWAVMetadata(result bankResult, dir string, files []outputFile) error {
+	if noWAVMetadata || outputFormat != formatWAV {
+		return nil
+	}
+	var firstErr error
+	for i := range files {
+		if !strings.EqualFold(filepath.Ext(files[i].Name), ".wav") {
+			continue
+		}
+		tags := describeOutput(result, files[i])
+		chunks := []wavChunk{infoChunk(tags)}
+		if writeID3 {
+			chunks = append(chunks, id3Chunk(tags))
+		}
+		path := filepath.Join(dir, files[i].Name)
+		if err := rewriteWAVChunks(path, chunks); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", files[i].Name, err)
+			}
+			continue
+		}
+		if err := files[i].rehash(path); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	return firstErr
+}
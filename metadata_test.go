@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDescribeOutput(t *testing.T) {
+	originalGameBuild := gameBuild
+	defer func() { gameBuild = originalGameBuild }()
+
+	result := bankResult{
+		BankFile: filepath.Join("in", "SFX_Forest.bank"),
+		Category: "SFX",
+		Streams:  []streamInfo{{Index: 4, Name: "sfx_rain"}},
+	}
+	tags := describeOutput(result, outputFile{Subsong: 4})
+	if tags.Title != "sfx_rain" || tags.Album != "SFX_Forest" || tags.Genre != "SFX" || tags.Track != 4 {
+		t.Errorf("Unexpected metadata %+v", tags)
+	}
+	if !strings.Contains(tags.Comment, version) || strings.Contains(tags.Comment, "build") {
+		t.Errorf("Expected the tool version without a game build, got %q", tags.Comment)
+	}
+
+	gameBuild = "0.27.5"
+	track := &trackInfo{Title: "Rain", Album: "Sky OST", Track: 12, Composer: "Someone"}
+	tags = describeOutput(result, outputFile{Subsong: 4, Track: track})
+	if tags.Title != "Rain" || tags.Album != "Sky OST" || tags.Track != 12 || tags.Artist != "Someone" {
+		t.Errorf("Expected the mapped track details, got %+v", tags)
+	}
+	if !strings.Contains(tags.Comment, "build 0.27.5") {
+		t.Errorf("Expected the game build in the comment, got %q", tags.Comment)
+	}
+}
+
+func TestWriteWAVMetadata(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalID3, originalNoMetadata := writeID3, noWAVMetadata
+	defer func() { writeID3, noWAVMetadata = originalID3, originalNoMetadata }()
+	writeID3 = true
+
+	var wav bytes.Buffer
+	if err := writeWAV(&wav, testAudio(8000, 1, 16, 100), nil); err != nil {
+		t.Fatalf("writeWAV returned an error: %v", err)
+	}
+	path := filepath.Join(tempDir, "00001_amb_wind.wav")
+	if err := os.WriteFile(path, wav.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write WAV: %v", err)
+	}
+	// Files that aren't valid WAV are reported but don't stop the others
+	if err := os.WriteFile(filepath.Join(tempDir, "00002_broken.wav"), []byte("RIFF"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	result := bankResult{
+		BankFile: "Ambience_Prairie.bank",
+		Category: "Other",
+		Streams:  []streamInfo{{Index: 1, Name: "amb_wind"}},
+	}
+	// The broken file comes first, so the one after it must still be tagged
+	files := []outputFile{
+		{Subsong: 2, Name: "00002_broken.wav", SHA256: "broken"},
+		{Subsong: 1, Name: "00001_amb_wind.wav", SHA256: "decoded"},
+	}
+	if err := writeWAVMetadata(result, tempDir, files); err == nil {
+		t.Errorf("Expected an error for the broken file")
+	}
+	if files[1].DecodedSHA256 != "decoded" || files[1].SHA256 == "decoded" {
+		t.Errorf("Expected the decoded hash to be kept and the file rehashed, got %+v", files[1])
+	}
+	if files[0].DecodedSHA256 != "" {
+		t.Errorf("Expected the broken file to be left alone, got %+v", files[0])
+	}
+
+	_, chunks, err := readWAVFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read WAV: %v", err)
+	}
+	if len(chunks) != 2 || chunks[0].ID != "LIST" || chunks[1].ID != "id3 " {
+		t.Fatalf("Expected LIST and id3 chunks, got %v", chunks)
+	}
+	info := string(chunks[0].Data)
+	for _, expected := range []string{"INFO", "INAM", "amb_wind\x00", "Ambience_Prairie\x00", "IGNR", "Other\x00", "ITRK", "1\x00", "ICMT"} {
+		if !strings.Contains(info, expected) {
+			t.Errorf("Expected %q in the INFO list, got %q", expected, info)
+		}
+	}
+	if id3 := chunks[1].Data; !bytes.HasPrefix(id3, []byte{'I', 'D', '3', 4, 0}) || !bytes.Contains(id3, []byte("TIT2")) {
+		t.Errorf("Expected an ID3v2.4 tag with a title, got %q", id3)
+	}
+
+	// Writing the metadata again replaces it instead of adding a second copy
+	if err := writeWAVMetadata(result, tempDir, files[1:]); err != nil {
+		t.Fatalf("writeWAVMetadata returned an error: %v", err)
+	}
+	if _, chunks, _ = readWAVFile(path); len(chunks) != 2 {
+		t.Errorf("Expected the chunks to be replaced, got %v", chunks)
+	}
+
+	noWAVMetadata = true
+	files[1].DecodedSHA256 = ""
+	if err := writeWAVMetadata(result, tempDir, files); err != nil || files[1].DecodedSHA256 != "" {
+		t.Errorf("Expected --no-wav-metadata to leave the files alone")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultNameTemplate reproduces vgmstream's "?02s_?n" naming
+	defaultNameTemplate = "{index:02}_{name}"
+
+	// maxNameLength keeps generated names well inside common filesystem limits
+	maxNameLength = 200
+)
+
+// nameTemplate is the template output files are named with, without extension
+var nameTemplate = defaultNameTemplate
+
+// nameTemplateKeys lists the placeholders available in --name-template
+var nameTemplateKeys = []string{"bank", "category", "index", "name", "channels", "rate", "duration", "realm", "season", "type", "title", "album", "track", "composer"}
+
+// windowsReservedNames can't be used as file names on Windows, with or without extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// templateFields returns the placeholder values for one output file of a bank
+func templateFields(result bankResult, file outputFile) map[string]interface{} {
+	bankName := strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile))
+	// A split stem's file name already carries its suffix, which naming adds
+	// back after the template
+	name := decodedStreamName(file.Name)
+	if file.Stem != "" {
+		name = strings.TrimSuffix(name, "_"+file.Stem)
+	}
+	fields := map[string]interface{}{
+		"bank":     bankName,
+		"category": result.Category,
+		"index":    file.Subsong,
+		"name":     name,
+		"channels": 0,
+		"rate":     0,
+		"duration": "",
+		"realm":    file.Tags.Realm,
+		"season":   file.Tags.Season,
+		"type":     file.Tags.Type,
+		"title":    "",
+		"album":    "",
+		"track":    0,
+		"composer": "",
+	}
+	if file.Track != nil {
+		fields["title"] = file.Track.Title
+		fields["album"] = file.Track.Album
+		fields["track"] = file.Track.Track
+		fields["composer"] = file.Track.Composer
+	}
+	for _, stream := range result.Streams {
+		if stream.Index != file.Subsong {
+			continue
+		}
+		if stream.Name != "" {
+			fields["name"] = stream.Name
+		}
+		fields["channels"] = stream.Channels
+		fields["rate"] = stream.SampleRate
+		fields["duration"] = stream.Duration().Round(time.Second).String()
+	}
+	if fields["name"] == "" {
+		fields["name"] = bankName
+	}
+	return fields
+}
+
+// expandTemplate replaces {key} placeholders with their values. Numeric values
+// accept a zero-padding width as in {index:03}.
+func expandTemplate(template string, fields map[string]interface{}) (string, error) {
+	var out strings.Builder
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			out.WriteString(rest)
+			return out.String(), nil
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in %q", template)
+		}
+		out.WriteString(rest[:start])
+
+		key, format, _ := strings.Cut(rest[start+1:start+end], ":")
+		value, ok := fields[key]
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder {%s} in %q", key, template)
+		}
+		if format == "" {
+			out.WriteString(fmt.Sprint(value))
+		} else {
+			number, isNumber := value.(int)
+			width, err := strconv.Atoi(format)
+			if !isNumber || err != nil || width < 0 || !strings.HasPrefix(format, "0") {
+				return "", fmt.Errorf("invalid format {%s:%s} in %q", key, format, template)
+			}
+			out.WriteString(fmt.Sprintf("%0*d", width, number))
+		}
+		rest = rest[start+end+1:]
+	}
+}
+
+// validateNameTemplate checks that a template only uses known placeholders
+func validateNameTemplate(template string, keys []string) error {
+	fields := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		fields[key] = 0
+	}
+	name, err := expandTemplate(template, fields)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("template %q produces empty names", template)
+	}
+	return nil
+}
+
+// sanitizeFileName makes name safe to use on Windows, macOS and Linux
+func sanitizeFileName(name string) string {
+	var out strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			out.WriteRune('_')
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			out.WriteRune('_')
+		default:
+			out.WriteRune(r)
+		}
+	}
+	clean := strings.TrimSpace(out.String())
+	// Windows silently drops trailing dots and spaces
+	clean = strings.TrimRight(clean, ". ")
+
+	for len(clean) > maxNameLength {
+		_, size := utf8.DecodeLastRuneInString(clean)
+		clean = clean[:len(clean)-size]
+	}
+
+	stem, _, _ := strings.Cut(clean, ".")
+	if windowsReservedNames[strings.ToUpper(stem)] {
+		clean = "_" + clean
+	}
+	if clean == "" {
+		clean = "_"
+	}
+	return clean
+}
+
+// uniqueName returns name, or name with a numeric suffix if it is already
+// taken. Names are compared case-insensitively since Windows and macOS are.
+func uniqueName(name, ext string, taken map[string]bool) string {
+	candidate := name + ext
+	for n := 2; taken[strings.ToLower(candidate)]; n++ {
+		candidate = fmt.Sprintf("%s_%d%s", name, n, ext)
+	}
+	taken[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// nameOutputFiles renames the decoded files in dir according to the name
+// template, or the title template for mapped tracks. Files are processed in subsong order so collision suffixes are
+// the same on every run.
+func nameOutputFiles(result bankResult, dir string, files []outputFile) ([]outputFile, error) {
+	sort.SliceStable(files, func(a, b int) bool {
+		return files[a].Subsong < files[b].Subsong
+	})
+
+	// Move everything out of the way first so a new name can't clash with a
+	// decoded file that hasn't been renamed yet
+	temporary := make([]string, len(files))
+	for i, file := range files {
+		temporary[i] = fmt.Sprintf(".fsbext-rename-%d.tmp", i)
+		if err := os.Rename(filepath.Join(dir, file.Name), filepath.Join(dir, temporary[i])); err != nil {
+			return files, err
+		}
+	}
+
+	taken := map[string]bool{strings.ToLower(manifestFileName): true}
+	for i := range files {
+		ext := filepath.Ext(files[i].Name)
+		template := nameTemplate
+		if files[i].Track != nil {
+			template = titleTemplate
+		}
+		name, err := expandTemplate(template, templateFields(result, files[i]))
+		if err != nil {
+			return files, err
+		}
+		if files[i].Stem != "" {
+			name += "_" + files[i].Stem
+		}
+		files[i].Name = uniqueName(sanitizeFileName(name), ext, taken)
+		if err := os.Rename(filepath.Join(dir, temporary[i]), filepath.Join(dir, files[i].Name)); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// decodedStreamName recovers the stream name vgmstream put into a file name
+// written with outputPattern
+func decodedStreamName(fileName string) string {
+	stem := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if _, name, found := strings.Cut(stem, "_"); found && subsongFromName(fileName) > 0 {
+		return name
+	}
+	return stem
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	fields := map[string]interface{}{"bank": "Music_Title", "index": 7, "name": "theme"}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{index:02}_{name}", "07_theme"},
+		{"{bank}-{index:04}", "Music_Title-0007"},
+		{"{index}", "7"},
+		{"plain", "plain"},
+	}
+	for _, test := range tests {
+		name, err := expandTemplate(test.template, fields)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.template, err)
+		} else if name != test.expected {
+			t.Errorf("Template %q: expected %q, got %q", test.template, test.expected, name)
+		}
+	}
+
+	for _, invalid := range []string{"{unknown}", "{name:02}", "{index:x}", "{index"} {
+		if _, err := expandTemplate(invalid, fields); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestValidateNameTemplate(t *testing.T) {
+	if err := validateNameTemplate(defaultNameTemplate, nameTemplateKeys); err != nil {
+		t.Errorf("Expected the default template to be valid: %v", err)
+	}
+	if err := validateNameTemplate("{category}/{rate}Hz_{channels}ch_{duration}", nameTemplateKeys); err != nil {
+		t.Errorf("Expected all placeholders to be valid: %v", err)
+	}
+	if err := validateNameTemplate("{artist}", nameTemplateKeys); err == nil {
+		t.Errorf("Expected an unknown placeholder to be rejected")
+	}
+	if err := validateNameTemplate("  ", nameTemplateKeys); err == nil {
+		t.Errorf("Expected a blank template to be rejected")
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := map[string]string{
+		"normal name":      "normal name",
+		`a<b>c:d"e/f\g|h?`: "a_b_c_d_e_f_g_h_",
+		"tab\there":        "tab_here",
+		"trailing dots...": "trailing dots",
+		"CON":              "_CON",
+		"nul.backup":       "_nul.backup",
+		"CONSOLE":          "CONSOLE",
+		"":                 "_",
+	}
+	for input, expected := range tests {
+		if got := sanitizeFileName(input); got != expected {
+			t.Errorf("sanitizeFileName(%q): expected %q, got %q", input, expected, got)
+		}
+	}
+}
+
+func TestNameOutputFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalNameTemplate := nameTemplate
+	defer func() { nameTemplate = originalNameTemplate }()
+	nameTemplate = "{bank}_{name}_{rate}"
+
+	// Subsongs 2 and 3 share a name, subsongs 1 and 4 have no metadata and 4
+	// was split into stems
+	decoded := []string{"00003_hit.wav", "00001_fallback.wav", "00002_Hit.wav", "00004_music_ch3-4.wav"}
+	var files []outputFile
+	for _, name := range decoded {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(name), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		files = append(files, outputFile{Subsong: subsongFromName(name), Name: name})
+	}
+	files[3].Channels, files[3].Stem = []int{3, 4}, "ch3-4"
+
+	result := bankResult{
+		BankFile: filepath.Join("in", "SFX_UI.bank"),
+		Streams: []streamInfo{
+			{Index: 2, Name: "hit", SampleRate: 48000},
+			{Index: 3, Name: "hit", SampleRate: 48000},
+		},
+	}
+	files, err = nameOutputFiles(result, tempDir, files)
+	if err != nil {
+		t.Fatalf("Failed to name files: %v", err)
+	}
+
+	expected := []string{"SFX_UI_fallback_0.wav", "SFX_UI_hit_48000.wav", "SFX_UI_hit_48000_2.wav", "SFX_UI_music_0_ch3-4.wav"}
+	for i, file := range files {
+		if file.Subsong != i+1 || file.Name != expected[i] {
+			t.Errorf("Expected subsong %d as %s, got %+v", i+1, expected[i], file)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, file.Name)); err != nil {
+			t.Errorf("Expected %s to exist: %v", file.Name, err)
+		}
+	}
+
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read dir: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Expected no leftover temporary files, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// stageQueueSize bounds the queues between pipeline stages so a slow stage
+// applies backpressure to the ones before it instead of buffering everything
+const stageQueueSize = 8
+
+// processBankFilesConcurrently runs the extraction as a pipeline of stages
+// connected by bounded channels:
+//
+//	discover -> validate -> decode -> post-process -> report
+//
+// Each stage has its own workers, so CPU-heavy post-processing of one bank
+// overlaps with the decoding of the next.
+func processBankFilesConcurrently(bankFiles []string, maxWorkers int) []bankResult {
+	var printMutex sync.Mutex // To synchronize console output
+
+	banks, totalSize := discoverBanks(bankFiles)
+	target := splitTarget(totalSize, maxWorkers)
+
+	discovered := make(chan string, stageQueueSize)
+	validated := make(chan *bankTask, stageQueueSize)
+	jobs := make(chan decodeJob, stageQueueSize)
+	decoded := make(chan *bankTask, stageQueueSize)
+	finished := make(chan *bankTask, stageQueueSize)
+
+	var throttle *writeThrottle
+	if throttleWrites {
+		throttle = newWriteThrottle(maxWorkers)
+	}
+
+	// Discover: feed banks largest first
+	go func() {
+		for _, bankFile := range banks {
+			discovered <- bankFile
+		}
+		close(discovered)
+	}()
+
+	// Validate: check headers and query subsong metadata. Banks that fail
+	// here, or that a resumed run already completed, skip straight to the
+	// report stage.
+	startStage(maxWorkers, func() {
+		for bankFile := range discovered {
+			// Use the mockable function variable here
+			task := prepareBankFunc(bankFile)
+			if task.result.Error != "" || task.result.Skipped {
+				finished <- task
+			} else {
+				validated <- task
+			}
+		}
+	}, func() { close(validated) })
+
+	// Split every bank into decode jobs as it arrives
+	go func() {
+		for task := range validated {
+			for _, job := range planBankJobs(task, target) {
+				jobs <- job
+			}
+		}
+		close(jobs)
+	}()
+
+	// Decode: a bank moves on once the last of its jobs is done
+	startStage(maxWorkers, func() {
+		for job := range jobs {
+			throttle.acquire()
+			err := decodeJobFunc(job)
+			throttle.release(job.outputBytes())
+			if job.task.jobDone(err) {
+				decoded <- job.task
+			}
+		}
+	}, func() { close(decoded) })
+
+	// Post-process: verify and hash the outputs and write the manifest. The
+	// validate stage has always finished by the time this stage drains, so it
+	// is safe to close the report queue here.
+	startStage(maxWorkers, func() {
+		for task := range decoded {
+			postProcessBank(task)
+			finished <- task
+		}
+	}, func() { close(finished) })
+
+	// Report: print one status line per bank as it completes
+	var results []bankResult
+	for task := range finished {
+		reportBank(task, &printMutex)
+		results = append(results, task.result)
+	}
+
+	// Return the results in input order regardless of completion order
+	order := make(map[string]int, len(bankFiles))
+	for i, bankFile := range bankFiles {
+		order[bankFile] = i
+	}
+	sort.SliceStable(results, func(a, b int) bool {
+		return order[results[a].BankFile] < order[results[b].BankFile]
+	})
+	return results
+}
+
+// startStage runs fn on the given number of goroutines and calls done once all of them return
+func startStage(workers int, fn func(), done func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		done()
+	}()
+}
+
+// discoverBanks orders the banks largest first and returns their total size.
+// Banks that can't be stat'ed keep their place at the end and are reported
+// by the validate stage.
+func discoverBanks(bankFiles []string) ([]string, int64) {
+	sizes := make(map[string]int64, len(bankFiles))
+	var total int64
+	for _, bankFile := range bankFiles {
+		if info, err := os.Stat(bankFile); err == nil {
+			sizes[bankFile] = info.Size()
+			total += info.Size()
+		}
+	}
+
+	banks := append([]string(nil), bankFiles...)
+	sort.SliceStable(banks, func(a, b int) bool {
+		return sizes[banks[a]] > sizes[banks[b]]
+	})
+	return banks, total
+}
+
+// reportBank prints the bank's status line
+func reportBank(task *bankTask, printMutex *sync.Mutex) {
+	result := task.result
+	message := fmt.Sprintf("Processing file: %s", result.BankFile)
+	switch {
+	case result.Error != "":
+		message += ": FAIL\n"
+	case result.Skipped && result.Extracted == 0 && len(result.Filtered) > 0:
+		message += ": SKIP (all subsongs filtered out)\n"
+	case result.Skipped:
+		message += fmt.Sprintf(": SKIP (%d files extracted by a previous run)\n", result.Extracted)
+	case len(result.Failed) > 0:
+		message += fmt.Sprintf(": PARTIAL (%d of %d streams extracted, %s failed)\n",
+			result.Extracted, result.expectedCount(), failedSubsongs(result.Failed))
+	case result.Mismatch:
+		message += fmt.Sprintf(": WARN (%d of %d streams extracted)\n", result.Extracted, result.expectedCount())
+	default:
+		message += fmt.Sprintf(": OK (%d files extracted)\n", result.Extracted)
+	}
+	if len(result.Silent) > 0 && result.Error == "" {
+		action := "flagged"
+		if dropSilent {
+			action = "dropped"
+		}
+		message += fmt.Sprintf("  %d silent subsong(s) %s: %s\n", len(result.Silent), action, joinSubsongs(result.Silent))
+	}
+	// Print the message
+	safePrintf(printMutex, message)
+}
+
+// failedSubsongs formats the failed subsong indices for the status line
+func failedSubsongs(failures []subsongFailure) string {
+	indices := make([]int, len(failures))
+	for i, failure := range failures {
+		indices[i] = failure.Subsong
+	}
+	return "subsong " + joinSubsongs(indices)
+}
+
+// joinSubsongs formats subsong indices as a comma-separated list
+func joinSubsongs(subsongs []int) string {
+	indices := make([]string, len(subsongs))
+	for i, subsong := range subsongs {
+		indices[i] = fmt.Sprint(subsong)
+	}
+	return strings.Join(indices, ", ")
+}
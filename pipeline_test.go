@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDiscoverBanks(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	sizes := map[string]int{"a.bank": 10, "b.bank": 300, "c.bank": 20}
+	var bankFiles []string
+	for name, size := range sizes {
+		path := filepath.Join(tempDir, name)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		bankFiles = append(bankFiles, path)
+	}
+	missing := filepath.Join(tempDir, "missing.bank")
+	bankFiles = append([]string{missing}, bankFiles...)
+
+	banks, total := discoverBanks(bankFiles)
+	if total != 330 {
+		t.Errorf("Expected total size 330, got %d", total)
+	}
+	expected := []string{"b.bank", "c.bank", "a.bank", "missing.bank"}
+	for i, bank := range banks {
+		if filepath.Base(bank) != expected[i] {
+			t.Errorf("Position %d: expected %s, got %s", i, expected[i], filepath.Base(bank))
+		}
+	}
+}
+
+func TestStartStage(t *testing.T) {
+	queue := make(chan int)
+	var processed int64
+	done := make(chan struct{})
+
+	startStage(3, func() {
+		for n := range queue {
+			atomic.AddInt64(&processed, int64(n))
+		}
+	}, func() { close(done) })
+
+	for i := 1; i <= 10; i++ {
+		queue <- i
+	}
+	close(queue)
+	<-done
+
+	if processed != 55 {
+		t.Errorf("Expected every item to be processed once, got sum %d", processed)
+	}
+}
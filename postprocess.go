@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outputFile describes one extracted audio file in the bank manifest
+type outputFile struct {
+	Subsong       int           `json:"subsong,omitempty"`
+	Dir           string        `json:"dir"`
+	Name          string        `json:"name"`
+	Size          int64         `json:"size"`
+	SHA256        string        `json:"sha256"`
+	DecodedSHA256 string        `json:"decodedSha256,omitempty"` // hash of the file as decoded, if it was changed after
+	Tags          areaTags      `json:"tags"`
+	Track         *trackInfo    `json:"track,omitempty"`
+	Loudness      *loudnessInfo `json:"loudness,omitempty"`
+	Silent        bool          `json:"silent,omitempty"`
+	TrimmedStart  int64         `json:"trimmedStart,omitempty"`
+	TrimmedEnd    int64         `json:"trimmedEnd,omitempty"`
+	Format        *audioFormat  `json:"format,omitempty"`
+	Channels      []int         `json:"channels,omitempty"` // channels of the subsong in a split stem
+	Stem          string        `json:"stem,omitempty"`     // suffix naming the stem, e.g. ch3-4
+	Waveform      string        `json:"waveform,omitempty"` // image paths below the output directory
+	Spectrogram   string        `json:"spectrogram,omitempty"`
+
+	images []renderedImage
+}
+
+// decodedHash returns the hash of the file as decoded, which stays the same
+// whatever the post-processing wrote into it after
+func (f outputFile) decodedHash() string {
+	if f.DecodedSHA256 != "" {
+		return f.DecodedSHA256
+	}
+	return f.SHA256
+}
+
+// rehash updates the hash and size after a post-processing step rewrote the
+// file at path. The hash of the file as decoded is kept the first time, so
+// track mappings and diffs still match the audio whatever was written after.
+func (f *outputFile) rehash(path string) error {
+	sum, size, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	f.DecodedSHA256 = f.decodedHash()
+	f.SHA256, f.Size = sum, size
+	return nil
+}
+
+// postProcessBank checks what the decode stage wrote, hashes every output
+// file, writes the bank manifest and moves the bank into place
+func postProcessBank(task *bankTask) {
+	result := &task.result
+	dir := task.workDir()
+
+	for _, err := range task.errs {
+		fileLogger.Printf("%v\n", err)
+	}
+
+	extractedCount, err := countFilesInDir(dir)
+	if err != nil {
+		task.fail("Error counting files in %s: %v\n", dir, err)
+		discardStaging(task)
+		return
+	} else if extractedCount == 0 {
+		if len(task.errs) > 0 {
+			task.fail("Failed to extract %s: %v\n", result.BankFile, task.errs[0])
+		} else {
+			task.fail("No files were extracted to %s\n", result.OutputDir)
+		}
+		discardStaging(task)
+		return
+	}
+	result.Extracted = extractedCount
+	sort.Slice(result.Failed, func(a, b int) bool {
+		return result.Failed[a].Subsong < result.Failed[b].Subsong
+	})
+	result.Mismatch = result.expectedCount() > 0 && extractedCount != result.expectedCount()
+
+	files, err := collectOutputFiles(dir)
+	if err != nil {
+		task.fail("Error listing files in %s: %v\n", dir, err)
+		discardStaging(task)
+		return
+	}
+	for i := range files {
+		files[i].Tags = tagSubsong(result.Tags, streamName(*result, files[i].Subsong))
+	}
+	// Hash straight after decoding, before any step rewrites the files, since
+	// the track mapping can identify subsongs by the hash of the decoded audio
+	if err := hashOutputFiles(dir, files); err != nil {
+		fileLogger.Printf("Failed to hash output files in %s: %v\n", dir, err)
+	}
+	mapTracks(*result, files)
+	if err := renderLoopFiles(*result, dir, files); err != nil {
+		fileLogger.Printf("Failed to render loops in %s: %v\n", dir, err)
+	}
+	if err := writeLoopPoints(*result, dir, files); err != nil {
+		fileLogger.Printf("Failed to write loop points in %s: %v\n", dir, err)
+	}
+	if files, err = checkSilence(result, dir, files); err != nil {
+		fileLogger.Printf("Failed to check %s for silence: %v\n", dir, err)
+	}
+	if files, err = splitStemFiles(dir, files); err != nil {
+		fileLogger.Printf("Failed to split stems in %s: %v\n", dir, err)
+	}
+	// Convert before measuring and normalising, so the loudness in the
+	// manifest and the true-peak ceiling hold for the files that ship
+	if err := convertOutputFiles(*result, dir, files); err != nil {
+		fileLogger.Printf("Failed to convert output files in %s: %v\n", dir, err)
+	}
+	if err := analyzeOutputFiles(dir, files); err != nil {
+		fileLogger.Printf("Failed to analyse loudness in %s: %v\n", dir, err)
+	}
+	if err := renderOutputImages(dir, files); err != nil {
+		fileLogger.Printf("Failed to render images in %s: %v\n", dir, err)
+	}
+	if err := writeWAVMetadata(*result, dir, files); err != nil {
+		fileLogger.Printf("Failed to write metadata in %s: %v\n", dir, err)
+	}
+	if err := encodeOutputFiles(*result, dir, files); err != nil {
+		task.fail("%v\n", err)
+		discardStaging(task)
+		return
+	}
+	if files, err = nameOutputFiles(*result, dir, files); err != nil {
+		task.fail("Failed to rename output files in %s: %v\n", dir, err)
+		discardStaging(task)
+		return
+	}
+	result.Files = files
+	if err := routeOutputFiles(task, files); err != nil {
+		task.fail("Failed to sort output files of %s into categories: %v\n", result.BankFile, err)
+		discardStaging(task)
+		return
+	}
+	if err := writeOutputImages(task, files); err != nil {
+		fileLogger.Printf("Failed to write images of %s: %v\n", result.BankFile, err)
+	}
+
+	if err := writeBankManifest(*result, dir); err != nil {
+		fileLogger.Printf("Failed to write manifest for %s: %v\n", result.BankFile, err)
+	}
+
+	if err := commitBank(task); err != nil {
+		task.fail("%v\n", err)
+		discardStaging(task)
+		return
+	}
+
+	// Banks with failed subsongs are left out of the journal so --resume retries
+	// them, as are banks only partly extracted by a subsong selection or the
+	// subsong filters
+	if len(result.Failed) == 0 && result.wantedSubsongs() == nil {
+		if err := runJournal.record(*result); err != nil {
+			fileLogger.Printf("Failed to record %s in the run journal: %v\n", result.BankFile, err)
+		}
+	}
+
+	if len(result.Failed) > 0 {
+		fileLogger.Printf("Extracted %d files from %s to %s, %d subsong(s) failed\n", result.Extracted, result.BankFile, result.OutputDir, len(result.Failed))
+	} else if result.Mismatch {
+		fileLogger.Printf("Extracted %d files from %s to %s, but expected %d\n", result.Extracted, result.BankFile, result.OutputDir, result.expectedCount())
+	} else {
+		fileLogger.Printf("Successfully extracted %d files from %s to %s\n", result.Extracted, result.BankFile, result.OutputDir)
+	}
+}
+
+// collectOutputFiles lists the decoded files in the bank directory
+func collectOutputFiles(dir string) ([]outputFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []outputFile
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == manifestFileName {
+			continue
+		}
+		files = append(files, outputFile{Subsong: subsongFromName(entry.Name()), Name: entry.Name()})
+	}
+	return files, nil
+}
+
+// hashOutputFiles fills in the size and SHA-256 of every output file
+func hashOutputFiles(dir string, files []outputFile) error {
+	for i := range files {
+		sum, size, err := hashFile(filepath.Join(dir, files[i].Name))
+		if err != nil {
+			return err
+		}
+		files[i].Size = size
+		files[i].SHA256 = sum
+	}
+	return nil
+}
+
+// hashFile returns the hex SHA-256 and size of a file
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fileLogger.Printf("Error closing file: %v", err)
+		}
+	}()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// subsongFromName recovers the subsong index from the "?05s_" prefix of the
+// vgmstream output pattern, or 0 if the name doesn't carry one
+func subsongFromName(name string) int {
+	prefix, _, found := strings.Cut(name, "_")
+	if !found {
+		return 0
+	}
+	index, err := strconv.Atoi(prefix)
+	if err != nil {
+		return 0
+	}
+	return index
+}
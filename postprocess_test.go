@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashOutputFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	for name, content := range map[string]string{
+		"03_mus_title.wav": "hello",
+		"plain.wav":        "",
+		manifestFileName:   "{}",
+	} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	files, err := collectOutputFiles(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to list files: %v", err)
+	}
+	if err := hashOutputFiles(tempDir, files); err != nil {
+		t.Fatalf("Failed to hash files: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 files without the manifest, got %d", len(files))
+	}
+
+	first := files[0]
+	if first.Name != "03_mus_title.wav" || first.Subsong != 3 || first.Size != 5 ||
+		first.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Unexpected output file: %+v", first)
+	}
+	if files[1].Subsong != 0 {
+		t.Errorf("Expected no subsong for a name without index, got %d", files[1].Subsong)
+	}
+}
+
+func TestRehashKeepsDecodedHash(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	path := filepath.Join(tempDir, "00001_a.wav")
+	file := outputFile{Name: "00001_a.wav", SHA256: "decoded", Size: 4}
+	for _, content := range []string{"rewritten once", "and twice"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if err := file.rehash(path); err != nil {
+			t.Fatalf("rehash returned an error: %v", err)
+		}
+		sum, size, _ := hashFile(path)
+		if file.SHA256 != sum || file.Size != size || file.DecodedSHA256 != "decoded" || file.decodedHash() != "decoded" {
+			t.Errorf("Expected the new hash and the decoded one to be kept, got %+v", file)
+		}
+	}
+	if err := file.rehash(filepath.Join(tempDir, "missing.wav")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
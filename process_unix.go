@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// processExists reports whether a process with the given PID is running
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	// Signal 0 performs the permission and existence checks without sending anything
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"log"
+
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code GetExitCodeProcess reports for a running process
+const stillActive = 259
+
+// processExists reports whether a process with the given PID is running
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	// #nosec G115 -- pid is positive
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// The process exists but belongs to someone we can't query
+		return errors.Is(err, windows.ERROR_ACCESS_DENIED)
+	}
+	defer func() {
+		if err := windows.CloseHandle(handle); err != nil {
+			log.Printf("Error closing process handle: %v", err)
+		}
+	}()
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(handle, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultRealmMap is the built-in table of Sky realms, seasons and sound types
+//
+//go:embed data/realms.json
+var defaultRealmMap []byte
+
+const (
+	// defaultLayout places every bank in a directory named after it below its category
+	defaultLayout = "{category}/{bank}"
+
+	// unknownTag fills in layout directories for tags that didn't match anything
+	unknownTag = "Unknown"
+)
+
+// areaTags describes where in Sky a bank or subsong belongs
+type areaTags struct {
+	Realm  string `json:"realm,omitempty"`
+	Season string `json:"season,omitempty"`
+	Type   string `json:"type,omitempty"`
+}
+
+// tagEntry maps names matching a pattern to a tag value
+type tagEntry struct {
+	Name  string `json:"name"`
+	Match string `json:"match"`
+
+	pattern *namePattern
+}
+
+// realmMap holds the tables used to tag bank and subsong names. Lists left
+// out of a user's --realm-map file keep their built-in entries.
+type realmMap struct {
+	Realms  []tagEntry `json:"realms"`
+	Seasons []tagEntry `json:"seasons"`
+	Types   []tagEntry `json:"types"`
+}
+
+var (
+	realmMapPath string
+	layout       = defaultLayout
+	realmTags    = mustParseRealmMap(defaultRealmMap)
+)
+
+// layoutKeys lists the placeholders available in --layout
+var layoutKeys = []string{"category", "bank", "realm", "season", "type"}
+
+// mustParseRealmMap parses the built-in table
+func mustParseRealmMap(data []byte) realmMap {
+	var tags realmMap
+	if err := json.Unmarshal(data, &tags); err != nil {
+		panic(fmt.Sprintf("invalid built-in realm map: %v", err))
+	}
+	if err := tags.compile(); err != nil {
+		panic(fmt.Sprintf("invalid built-in realm map: %v", err))
+	}
+	return tags
+}
+
+// loadRealmMap reads a user mapping file and overlays it on the built-in table
+func loadRealmMap(path string) (realmMap, error) {
+	tags := mustParseRealmMap(defaultRealmMap)
+
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return tags, err
+	}
+	var override realmMap
+	if err := json.Unmarshal(data, &override); err != nil {
+		return tags, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if err := override.compile(); err != nil {
+		return tags, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if override.Realms != nil {
+		tags.Realms = override.Realms
+	}
+	if override.Seasons != nil {
+		tags.Seasons = override.Seasons
+	}
+	if override.Types != nil {
+		tags.Types = override.Types
+	}
+	return tags, nil
+}
+
+// compile compiles the pattern of every entry
+func (m *realmMap) compile() error {
+	for _, list := range [][]tagEntry{m.Realms, m.Seasons, m.Types} {
+		for i := range list {
+			if list[i].Name == "" {
+				return fmt.Errorf("entry %q has no name", list[i].Match)
+			}
+			pattern, err := compileNamePattern(list[i].Match)
+			if err != nil {
+				return fmt.Errorf("%s: %v", list[i].Name, err)
+			}
+			list[i].pattern = pattern
+		}
+	}
+	return nil
+}
+
+// firstMatch returns the name of the first entry matching name
+func firstMatch(entries []tagEntry, name string) string {
+	if name == "" {
+		return ""
+	}
+	for _, entry := range entries {
+		if entry.pattern.match(name) {
+			return entry.Name
+		}
+	}
+	return ""
+}
+
+// tag looks up the realm, season and type of a name
+func (m realmMap) tag(name string) areaTags {
+	return areaTags{
+		Realm:  firstMatch(m.Realms, name),
+		Season: firstMatch(m.Seasons, name),
+		Type:   firstMatch(m.Types, name),
+	}
+}
+
+// tagSubsong tags a subsong by its own name, falling back to the bank's tags
+// for anything the subsong name doesn't reveal
+func tagSubsong(bank areaTags, subsongName string) areaTags {
+	tags := realmTags.tag(subsongName)
+	if tags.Realm == "" {
+		tags.Realm = bank.Realm
+	}
+	if tags.Season == "" {
+		tags.Season = bank.Season
+	}
+	if tags.Type == "" {
+		tags.Type = bank.Type
+	}
+	return tags
+}
+
+// bankTags tags a bank by its name. Banks whose name doesn't reveal a type
+// take it from their category.
+func bankTags(bankName, category string) areaTags {
+	tags := realmTags.tag(bankName)
+	if tags.Type == "" {
+		tags.Type = path.Base(category)
+	}
+	return tags
+}
+
+// validateLayout checks the layout template. It has to contain {bank} since
+// each bank's directories are replaced as a whole when it is committed.
+func validateLayout(template string) error {
+	if !strings.Contains(template, "{bank}") {
+		return fmt.Errorf("layout %q must contain {bank}", template)
+	}
+	return validateNameTemplate(template, layoutKeys)
+}
+
+// layoutDir expands the layout for a bank or subsong into a relative,
+// slash-separated directory with every level made safe as a file name
+func layoutDir(category, bankName string, tags areaTags) (string, error) {
+	orUnknown := func(value string) string {
+		if value == "" {
+			return unknownTag
+		}
+		return value
+	}
+	expanded, err := expandTemplate(layout, map[string]interface{}{
+		"category": category,
+		"bank":     bankName,
+		"realm":    orUnknown(tags.Realm),
+		"season":   orUnknown(tags.Season),
+		"type":     orUnknown(tags.Type),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var levels []string
+	for _, level := range strings.Split(filepath.ToSlash(expanded), "/") {
+		if level = strings.TrimSpace(level); level != "" && level != "." && level != ".." {
+			levels = append(levels, sanitizeFileName(level))
+		}
+	}
+	return path.Join(levels...), nil
+}
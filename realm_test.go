@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultRealmTags(t *testing.T) {
+	tests := []struct {
+		bank     string
+		category string
+		expected areaTags
+	}{
+		{"Music_Prairie_Butterfly", "Music", areaTags{Realm: "Daylight Prairie", Type: "Music"}},
+		{"SFX_Wasteland_Krill", "SFX", areaTags{Realm: "Golden Wasteland", Type: "SFX"}},
+		{"Music_Season_Abyss", "Music", areaTags{Season: "Season of Abyss", Type: "Music"}},
+		{"Misc", "Sounds/Other", areaTags{Type: "Other"}},
+	}
+	for _, test := range tests {
+		if got := bankTags(test.bank, test.category); got != test.expected {
+			t.Errorf("bankTags(%q): expected %+v, got %+v", test.bank, test.expected, got)
+		}
+	}
+
+	bank := bankTags("Music_Forest", "Music")
+	if got := tagSubsong(bank, "Vault_Theme"); got.Realm != "Vault of Knowledge" || got.Type != "Music" {
+		t.Errorf("Expected the subsong's own realm with the bank's type, got %+v", got)
+	}
+	if got := tagSubsong(bank, ""); got != bank {
+		t.Errorf("Expected an unnamed subsong to take the bank's tags, got %+v", got)
+	}
+}
+
+func TestLoadRealmMap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Failed to remove temp dir: %v", err)
+		}
+	}()
+
+	path := filepath.Join(tempDir, "realms.json")
+	content := `{"realms": [{"name": "Cave", "match": "*Cave*"}]}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write realm map: %v", err)
+	}
+	tags, err := loadRealmMap(path)
+	if err != nil {
+		t.Fatalf("loadRealmMap returned an error: %v", err)
+	}
+	if got := tags.tag("Music_Cave_Abyss"); got.Realm != "Cave" || got.Season != "Season of Abyss" {
+		t.Errorf("Expected the overridden realms with the built-in seasons, got %+v", got)
+	}
+	if got := tags.tag("Music_Prairie"); got.Realm != "" {
+		t.Errorf("Expected the built-in realms to be replaced, got %+v", got)
+	}
+
+	for _, invalid := range []string{`{"realms": [{"match": "*"}]}`, `{"types": [{"name": "X", "match": "re:("}]}`, `{`} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatalf("Failed to write realm map: %v", err)
+		}
+		if _, err := loadRealmMap(path); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestLayoutDir(t *testing.T) {
+	originalLayout := layout
+	defer func() { layout = originalLayout }()
+
+	tags := areaTags{Realm: "Isle of Dawn", Type: "Music"}
+	if dir, err := layoutDir("Music", "Music_Isle", tags); err != nil || dir != "Music/Music_Isle" {
+		t.Errorf("Expected the default layout, got %q (err %v)", dir, err)
+	}
+
+	layout = "{realm}/{season}/{type}/{bank}"
+	if dir, err := layoutDir("Music", "Music_Isle", tags); err != nil || dir != "Isle of Dawn/Unknown/Music/Music_Isle" {
+		t.Errorf("Expected a realm layout, got %q (err %v)", dir, err)
+	}
+
+	layout = "{realm}/{bank}"
+	if dir, err := layoutDir("Music", "Music_Isle", areaTags{Realm: "../A:B"}); err != nil || dir != "A_B/Music_Isle" {
+		t.Errorf("Expected a sanitised layout, got %q (err %v)", dir, err)
+	}
+
+	for _, invalid := range []string{"{realm}", "{region}/{bank}", "{bank"} {
+		if err := validateLayout(invalid); err == nil {
+			t.Errorf("Expected an error for layout %q", invalid)
+		}
+	}
+	if err := validateLayout("{realm}/{season}/{bank}"); err != nil {
+		t.Errorf("Expected a valid layout, got %v", err)
+	}
+}
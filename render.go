@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	renderLoops    int
+	renderDuration time.Duration
+	renderFade     = 10 * time.Second
+	renderSilence  time.Duration
+)
+
+// renderingLoops reports whether looping subsongs are rendered out
+func renderingLoops() bool {
+	return renderLoops > 0 || renderDuration > 0
+}
+
+// validateLoopRender checks the loop rendering options
+func validateLoopRender() error {
+	if renderLoops < 0 || renderDuration < 0 || renderFade < 0 || renderSilence < 0 {
+		return fmt.Errorf("loop counts and durations can't be negative")
+	}
+	if renderLoops > 0 && renderDuration > 0 {
+		return fmt.Errorf("--render-loops and --render-duration can't be combined")
+	}
+	return nil
+}
+
+// renderLoop plays a looping stream as its intro followed by the loop body,
+// repeated renderLoops times or up to renderDuration, fades it out and pads
+// it with silence. Only the audio up to the loop end is used, so whatever
+// the decoder did after the first loop doesn't matter.
+func renderLoop(audio *pcmAudio, stream streamInfo) (*pcmAudio, error) {
+	start, end := int(stream.LoopStart), int(stream.LoopEnd)
+	if end > audio.frames() {
+		return nil, fmt.Errorf("loop end %d is past the end of the decoded audio (%d samples)", end, audio.frames())
+	}
+	toFrames := func(d time.Duration) int {
+		return int(d * time.Duration(audio.SampleRate) / time.Second)
+	}
+
+	fade := toFrames(renderFade)
+	length := start + renderLoops*(end-start) + fade
+	if renderDuration > 0 {
+		length = toFrames(renderDuration)
+		fade = min(fade, length)
+	}
+	silence := toFrames(renderSilence)
+
+	rendered := &pcmAudio{
+		SampleRate:    audio.SampleRate,
+		Channels:      audio.Channels,
+		BitsPerSample: audio.BitsPerSample,
+		Samples:       make([]int32, (length+silence)*audio.Channels),
+	}
+	for frame := 0; frame < length; frame++ {
+		source := frame
+		if frame >= end {
+			source = start + (frame-start)%(end-start)
+		}
+		gain := 1.0
+		if fadeStart := length - fade; frame >= fadeStart {
+			gain = float64(length-frame) / float64(fade)
+		}
+		for ch := 0; ch < audio.Channels; ch++ {
+			sample := audio.Samples[source*audio.Channels+ch]
+			if gain < 1 {
+				sample = int32(math.Round(float64(sample) * gain))
+			}
+			rendered.Samples[frame*audio.Channels+ch] = sample
+		}
+	}
+	return rendered, nil
+}
+
+// renderLoopFiles renders the WAV files of looping subsongs in dir. Other
+// subsongs are left as they are.
+func renderLoopFiles(result bankResult, dir string, files []outputFile) error {
+	if !renderingLoops() {
+		return nil
+	}
+	for i := range files {
+		stream, ok := findStream(result, files[i].Subsong)
+		if !ok || !hasLoop(stream) || !strings.EqualFold(filepath.Ext(files[i].Name), ".wav") {
+			continue
+		}
+		path := filepath.Join(dir, files[i].Name)
+		audio, chunks, err := readWAVFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+		rendered, err := renderLoop(audio, stream)
+		if err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+		if err := writeWAVFile(path, rendered, chunks); err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+		if err := files[i].rehash(path); err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	return nil
+}
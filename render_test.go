@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenderLoop(t *testing.T) {
+	originalLoops, originalDuration, originalFade, originalSilence := renderLoops, renderDuration, renderFade, renderSilence
+	defer func() {
+		renderLoops, renderDuration, renderFade, renderSilence = originalLoops, originalDuration, originalFade, originalSilence
+	}()
+
+	// 1 kHz mono: intro 1, 2 and loop body 10, 20, 30, followed by the
+	// decoder's own second loop and fade, which must not be used
+	audio := &pcmAudio{SampleRate: 1000, Channels: 1, BitsPerSample: 16, Samples: []int32{1, 2, 10, 20, 30, 99, 99}}
+	stream := streamInfo{Looping: true, LoopStart: 2, LoopEnd: 5}
+
+	renderLoops, renderFade, renderSilence = 2, 3*time.Millisecond, 2*time.Millisecond
+	rendered, err := renderLoop(audio, stream)
+	if err != nil {
+		t.Fatalf("renderLoop returned an error: %v", err)
+	}
+	expected := []int32{1, 2, 10, 20, 30, 10, 20, 30, 10, 13, 10, 0, 0}
+	if !equalSamples(rendered.Samples, expected) {
+		t.Errorf("Expected %v, got %v", expected, rendered.Samples)
+	}
+
+	renderLoops, renderDuration, renderFade, renderSilence = 0, 6*time.Millisecond, 0, 0
+	if rendered, err = renderLoop(audio, stream); err != nil {
+		t.Fatalf("renderLoop returned an error: %v", err)
+	}
+	expected = []int32{1, 2, 10, 20, 30, 10}
+	if !equalSamples(rendered.Samples, expected) {
+		t.Errorf("Expected the loop to be cut at the target duration, got %v", rendered.Samples)
+	}
+
+	stream.LoopEnd = 8
+	if _, err := renderLoop(audio, stream); err == nil {
+		t.Errorf("Expected an error for a loop end past the decoded audio")
+	}
+}
+
+func equalSamples(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRenderLoopFiles(t *testing.T) {
+	originalLoops, originalDuration, originalFade, originalSilence := renderLoops, renderDuration, renderFade, renderSilence
+	defer func() {
+		renderLoops, renderDuration, renderFade, renderSilence = originalLoops, originalDuration, originalFade, originalSilence
+	}()
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	audio := testAudio(8000, 2, 16, 4000)
+	var wav bytes.Buffer
+	if err := writeWAV(&wav, audio, nil); err != nil {
+		t.Fatalf("writeWAV returned an error: %v", err)
+	}
+	for _, name := range []string{"00001_loop.wav", "00002_once.wav"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), wav.Bytes(), 0600); err != nil {
+			t.Fatalf("Failed to write WAV: %v", err)
+		}
+	}
+
+	renderLoops, renderFade, renderSilence = 3, time.Second, 0
+	result := bankResult{Streams: []streamInfo{
+		{Index: 1, SampleRate: 8000, Looping: true, LoopStart: 1000, LoopEnd: 3000},
+		{Index: 2, SampleRate: 8000},
+	}}
+	files := []outputFile{{Subsong: 1, Name: "00001_loop.wav"}, {Subsong: 2, Name: "00002_once.wav"}}
+	if err := renderLoopFiles(result, tempDir, files); err != nil {
+		t.Fatalf("renderLoopFiles returned an error: %v", err)
+	}
+	if err := writeLoopPoints(result, tempDir, files); err != nil {
+		t.Fatalf("writeLoopPoints returned an error: %v", err)
+	}
+
+	rendered, chunks, err := readWAVFile(filepath.Join(tempDir, "00001_loop.wav"))
+	if err != nil {
+		t.Fatalf("Failed to read the rendered WAV: %v", err)
+	}
+	if frames := rendered.frames(); frames != 1000+3*2000+8000 {
+		t.Errorf("Expected the intro, three loops and the fade, got %d samples", frames)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("Expected no loop points in a rendered loop, got %v", chunks)
+	}
+	unchanged, err := os.ReadFile(filepath.Join(tempDir, "00002_once.wav"))
+	if err != nil {
+		t.Fatalf("Failed to read WAV: %v", err)
+	}
+	if !bytes.Equal(unchanged, wav.Bytes()) {
+		t.Errorf("Expected the non-looping subsong to be passed through")
+	}
+}
+
+func TestValidateLoopRender(t *testing.T) {
+	originalLoops, originalDuration, originalFade, originalSilence := renderLoops, renderDuration, renderFade, renderSilence
+	defer func() {
+		renderLoops, renderDuration, renderFade, renderSilence = originalLoops, originalDuration, originalFade, originalSilence
+	}()
+
+	renderLoops, renderDuration = 2, 0
+	if err := validateLoopRender(); err != nil {
+		t.Errorf("Expected a loop count to be valid: %v", err)
+	}
+	renderDuration = time.Minute
+	if err := validateLoopRender(); err == nil {
+		t.Errorf("Expected an error for both a loop count and a duration")
+	}
+	renderLoops, renderFade = 0, -time.Second
+	if err := validateLoopRender(); err == nil {
+		t.Errorf("Expected an error for a negative fade")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// reportDirName is the directory below the output directory that holds
+	// the HTML report
+	reportDirName = "report"
+
+	thumbnailWidth  = 240
+	thumbnailHeight = 48
+)
+
+var htmlReport bool
+
+// htmlFile is a subsong as the report's bank page lists it
+type htmlFile struct {
+	Anchor    string
+	Subsong   int
+	Name      string
+	Title     string
+	Duration  string
+	Loop      string
+	Loudness  string
+	Size      string
+	Silent    bool
+	Audio     string
+	Thumbnail string
+}
+
+// htmlBank is a bank page of the report
+type htmlBank struct {
+	Name     string
+	Category string
+	Page     string
+	Streams  int
+	Files    []htmlFile
+	Failed   []subsongFailure
+	Error    string
+}
+
+// htmlCategory groups the banks on the index page
+type htmlCategory struct {
+	Name  string
+	Banks []*htmlBank
+}
+
+// searchEntry is one subsong in the index page's search data
+type searchEntry struct {
+	Bank     string `json:"bank"`
+	Category string `json:"category"`
+	Title    string `json:"title"`
+	Name     string `json:"name"`
+	Href     string `json:"href"`
+}
+
+// reportHref returns a link from a report page to a path below the output
+// directory, escaped for use in a URL
+func reportHref(prefix, rel string) string {
+	return prefix + (&url.URL{Path: rel}).EscapedPath()
+}
+
+// formatPosition formats a sample position as a time
+func formatPosition(samples int64, rate int) string {
+	if rate <= 0 {
+		return fmt.Sprintf("%d", samples)
+	}
+	return (time.Duration(samples) * time.Second / time.Duration(rate)).Round(time.Millisecond).String()
+}
+
+// writeThumbnail renders a small waveform of a WAV file for the report and
+// returns its path below the output directory
+func writeThumbnail(root, audioPath, rel string) (string, error) {
+	audio, _, err := readWAVFile(audioPath)
+	if err != nil {
+		return "", err
+	}
+	colormap, ok := colormaps[colormapName]
+	if !ok {
+		colormap = colormaps["magma"]
+	}
+	data, err := encodePNG(drawWaveform(audio, thumbnailWidth, thumbnailHeight, colormap))
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return "", err
+	}
+	return rel, os.WriteFile(target, data, 0600)
+}
+
+// buildReportBank collects what a bank page shows from the bank's manifest.
+// Files without a rendered waveform get a thumbnail if they are WAV.
+func buildReportBank(root, manifestDir string, result bankResult, page string) *htmlBank {
+	bank := &htmlBank{
+		Name:     strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile)),
+		Category: result.Category,
+		Page:     page,
+		Streams:  result.StreamCount,
+		Failed:   result.Failed,
+		Error:    result.Error,
+	}
+	if bank.Category == "" {
+		bank.Category = "Other"
+	}
+
+	bankDir, err := filepath.Rel(root, manifestDir)
+	if err != nil {
+		bankDir = manifestDir
+	}
+	for i, file := range result.Files {
+		dir := filepath.ToSlash(bankDir)
+		if file.Dir != "" {
+			dir = file.Dir
+		}
+		rel := path.Join(dir, file.Name)
+		entry := htmlFile{
+			Anchor:  fmt.Sprintf("file-%d", i+1),
+			Subsong: file.Subsong,
+			Name:    file.Name,
+			Title:   describeOutput(result, file).Title,
+			Size:    formatSize(file.Size),
+			Silent:  file.Silent,
+			Audio:   reportHref("../../", rel),
+		}
+		if stream, ok := findStream(result, file.Subsong); ok {
+			samples := stream.Samples - file.TrimmedStart - file.TrimmedEnd
+			entry.Duration = formatPosition(samples, stream.SampleRate)
+			if hasLoop(stream) {
+				entry.Loop = formatPosition(stream.LoopStart, stream.SampleRate) + " – " + formatPosition(stream.LoopEnd, stream.SampleRate)
+			}
+		}
+		if file.Loudness != nil {
+			entry.Loudness = fmt.Sprintf("%.1f LUFS", file.Loudness.Integrated)
+		}
+
+		thumbnail := file.Waveform
+		if thumbnail == "" && strings.EqualFold(filepath.Ext(file.Name), ".wav") {
+			name := strings.TrimSuffix(page, ".html") + "_" + strings.TrimSuffix(file.Name, filepath.Ext(file.Name)) + ".png"
+			var err error
+			thumbnail, err = writeThumbnail(root, filepath.Join(root, filepath.FromSlash(rel)), path.Join(reportDirName, "thumbnails", name))
+			if err != nil {
+				fileLogger.Printf("Failed to render a thumbnail of %s: %v\n", rel, err)
+				thumbnail = ""
+			}
+		}
+		if thumbnail != "" {
+			entry.Thumbnail = reportHref("../../", thumbnail)
+		}
+		bank.Files = append(bank.Files, entry)
+	}
+	return bank
+}
+
+// writeHTMLReport writes a static site browsing the banks of the output
+// directory into its report directory: an index of the banks by category
+// with a search over every subsong, and a page per bank with players
+func writeHTMLReport(root string) error {
+	manifestDirs, results, err := loadManifests(root)
+	if err != nil {
+		return err
+	}
+	reportDir := filepath.Join(root, reportDirName)
+	if err := os.RemoveAll(reportDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(reportDir, "banks"), 0750); err != nil {
+		return err
+	}
+
+	categories := make(map[string]*htmlCategory)
+	var search []searchEntry
+	taken := make(map[string]bool)
+	for _, result := range results {
+		name := strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile))
+		page := uniqueName(sanitizeFileName(name), ".html", taken)
+		taken[strings.ToLower(page)] = true
+		bank := buildReportBank(root, manifestDirs[result.BankFile], result, page)
+
+		category := categories[bank.Category]
+		if category == nil {
+			category = &htmlCategory{Name: bank.Category}
+			categories[bank.Category] = category
+		}
+		category.Banks = append(category.Banks, bank)
+		for _, file := range bank.Files {
+			search = append(search, searchEntry{
+				Bank:     bank.Name,
+				Category: bank.Category,
+				Title:    file.Title,
+				Name:     file.Name,
+				Href:     reportHref("banks/", page) + "#" + file.Anchor,
+			})
+		}
+
+		if err := writeReportPage(filepath.Join(reportDir, "banks", page), "bank", bank); err != nil {
+			return err
+		}
+	}
+
+	index := struct {
+		Categories []*htmlCategory
+		Banks      int
+		Files      int
+		Generated  string
+		Version    string
+		Search     []searchEntry
+	}{Banks: len(results), Files: len(search), Generated: time.Now().Format(time.RFC1123), Version: version, Search: search}
+	for _, category := range categories {
+		index.Categories = append(index.Categories, category)
+	}
+	sort.Slice(index.Categories, func(a, b int) bool {
+		return index.Categories[a].Name < index.Categories[b].Name
+	})
+	return writeReportPage(filepath.Join(reportDir, "index.html"), "index", index)
+}
+
+// writeReportPage renders one page of the report
+func writeReportPage(target, name string, data interface{}) error {
+	file, err := os.OpenFile(filepath.Clean(target), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := reportTemplates.ExecuteTemplate(file, name, data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// reportTemplates are the pages of the HTML report. They only link to the
+// audio and images, so the report works straight from the disk.
+var reportTemplates = template.Must(template.New("report").Funcs(template.FuncMap{
+	"href": reportHref,
+}).Parse(`
+{{define "style"}}<style>
+body { font-family: system-ui, sans-serif; margin: 2em auto; max-width: 72em; padding: 0 1em; color: #222; }
+h1 a { color: inherit; text-decoration: none; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.4em 0.6em; border-bottom: 1px solid #ddd; vertical-align: middle; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+img.wave { display: block; width: 240px; height: 48px; }
+audio { width: 16em; }
+#search { font-size: 1.1em; width: 100%; padding: 0.4em; box-sizing: border-box; }
+#results li { margin: 0.2em 0; }
+.muted { color: #777; }
+.badge { font-size: 0.8em; padding: 0 0.4em; border-radius: 0.3em; background: #eee; }
+:target { background: #fff6d5; }
+</style>{{end}}
+
+{{define "index"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>sky-fsbext report</title>
+{{template "style"}}
+</head>
+<body>
+<h1>sky-fsbext report</h1>
+<p class="muted">{{.Banks}} bank(s), {{.Files}} file(s). Generated {{.Generated}} by sky-fsbext {{.Version}}.</p>
+<input id="search" type="search" placeholder="Search subsongs by title, file or bank" autofocus>
+<ul id="results"></ul>
+{{range .Categories}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>Bank</th><th class="num">Streams</th><th class="num">Files</th><th>Problems</th></tr>
+{{range .Banks}}<tr>
+<td><a href="{{href "banks/" .Page}}">{{.Name}}</a></td>
+<td class="num">{{.Streams}}</td>
+<td class="num">{{len .Files}}</td>
+<td>{{if .Error}}{{.Error}}{{else if .Failed}}{{len .Failed}} subsong(s) failed{{end}}</td>
+</tr>{{end}}
+</table>
+{{end}}
+<script type="application/json" id="search-index">{{.Search}}</script>
+<script>
+const entries = JSON.parse(document.getElementById("search-index").textContent) || [];
+const search = document.getElementById("search");
+const results = document.getElementById("results");
+search.addEventListener("input", () => {
+  const terms = search.value.toLowerCase().split(/\s+/).filter(Boolean);
+  results.replaceChildren();
+  if (terms.length === 0) {
+    return;
+  }
+  const matches = entries.filter(entry => {
+    const text = (entry.title + " " + entry.name + " " + entry.bank + " " + entry.category).toLowerCase();
+    return terms.every(term => text.includes(term));
+  });
+  for (const entry of matches.slice(0, 200)) {
+    const item = document.createElement("li");
+    const link = document.createElement("a");
+    link.href = entry.href;
+    link.textContent = entry.title;
+    item.append(link, " ", Object.assign(document.createElement("span"), {className: "muted", textContent: entry.bank + " / " + entry.name}));
+    results.append(item);
+  }
+  if (matches.length > 200) {
+    results.append(Object.assign(document.createElement("li"), {className: "muted", textContent: (matches.length - 200) + " more"}));
+  }
+});
+</script>
+</body>
+</html>
+{{end}}
+
+{{define "bank"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} - sky-fsbext report</title>
+{{template "style"}}
+</head>
+<body>
+<h1><a href="../index.html">sky-fsbext report</a> / {{.Name}}</h1>
+<p class="muted">{{.Category}}, {{.Streams}} stream(s), {{len .Files}} file(s)</p>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<table>
+<tr><th class="num">#</th><th>Title</th><th>Waveform</th><th class="num">Duration</th><th>Loop</th><th class="num">Loudness</th><th class="num">Size</th><th>Play</th></tr>
+{{range .Files}}<tr id="{{.Anchor}}">
+<td class="num">{{.Subsong}}</td>
+<td>{{.Title}}{{if .Silent}} <span class="badge">silent</span>{{end}}<br><span class="muted">{{.Name}}</span></td>
+<td>{{if .Thumbnail}}<img class="wave" src="{{.Thumbnail}}" alt="Waveform of {{.Title}}" loading="lazy">{{end}}</td>
+<td class="num">{{.Duration}}</td>
+<td>{{.Loop}}</td>
+<td class="num">{{.Loudness}}</td>
+<td class="num">{{.Size}}</td>
+<td><audio controls preload="none" src="{{.Audio}}"></audio></td>
+</tr>{{end}}
+</table>
+{{if .Failed}}<h2>Failed subsongs</h2>
+<ul>{{range .Failed}}<li>{{.Subsong}} {{.Name}}: {{.Reason}}</li>{{end}}</ul>{{end}}
+</body>
+</html>
+{{end}}
+`))
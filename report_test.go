@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteHTMLReport(t *testing.T) {
+	dir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("Failed to remove temp directory: %v", err)
+		}
+	}()
+
+	bankDir := filepath.Join(dir, "Music", "Music_Bank")
+	if err := os.MkdirAll(bankDir, 0750); err != nil {
+		t.Fatalf("Failed to create bank directory: %v", err)
+	}
+	if err := writeWAVFile(filepath.Join(bankDir, "00001_Day #1.wav"), sineAudio(8000, 1, 440, 0.5, 0.5), nil); err != nil {
+		t.Fatalf("Failed to write WAV: %v", err)
+	}
+	result := bankResult{
+		BankFile:    "Music_Bank.bank",
+		Category:    "Music",
+		OutputDir:   bankDir,
+		StreamCount: 2,
+		Streams: []streamInfo{
+			{Index: 1, Name: "Day <1>", SampleRate: 8000, Samples: 4000, Looping: true, LoopStart: 800, LoopEnd: 4000},
+		},
+		Files:  []outputFile{{Subsong: 1, Name: "00001_Day #1.wav", Size: 1044}},
+		Failed: []subsongFailure{{Subsong: 2, Name: "Night", Reason: "decode failed"}},
+	}
+	if err := writeBankManifest(result, bankDir); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	if err := writeHTMLReport(dir); err != nil {
+		t.Fatalf("writeHTMLReport returned an error: %v", err)
+	}
+
+	index, err := os.ReadFile(filepath.Join(dir, reportDirName, "index.html"))
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	for _, expected := range []string{
+		"<h2>Music</h2>",
+		`<a href="banks/Music_Bank.html">Music_Bank</a>`,
+		"1 subsong(s) failed",
+		`"title":"Day \u003c1\u003e"`,
+		`"href":"banks/Music_Bank.html#file-1"`,
+	} {
+		if !strings.Contains(string(index), expected) {
+			t.Errorf("Expected the index to contain %s", expected)
+		}
+	}
+
+	page, err := os.ReadFile(filepath.Join(dir, reportDirName, "banks", "Music_Bank.html"))
+	if err != nil {
+		t.Fatalf("Failed to read bank page: %v", err)
+	}
+	for _, expected := range []string{
+		"Day &lt;1&gt;",
+		`<audio controls preload="none" src="../../Music/Music_Bank/00001_Day%20%231.wav">`,
+		`src="../../report/thumbnails/Music_Bank_00001_Day%20%231.png"`,
+		"<td class=\"num\">500ms</td>",
+		"<td>100ms – 500ms</td>",
+		"2 Night: decode failed",
+	} {
+		if !strings.Contains(string(page), expected) {
+			t.Errorf("Expected the bank page to contain %s", expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, reportDirName, "thumbnails", "Music_Bank_00001_Day #1.png")); err != nil {
+		t.Errorf("Expected a thumbnail: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jobsPerWorker controls how finely large banks are split; several jobs per
+	// worker keep the tail of the run short when one bank dominates the input
+	jobsPerWorker = 4
+
+	// workerMemoryBytes is the memory budget we assume each worker needs when
+	// deriving the worker count with -w auto
+	workerMemoryBytes = 256 * 1024 * 1024
+
+	// throttleWindow is how often the write throttle re-evaluates throughput
+	throttleWindow = 2 * time.Second
+)
+
+// workersValue implements flag.Value for -w, accepting a number or "auto"
+type workersValue struct{}
+
+func (workersValue) String() string {
+	if autoWorkers {
+		return "auto"
+	}
+	return strconv.Itoa(maxWorkers)
+}
+
+func (workersValue) Set(value string) error {
+	if value == "auto" {
+		autoWorkers = true
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("must be a positive number or \"auto\"")
+	}
+	maxWorkers, autoWorkers = n, false
+	return nil
+}
+
+// autoWorkerCount derives a worker count from the number of CPUs, capped by
+// how many workers fit into the available memory
+func autoWorkerCount() int {
+	workers := runtime.NumCPU()
+	available, err := availableMemory()
+	if err != nil {
+		fileLogger.Printf("Could not determine available memory: %v\n", err)
+		return max(workers, 1)
+	}
+	if byMemory := int(available / workerMemoryBytes); byMemory < workers {
+		workers = byMemory
+	}
+	return max(workers, 1)
+}
+
+// bankTask tracks a bank from validation until all of its decode jobs are done
+type bankTask struct {
+	result   bankResult
+	size     int64
+	stageDir string
+
+	mu      sync.Mutex
+	pending int
+	errs    []error
+}
+
+// workDir is where the bank's files are written until they are committed
+func (t *bankTask) workDir() string {
+	if t.stageDir != "" {
+		return t.stageDir
+	}
+	return t.result.OutputDir
+}
+
+// fail logs the error and records it in the bank result
+func (t *bankTask) fail(format string, args ...interface{}) {
+	fileLogger.Printf(format, args...)
+	t.result.Error = strings.TrimSpace(fmt.Sprintf(format, args...))
+}
+
+// addFailure records a subsong that could not be extracted
+func (t *bankTask) addFailure(subsong int, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failure := subsongFailure{Subsong: subsong, Reason: reason}
+	for _, stream := range t.result.Streams {
+		if stream.Index == subsong {
+			failure.Name = stream.Name
+		}
+	}
+	t.result.Failed = append(t.result.Failed, failure)
+}
+
+// jobDone records the outcome of one of the bank's jobs and reports whether
+// it was the last one outstanding
+func (t *bankTask) jobDone(err error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.errs = append(t.errs, err)
+	}
+	t.pending--
+	return t.pending <= 0
+}
+
+// streamWork estimates the decode cost of a stream from its sample count
+func streamWork(stream streamInfo) int64 {
+	return stream.Samples * int64(max(stream.Channels, 1))
+}
+
+// decodeJob is a unit of decode work: a whole bank or a range of its subsongs
+type decodeJob struct {
+	task        *bankTask
+	first, last int   // 1-based inclusive subsong range, both 0 for the whole bank
+	work        int64 // estimated cost in bank bytes
+}
+
+func (j decodeJob) whole() bool {
+	return j.first == 0
+}
+
+// splitTarget returns the job size above which a bank is split into subsong
+// ranges: a fraction of an even share of the total work per worker
+func splitTarget(totalSize int64, maxWorkers int) int64 {
+	return totalSize / int64(max(maxWorkers, 1)*jobsPerWorker)
+}
+
+// planBankJobs turns a prepared bank into decode jobs. Banks larger than the
+// target are split into subsong ranges so a single huge music bank cannot keep
+// one worker busy while the others sit idle; banks with a subsong selection
+// or filtered subsongs only get jobs for the subsongs they keep. The bank's pending job count is set
+// before the jobs are handed out.
+func planBankJobs(task *bankTask, target int64) []decodeJob {
+	if wanted := task.result.wantedSubsongs(); wanted != nil {
+		if noSplit {
+			target = math.MaxInt64
+		}
+		return planRangeJobs(task, selectedStreams(task.result.Streams, wanted), target)
+	}
+	if noSplit || len(task.result.Streams) < 2 || task.size <= target {
+		task.pending = 1
+		return []decodeJob{{task: task, work: task.size}}
+	}
+
+	return planRangeJobs(task, task.result.Streams, target)
+}
+
+// planRangeJobs splits the given streams of a bank into subsong-range jobs
+func planRangeJobs(task *bankTask, streams []streamInfo, target int64) []decodeJob {
+	jobs := splitStreams(streams, task.size, target)
+	for i := range jobs {
+		jobs[i].task = task
+	}
+	task.pending = len(jobs)
+
+	// Longest job first so the bank's big subsongs start right away
+	sort.SliceStable(jobs, func(a, b int) bool {
+		return jobs[a].work > jobs[b].work
+	})
+	return jobs
+}
+
+// outputBytes estimates how many bytes of 16-bit PCM a job writes
+func (j decodeJob) outputBytes() int64 {
+	streams := j.task.result.Streams
+	if len(streams) == 0 {
+		return int64(float64(j.work) * compressionRatio)
+	}
+
+	var samples int64
+	for _, stream := range streams {
+		if j.whole() || (stream.Index >= j.first && stream.Index <= j.last) {
+			samples += streamWork(stream)
+		}
+	}
+	return samples * 2
+}
+
+// writeThrottle limits how many jobs run at once when the output disk's write
+// throughput stops scaling with the number of workers. It lowers the limit
+// when throughput drops noticeably below the best rate seen so far and raises
+// it again while throughput keeps improving. A nil throttle never blocks.
+type writeThrottle struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	max    int
+	active int
+
+	windowStart time.Time
+	windowBytes int64
+	best        float64
+}
+
+func newWriteThrottle(maxWorkers int) *writeThrottle {
+	t := &writeThrottle{limit: maxWorkers, max: maxWorkers, windowStart: time.Now()}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// acquire blocks until the job may run under the current limit
+func (t *writeThrottle) acquire() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.active >= t.limit {
+		t.cond.Wait()
+	}
+	t.active++
+}
+
+// release records the bytes a finished job wrote and adjusts the limit
+func (t *writeThrottle) release(written int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	t.windowBytes += written
+
+	if elapsed := time.Since(t.windowStart); elapsed >= throttleWindow {
+		t.adjust(float64(t.windowBytes) / elapsed.Seconds())
+		t.windowStart = time.Now()
+		t.windowBytes = 0
+	}
+	t.cond.Broadcast()
+}
+
+// adjust updates the limit from the throughput of the last window in bytes per second
+func (t *writeThrottle) adjust(rate float64) {
+	switch {
+	case rate > t.best*1.05:
+		t.best = rate
+		if t.limit < t.max {
+			t.limit++
+			fileLogger.Printf("Write throughput %.1f MB/s, raising concurrency to %d\n", rate/(1024*1024), t.limit)
+		}
+	case rate < t.best*0.9 && t.limit > 1:
+		t.limit--
+		fileLogger.Printf("Write throughput dropped to %.1f MB/s, lowering concurrency to %d\n", rate/(1024*1024), t.limit)
+	}
+}
+
+// splitStreams groups consecutive subsongs into ranges of roughly target work.
+// Each stream's share of the bank size is proportional to its sample count.
+func splitStreams(streams []streamInfo, bankSize, target int64) []decodeJob {
+	var bankWork int64
+	for _, stream := range streams {
+		bankWork += streamWork(stream)
+	}
+
+	var ranges []decodeJob
+	current := decodeJob{}
+	for _, stream := range streams {
+		work := bankSize / int64(len(streams))
+		if bankWork > 0 {
+			work = streamWork(stream) * bankSize / bankWork
+		}
+
+		// A range can't skip subsongs, so gaps in a selection start a new one
+		if current.first != 0 && (current.work+work > target || stream.Index != current.last+1) {
+			ranges = append(ranges, current)
+			current = decodeJob{}
+		}
+		if current.first == 0 {
+			current.first = stream.Index
+		}
+		current.last = stream.Index
+		current.work += work
+	}
+	if current.first != 0 {
+		ranges = append(ranges, current)
+	}
+	return ranges
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+)
+
+func testStreams(samples ...int64) []streamInfo {
+	streams := make([]streamInfo, len(samples))
+	for i, n := range samples {
+		streams[i] = streamInfo{Index: i + 1, Channels: 2, SampleRate: 48000, Samples: n}
+	}
+	return streams
+}
+
+func TestSplitStreams(t *testing.T) {
+	streams := testStreams(100, 100, 200, 400, 200)
+
+	ranges := splitStreams(streams, 1000, 250)
+	expected := [][2]int{{1, 2}, {3, 3}, {4, 4}, {5, 5}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("Expected %d ranges, got %d: %+v", len(expected), len(ranges), ranges)
+	}
+	var total int64
+	for i, r := range ranges {
+		if r.first != expected[i][0] || r.last != expected[i][1] {
+			t.Errorf("Range %d: expected %v, got %d-%d", i, expected[i], r.first, r.last)
+		}
+		total += r.work
+	}
+	if total != 1000 {
+		t.Errorf("Expected the ranges to add up to the bank size, got %d", total)
+	}
+}
+
+func TestPlanBankJobs(t *testing.T) {
+	originalNoSplit := noSplit
+	defer func() { noSplit = originalNoSplit }()
+	noSplit = false
+
+	big := &bankTask{size: 8000, result: bankResult{Streams: testStreams(1, 1, 1, 1, 4, 1, 1, 1)}}
+	small := &bankTask{size: 100, result: bankResult{Streams: testStreams(1, 1)}}
+	unknown := &bankTask{size: 5000}
+	target := splitTarget(big.size+small.size+unknown.size, 2)
+
+	jobs := planBankJobs(big, target)
+	if len(jobs) < 2 || big.pending != len(jobs) {
+		t.Errorf("Expected the big bank to be split, got %d jobs (pending %d)", len(jobs), big.pending)
+	}
+	for i, job := range jobs {
+		if job.task != big || job.whole() {
+			t.Errorf("Expected a subsong range of the big bank, got %+v", job)
+		}
+		if i > 0 && job.work > jobs[i-1].work {
+			t.Errorf("Expected jobs ordered longest first, got %d after %d", job.work, jobs[i-1].work)
+		}
+	}
+
+	for _, task := range []*bankTask{small, unknown} {
+		if jobs := planBankJobs(task, target); len(jobs) != 1 || !jobs[0].whole() || task.pending != 1 {
+			t.Errorf("Expected one whole-bank job, got %+v", jobs)
+		}
+	}
+
+	noSplit = true
+	if jobs := planBankJobs(big, target); len(jobs) != 1 || !jobs[0].whole() {
+		t.Errorf("Expected a single whole-bank job with splitting disabled")
+	}
+}
+
+func TestWorkersValue(t *testing.T) {
+	originalMaxWorkers, originalAutoWorkers := maxWorkers, autoWorkers
+	defer func() { maxWorkers, autoWorkers = originalMaxWorkers, originalAutoWorkers }()
+
+	var value workersValue
+	if err := value.Set("auto"); err != nil || !autoWorkers || value.String() != "auto" {
+		t.Errorf("Expected auto workers, got %q (err %v)", value.String(), err)
+	}
+	if err := value.Set("6"); err != nil || autoWorkers || maxWorkers != 6 {
+		t.Errorf("Expected 6 workers, got %d (err %v)", maxWorkers, err)
+	}
+	for _, invalid := range []string{"0", "-2", "many"} {
+		if err := value.Set(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+
+	if n := autoWorkerCount(); n < 1 {
+		t.Errorf("Expected at least one worker, got %d", n)
+	}
+}
+
+func TestWriteThrottleAdjust(t *testing.T) {
+	throttle := newWriteThrottle(4)
+	throttle.limit = 2
+
+	throttle.adjust(100)
+	if throttle.limit != 3 || throttle.best != 100 {
+		t.Errorf("Expected the limit to rise while throughput improves, got %d", throttle.limit)
+	}
+
+	throttle.adjust(98)
+	if throttle.limit != 3 {
+		t.Errorf("Expected the limit to hold at a stable rate, got %d", throttle.limit)
+	}
+
+	throttle.adjust(50)
+	if throttle.limit != 2 {
+		t.Errorf("Expected the limit to drop when throughput saturates, got %d", throttle.limit)
+	}
+
+	// A nil throttle must never block
+	var disabled *writeThrottle
+	disabled.acquire()
+	disabled.release(1)
+}
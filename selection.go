@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// subsongSelection picks subsongs of a bank by index, index range or name
+// pattern, e.g. "1,4-6,*Theme*,re:^mus_"
+type subsongSelection struct {
+	spec   string
+	ranges [][2]int
+	names  []*namePattern
+}
+
+var (
+	subsongSpec      string
+	selectedSubsongs *subsongSelection
+)
+
+// parseSubsongSelection parses a comma-separated list of indices, ranges and
+// name patterns. Items that aren't numbers are globs, or regular expressions
+// when prefixed with "re:".
+func parseSubsongSelection(spec string) (*subsongSelection, error) {
+	selection := &subsongSelection{spec: spec}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if first, last, ok := parseSubsongRange(item); ok {
+			if first < 1 || last < first {
+				return nil, fmt.Errorf("invalid subsong range %q", item)
+			}
+			selection.ranges = append(selection.ranges, [2]int{first, last})
+			continue
+		}
+
+		pattern, err := compileNamePattern(item)
+		if err != nil {
+			return nil, err
+		}
+		selection.names = append(selection.names, pattern)
+	}
+	if len(selection.ranges) == 0 && len(selection.names) == 0 {
+		return nil, fmt.Errorf("empty subsong selection %q", spec)
+	}
+	return selection, nil
+}
+
+// parseSubsongRange parses "N" or "N-M"
+func parseSubsongRange(item string) (int, int, bool) {
+	firstText, lastText, isRange := strings.Cut(item, "-")
+	first, err := strconv.Atoi(firstText)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !isRange {
+		return first, first, true
+	}
+	last, err := strconv.Atoi(lastText)
+	if err != nil {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// String returns the selection as it was given
+func (s *subsongSelection) String() string {
+	return s.spec
+}
+
+// resolve returns the selected subsong indices in order. Name patterns need
+// the bank's stream metadata; indices are checked against it when known.
+func (s *subsongSelection) resolve(streams []streamInfo) ([]int, error) {
+	if len(streams) == 0 {
+		if len(s.names) > 0 {
+			return nil, fmt.Errorf("stream names are unknown, select subsongs by index instead")
+		}
+		var subsongs []int
+		for _, r := range s.ranges {
+			for subsong := r[0]; subsong <= r[1]; subsong++ {
+				subsongs = append(subsongs, subsong)
+			}
+		}
+		return uniqueSorted(subsongs), nil
+	}
+
+	var subsongs []int
+	for _, stream := range streams {
+		for _, r := range s.ranges {
+			if stream.Index >= r[0] && stream.Index <= r[1] {
+				subsongs = append(subsongs, stream.Index)
+			}
+		}
+		for _, pattern := range s.names {
+			if stream.Name != "" && pattern.match(stream.Name) {
+				subsongs = append(subsongs, stream.Index)
+			}
+		}
+	}
+	return uniqueSorted(subsongs), nil
+}
+
+// uniqueSorted sorts the indices and drops duplicates
+func uniqueSorted(values []int) []int {
+	sort.Ints(values)
+	unique := values[:0]
+	for i, value := range values {
+		if i == 0 || value != values[i-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// selectedStreams returns the metadata of the selected subsongs. Subsongs
+// without metadata get an empty entry so they can still be scheduled.
+func selectedStreams(streams []streamInfo, selected []int) []streamInfo {
+	byIndex := make(map[int]streamInfo, len(streams))
+	for _, stream := range streams {
+		byIndex[stream.Index] = stream
+	}
+	picked := make([]streamInfo, len(selected))
+	for i, subsong := range selected {
+		stream, ok := byIndex[subsong]
+		if !ok {
+			stream = streamInfo{Index: subsong}
+		}
+		picked[i] = stream
+	}
+	return picked
+}
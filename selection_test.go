@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubsongSelection(t *testing.T) {
+	streams := []streamInfo{
+		{Index: 1, Name: "mus_title"},
+		{Index: 2, Name: "mus_prairie"},
+		{Index: 3, Name: "sfx_wind"},
+		{Index: 4, Name: "mus_forest"},
+		{Index: 5, Name: "sfx_rain"},
+	}
+	tests := map[string][]int{
+		"3":                {3},
+		"2-4":              {2, 3, 4},
+		"mus_*":            {1, 2, 4},
+		"re:^sfx_, 1":      {1, 3, 5},
+		"4-9,mus_forest,4": {4, 5},
+	}
+	for spec, expected := range tests {
+		selection, err := parseSubsongSelection(spec)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", spec, err)
+		}
+		got, err := selection.resolve(streams)
+		if err != nil || !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: expected %v, got %v (err %v)", spec, expected, got, err)
+		}
+	}
+
+	// Without metadata only indices can be resolved
+	selection, _ := parseSubsongSelection("7,2-3")
+	if got, err := selection.resolve(nil); err != nil || !reflect.DeepEqual(got, []int{2, 3, 7}) {
+		t.Errorf("Expected the indices as given, got %v (err %v)", got, err)
+	}
+	selection, _ = parseSubsongSelection("mus_*")
+	if _, err := selection.resolve(nil); err == nil {
+		t.Errorf("Expected an error for a name pattern without metadata")
+	}
+
+	for _, invalid := range []string{"", " , ", "0", "5-2", "re:("} {
+		if _, err := parseSubsongSelection(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestSplitStreamsSelection(t *testing.T) {
+	streams := selectedStreams(testStreams(100, 100, 100, 100, 100), []int{1, 2, 4, 9})
+	ranges := splitStreams(streams, 500, 1000)
+	expected := [][2]int{{1, 2}, {4, 4}, {9, 9}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("Expected %d ranges, got %+v", len(expected), ranges)
+	}
+	for i, r := range ranges {
+		if r.first != expected[i][0] || r.last != expected[i][1] {
+			t.Errorf("Range %d: expected %v, got %d-%d", i, expected[i], r.first, r.last)
+		}
+	}
+}
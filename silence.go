@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	silenceThreshold = -60.0
+	trimSilence      bool
+	trimPadding      = 20 * time.Millisecond
+	dropSilent       bool
+)
+
+// audibleRange returns the first and one past the last frame with a sample
+// above the threshold amplitude, or 0, 0 if there is none
+func audibleRange(audio *pcmAudio, threshold float64) (int, int) {
+	level := int32(math.Ceil(threshold * float64(int64(1)<<(audio.BitsPerSample-1))))
+	loud := func(frame int) bool {
+		for _, sample := range audio.Samples[frame*audio.Channels : (frame+1)*audio.Channels] {
+			if sample > level || sample < -level {
+				return true
+			}
+		}
+		return false
+	}
+
+	frames := audio.frames()
+	first := 0
+	for first < frames && !loud(first) {
+		first++
+	}
+	if first == frames {
+		return 0, 0
+	}
+	last := frames
+	for !loud(last - 1) {
+		last--
+	}
+	return first, last
+}
+
+// trimAudio cuts the audio to the frames from first to last
+func trimAudio(audio *pcmAudio, first, last int) {
+	audio.Samples = audio.Samples[first*audio.Channels : last*audio.Channels]
+}
+
+// checkSilence flags the WAV files in dir whose peak stays below
+// --silence-threshold and, with --trim-silence, trims the silence around the
+// others. Looping subsongs aren't trimmed since that would move their loop
+// points. It returns the files left after --drop-silent, which are no longer
+// counted as extracted.
+func checkSilence(result *bankResult, dir string, files []outputFile) ([]outputFile, error) {
+	threshold := math.Pow(10, silenceThreshold/20)
+	var kept []outputFile
+	var firstErr error
+	note := func(name string, err error) {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	for i := range files {
+		file := &files[i]
+		if !strings.EqualFold(filepath.Ext(file.Name), ".wav") {
+			kept = append(kept, *file)
+			continue
+		}
+		path := filepath.Join(dir, file.Name)
+		audio, chunks, err := readWAVFile(path)
+		if err != nil {
+			note(file.Name, err)
+			kept = append(kept, *file)
+			continue
+		}
+
+		first, last := audibleRange(audio, threshold)
+		if last == 0 {
+			file.Silent = true
+			result.Silent = append(result.Silent, file.Subsong)
+			if dropSilent {
+				err := os.Remove(path)
+				if err == nil {
+					result.Extracted--
+					continue
+				}
+				note(file.Name, err)
+			}
+			kept = append(kept, *file)
+			continue
+		}
+
+		kept = append(kept, *file)
+		stream, _ := findStream(*result, file.Subsong)
+		if !trimSilence || hasLoop(stream) {
+			continue
+		}
+		padding := int(trimPadding * time.Duration(audio.SampleRate) / time.Second)
+		first, last = max(first-padding, 0), min(last+padding, audio.frames())
+		if first == 0 && last == audio.frames() {
+			continue
+		}
+		trimmed := &kept[len(kept)-1]
+		removedEnd := int64(audio.frames() - last)
+		trimAudio(audio, first, last)
+		if err := writeWAVFile(path, audio, chunks); err != nil {
+			note(file.Name, err)
+			continue
+		}
+		if err := trimmed.rehash(path); err != nil {
+			note(file.Name, err)
+			continue
+		}
+		trimmed.TrimmedStart, trimmed.TrimmedEnd = int64(first), removedEnd
+	}
+	return kept, firstErr
+}
+
+// validateSilenceOptions checks the threshold and padding
+func validateSilenceOptions() error {
+	if silenceThreshold > 0 || math.IsNaN(silenceThreshold) {
+		return fmt.Errorf("--silence-threshold %g is above full scale", silenceThreshold)
+	}
+	if trimPadding < 0 {
+		return fmt.Errorf("--trim-padding can't be negative")
+	}
+	return nil
+}
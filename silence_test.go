@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckSilence(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalTrim, originalPadding, originalDrop := trimSilence, trimPadding, dropSilent
+	defer func() { trimSilence, trimPadding, dropSilent = originalTrim, originalPadding, originalDrop }()
+	trimSilence, trimPadding, dropSilent = true, 10*time.Millisecond, true
+
+	// 1 kHz mono, 16-bit: -60 dBFS is about 33
+	padded := make([]int32, 1000)
+	for i := 300; i < 500; i++ {
+		padded[i] = 1000
+	}
+	hiss := make([]int32, 1000)
+	for i := range hiss {
+		hiss[i] = int32(i%3) * 10
+	}
+	contents := map[string][]int32{
+		"00001_padded.wav":  padded,
+		"00002_empty.wav":   make([]int32, 1000),
+		"00003_hiss.wav":    hiss,
+		"00004_looping.wav": padded,
+	}
+	for name, samples := range contents {
+		var wav bytes.Buffer
+		if err := writeWAV(&wav, &pcmAudio{SampleRate: 1000, Channels: 1, BitsPerSample: 16, Samples: samples}, nil); err != nil {
+			t.Fatalf("writeWAV returned an error: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tempDir, name), wav.Bytes(), 0600); err != nil {
+			t.Fatalf("Failed to write WAV: %v", err)
+		}
+	}
+
+	result := &bankResult{Extracted: 4, Streams: []streamInfo{{Index: 4, Looping: true, LoopStart: 0, LoopEnd: 1000}}}
+	files := []outputFile{
+		{Subsong: 1, Name: "00001_padded.wav", SHA256: "padded"},
+		{Subsong: 2, Name: "00002_empty.wav"},
+		{Subsong: 3, Name: "00003_hiss.wav"},
+		{Subsong: 4, Name: "00004_looping.wav"},
+	}
+	kept, err := checkSilence(result, tempDir, files)
+	if err != nil {
+		t.Fatalf("checkSilence returned an error: %v", err)
+	}
+
+	if len(result.Silent) != 2 || result.Silent[0] != 2 || result.Silent[1] != 3 {
+		t.Errorf("Expected subsongs 2 and 3 to be silent, got %v", result.Silent)
+	}
+	if len(kept) != 2 || kept[0].Subsong != 1 || kept[1].Subsong != 4 {
+		t.Fatalf("Expected the silent files to be dropped, got %+v", kept)
+	}
+	if result.Extracted != 2 {
+		t.Errorf("Expected the dropped files not to count as extracted, got %d", result.Extracted)
+	}
+	for _, name := range []string{"00002_empty.wav", "00003_hiss.wav"} {
+		if _, err := os.Stat(filepath.Join(tempDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+
+	if kept[0].TrimmedStart != 290 || kept[0].TrimmedEnd != 490 || kept[0].DecodedSHA256 != "padded" {
+		t.Errorf("Expected 290 samples trimmed at the start and 490 at the end, got %+v", kept[0])
+	}
+	audio, _, err := readWAVFile(filepath.Join(tempDir, "00001_padded.wav"))
+	if err != nil {
+		t.Fatalf("Failed to read the trimmed WAV: %v", err)
+	}
+	if audio.frames() != 220 || audio.Samples[10] != 1000 || audio.Samples[9] != 0 {
+		t.Errorf("Expected the audio with 10 ms of padding, got %d samples", audio.frames())
+	}
+	if kept[1].TrimmedStart != 0 || kept[1].TrimmedEnd != 0 {
+		t.Errorf("Expected the looping subsong not to be trimmed, got %+v", kept[1])
+	}
+}
+
+func TestValidateSilenceOptions(t *testing.T) {
+	originalThreshold, originalPadding := silenceThreshold, trimPadding
+	defer func() { silenceThreshold, trimPadding = originalThreshold, originalPadding }()
+
+	silenceThreshold, trimPadding = -50, 0
+	if err := validateSilenceOptions(); err != nil {
+		t.Errorf("Expected -50 dBFS to be valid: %v", err)
+	}
+	silenceThreshold = 3
+	if err := validateSilenceOptions(); err == nil {
+		t.Errorf("Expected an error for a threshold above full scale")
+	}
+	silenceThreshold, trimPadding = -50, -time.Second
+	if err := validateSilenceOptions(); err == nil {
+		t.Errorf("Expected an error for a negative padding")
+	}
+}
@@ -113,12 +113,3 @@ func getSteamBankFiles() ([]string, error) {
 
 	return allBankFiles, nil
 }
-
-// dirExists checks if a directory exists
-func dirExists(path string) bool {
-	info, err := os.Stat(path)
-	if err != nil {
-		return false
-	}
-	return info.IsDir()
-}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	stemsChannels = "channels"
+	stemsPairs    = "pairs"
+)
+
+// stemSplit is how subsongs with more than two channels are split
+var stemSplit string
+
+// validateStemSplit checks the --split-stems option
+func validateStemSplit() error {
+	if stemSplit != "" && stemSplit != stemsChannels && stemSplit != stemsPairs {
+		return fmt.Errorf("unknown stem split %q, expected %s or %s", stemSplit, stemsChannels, stemsPairs)
+	}
+	return nil
+}
+
+// stemGroups returns the channels, counted from 1, that go into each stem.
+// With pairs an odd channel count leaves the last channel on its own.
+func stemGroups(channels int) [][]int {
+	size := 1
+	if stemSplit == stemsPairs {
+		size = 2
+	}
+	var groups [][]int
+	for first := 1; first <= channels; first += size {
+		var group []int
+		for ch := first; ch < first+size && ch <= channels; ch++ {
+			group = append(group, ch)
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// channelSuffix names a stem by its channels, e.g. ch3 or ch3-4
+func channelSuffix(channels []int) string {
+	suffix := "ch" + strconv.Itoa(channels[0])
+	if len(channels) > 1 {
+		suffix += "-" + strconv.Itoa(channels[len(channels)-1])
+	}
+	return suffix
+}
+
+// extractStem copies the given channels, counted from 1, out of the audio
+func extractStem(audio *pcmAudio, channels []int) *pcmAudio {
+	stem := &pcmAudio{SampleRate: audio.SampleRate, Channels: len(channels), BitsPerSample: audio.BitsPerSample}
+	frames := audio.frames()
+	stem.Samples = make([]int32, 0, frames*len(channels))
+	for i := 0; i < frames; i++ {
+		for _, ch := range channels {
+			stem.Samples = append(stem.Samples, audio.Samples[i*audio.Channels+ch-1])
+		}
+	}
+	return stem
+}
+
+// splitStemFiles replaces the WAV files of subsongs with more than two
+// channels by one file per channel or channel pair. Each stem records the
+// channels of the original it holds.
+func splitStemFiles(dir string, files []outputFile) ([]outputFile, error) {
+	if stemSplit == "" {
+		return files, nil
+	}
+	var split []outputFile
+	var firstErr error
+	for _, file := range files {
+		stems, err := splitStemFile(dir, file)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", file.Name, err)
+			}
+			stems = []outputFile{file}
+		}
+		split = append(split, stems...)
+	}
+	return split, firstErr
+}
+
+// splitStemFile splits one file, or returns it as it is if it has no more
+// than two channels
+func splitStemFile(dir string, file outputFile) ([]outputFile, error) {
+	if !strings.EqualFold(filepath.Ext(file.Name), ".wav") {
+		return []outputFile{file}, nil
+	}
+	path := filepath.Join(dir, file.Name)
+	audio, chunks, err := readWAVFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if audio.Channels <= 2 {
+		return []outputFile{file}, nil
+	}
+
+	base := strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
+	var stems []outputFile
+	for _, channels := range stemGroups(audio.Channels) {
+		stem := file
+		stem.Channels, stem.Stem = channels, channelSuffix(channels)
+		stem.Name = base + "_" + stem.Stem + filepath.Ext(file.Name)
+		stemPath := filepath.Join(dir, stem.Name)
+		if err := writeWAVFile(stemPath, extractStem(audio, channels), chunks); err != nil {
+			return nil, removeStems(dir, stems, err)
+		}
+		if err := stem.rehash(stemPath); err != nil {
+			return nil, removeStems(dir, append(stems, stem), err)
+		}
+		stems = append(stems, stem)
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, removeStems(dir, stems, err)
+	}
+	return stems, nil
+}
+
+// removeStems removes the stems written before a split failed, so only the
+// unsplit file is left for the manifest, and returns the error it failed with
+func removeStems(dir string, stems []outputFile, err error) error {
+	for _, stem := range stems {
+		if removeErr := os.Remove(filepath.Join(dir, stem.Name)); removeErr != nil && !os.IsNotExist(removeErr) {
+			fileLogger.Printf("Failed to remove stem %s: %v\n", stem.Name, removeErr)
+		}
+	}
+	return err
+}
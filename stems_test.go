@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStemGroups(t *testing.T) {
+	defer func(original string) { stemSplit = original }(stemSplit)
+
+	stemSplit = stemsPairs
+	if groups := stemGroups(5); !reflect.DeepEqual(groups, [][]int{{1, 2}, {3, 4}, {5}}) {
+		t.Errorf("Unexpected pairs %v", groups)
+	}
+	stemSplit = stemsChannels
+	if groups := stemGroups(3); !reflect.DeepEqual(groups, [][]int{{1}, {2}, {3}}) {
+		t.Errorf("Unexpected channels %v", groups)
+	}
+	if suffix := channelSuffix([]int{3, 4}); suffix != "ch3-4" {
+		t.Errorf("Expected ch3-4, got %s", suffix)
+	}
+
+	stemSplit = "quad"
+	if err := validateStemSplit(); err == nil {
+		t.Errorf("Expected an error for an unknown split")
+	}
+}
+
+func TestSplitStemFiles(t *testing.T) {
+	defer func(original string) { stemSplit = original }(stemSplit)
+	stemSplit = stemsPairs
+
+	dir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("Failed to remove temp directory: %v", err)
+		}
+	}()
+
+	quad := &pcmAudio{SampleRate: 48000, Channels: 4, BitsPerSample: 16, Samples: []int32{1, 2, 3, 4, 5, 6, 7, 8}}
+	stereo := &pcmAudio{SampleRate: 48000, Channels: 2, BitsPerSample: 16, Samples: []int32{1, 2}}
+	chunks := []wavChunk{{ID: "smpl", Data: make([]byte, 60)}}
+	if err := writeWAVFile(filepath.Join(dir, "00001_music.wav"), quad, chunks); err != nil {
+		t.Fatalf("Failed to write WAV: %v", err)
+	}
+	if err := writeWAVFile(filepath.Join(dir, "00002_sfx.wav"), stereo, nil); err != nil {
+		t.Fatalf("Failed to write WAV: %v", err)
+	}
+	files := []outputFile{
+		{Subsong: 1, Name: "00001_music.wav", SHA256: "quad"},
+		{Subsong: 2, Name: "00002_sfx.wav", SHA256: "stereo"},
+	}
+
+	files, err = splitStemFiles(dir, files)
+	if err != nil {
+		t.Fatalf("splitStemFiles returned an error: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected two stems and the stereo file, got %+v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00001_music.wav")); !os.IsNotExist(err) {
+		t.Errorf("Expected the multichannel file to be removed")
+	}
+
+	second := files[1]
+	if second.Name != "00001_music_ch3-4.wav" || !reflect.DeepEqual(second.Channels, []int{3, 4}) || second.Stem != "ch3-4" || second.DecodedSHA256 != "quad" {
+		t.Errorf("Unexpected stem %+v", second)
+	}
+	audio, gotChunks, err := readWAVFile(filepath.Join(dir, second.Name))
+	if err != nil {
+		t.Fatalf("Failed to read stem: %v", err)
+	}
+	if !reflect.DeepEqual(audio.Samples, []int32{3, 4, 7, 8}) || len(gotChunks) != 1 {
+		t.Errorf("Expected channels 3 and 4 with the loop points, got %v and %d chunks", audio.Samples, len(gotChunks))
+	}
+	if files[2].Name != "00002_sfx.wav" || files[2].Channels != nil {
+		t.Errorf("Expected the stereo file to be kept, got %+v", files[2])
+	}
+}
+
+func TestSplitStemFilesRemovesPartialStems(t *testing.T) {
+	defer func(original string) { stemSplit = original }(stemSplit)
+	stemSplit = stemsPairs
+
+	dir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("Failed to remove temp directory: %v", err)
+		}
+	}()
+
+	quad := &pcmAudio{SampleRate: 48000, Channels: 4, BitsPerSample: 16, Samples: []int32{1, 2, 3, 4}}
+	if err := writeWAVFile(filepath.Join(dir, "00001_music.wav"), quad, nil); err != nil {
+		t.Fatalf("Failed to write WAV: %v", err)
+	}
+	// A directory in the way of the second stem makes its write fail
+	if err := os.MkdirAll(filepath.Join(dir, "00001_music_ch3-4.wav", "blocked"), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	files, err := splitStemFiles(dir, []outputFile{{Subsong: 1, Name: "00001_music.wav", SHA256: "quad"}})
+	if err == nil {
+		t.Fatalf("Expected an error when a stem can't be written")
+	}
+	if len(files) != 1 || files[0].Name != "00001_music.wav" {
+		t.Errorf("Expected the unsplit file to be kept, got %+v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00001_music_ch1-2.wav")); !os.IsNotExist(err) {
+		t.Errorf("Expected the stem written before the failure to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00001_music.wav")); err != nil {
+		t.Errorf("Expected the multichannel file to be kept: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultTrackMap is the built-in mapping of Sky soundtrack pieces. It only
+// takes entries verified against the game files by their exact stream name or
+// hash, never broad patterns, so a title can't end up on every subsong that
+// happens to match. None has been verified yet, so it ships empty and titles
+// come from --track-map.
+//
+//go:embed data/tracks.json
+var defaultTrackMap []byte
+
+const (
+	// defaultTitleTemplate names mapped tracks after their soundtrack title
+	defaultTitleTemplate = "{title}"
+
+	// unmappedTracksFileName lists music outputs no mapping entry matched, in
+	// the mapping file format so they can be filled in and contributed
+	unmappedTracksFileName = "unmapped-tracks.json"
+
+	// musicType is the sound type whose outputs are expected to have a title
+	musicType = "Music"
+)
+
+// trackInfo is the soundtrack metadata of a mapped output file
+type trackInfo struct {
+	Title    string `json:"title"`
+	Album    string `json:"album,omitempty"`
+	Track    int    `json:"track,omitempty"`
+	Composer string `json:"composer,omitempty"`
+}
+
+// trackEntry maps a subsong, identified by its bank and stream name or the
+// SHA-256 of its decoded audio, to its soundtrack metadata
+type trackEntry struct {
+	Bank    string `json:"bank"`
+	Subsong string `json:"subsong,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	trackInfo
+
+	bank    *namePattern
+	subsong *namePattern
+}
+
+// trackMapFile is the layout of data/tracks.json and the file passed to --track-map
+type trackMapFile struct {
+	Tracks []trackEntry `json:"tracks"`
+}
+
+var (
+	trackMapPath  string
+	titleTemplate = defaultTitleTemplate
+	trackMap      = mustParseTrackMap(defaultTrackMap)
+)
+
+// trackTemplateKeys lists the placeholders the track mapping adds to the name templates
+var trackTemplateKeys = []string{"title", "album", "track", "composer"}
+
+// mustParseTrackMap parses the built-in mapping
+func mustParseTrackMap(data []byte) []trackEntry {
+	tracks, err := parseTrackMap(data)
+	if err == nil {
+		for i := range tracks {
+			if err = checkExactTrack(tracks[i]); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in track map: %v", err))
+	}
+	return tracks
+}
+
+// checkExactTrack reports an error unless the entry names one subsong: by its
+// hash, or by its exact bank and stream name
+func checkExactTrack(entry trackEntry) error {
+	if entry.SHA256 != "" {
+		return nil
+	}
+	for _, name := range []string{entry.Bank, entry.Subsong} {
+		if strings.HasPrefix(name, "re:") || strings.ContainsAny(name, "*?[\\") {
+			return fmt.Errorf("track %s uses the pattern %q instead of an exact name", entry.Title, name)
+		}
+	}
+	return nil
+}
+
+// parseTrackMap parses and compiles a track mapping
+func parseTrackMap(data []byte) ([]trackEntry, error) {
+	var file trackMapFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for i := range file.Tracks {
+		entry := &file.Tracks[i]
+		if entry.Title == "" {
+			return nil, fmt.Errorf("track %d has no title", i+1)
+		}
+		if entry.Subsong == "" && entry.SHA256 == "" {
+			return nil, fmt.Errorf("track %d (%s) needs a subsong name or sha256", i+1, entry.Title)
+		}
+		if entry.Bank == "" {
+			entry.Bank = "*"
+		}
+		var err error
+		if entry.bank, err = compileNamePattern(entry.Bank); err != nil {
+			return nil, fmt.Errorf("track %d (%s): %v", i+1, entry.Title, err)
+		}
+		if entry.Subsong != "" {
+			if entry.subsong, err = compileNamePattern(entry.Subsong); err != nil {
+				return nil, fmt.Errorf("track %d (%s): %v", i+1, entry.Title, err)
+			}
+		}
+		entry.SHA256 = strings.ToLower(entry.SHA256)
+	}
+	return file.Tracks, nil
+}
+
+// loadTrackMap reads a user mapping file. Its entries are checked before the
+// built-in ones, so they can both add and correct titles.
+func loadTrackMap(path string) ([]trackEntry, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := parseTrackMap(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return append(tracks, mustParseTrackMap(defaultTrackMap)...), nil
+}
+
+// lookupTrack returns the metadata of the first entry matching the subsong, or
+// nil if it isn't mapped
+func lookupTrack(bankName, subsongName, sum string) *trackInfo {
+	for _, entry := range trackMap {
+		if !entry.bank.match(bankName) {
+			continue
+		}
+		if entry.SHA256 != "" && entry.SHA256 != sum {
+			continue
+		}
+		if entry.subsong != nil && (subsongName == "" || !entry.subsong.match(subsongName)) {
+			continue
+		}
+		info := entry.trackInfo
+		return &info
+	}
+	return nil
+}
+
+// mapTracks attaches soundtrack metadata to every output file of a bank
+func mapTracks(result bankResult, files []outputFile) {
+	bankName := strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile))
+	for i := range files {
+		files[i].Track = lookupTrack(bankName, streamName(result, files[i].Subsong), files[i].SHA256)
+	}
+}
+
+// unmappedTracks lists the music outputs of the run that have no title, as
+// mapping entries
+func unmappedTracks(results []bankResult) []trackEntry {
+	var unmapped []trackEntry
+	for _, result := range results {
+		bankName := strings.TrimSuffix(filepath.Base(result.BankFile), filepath.Ext(result.BankFile))
+		for _, file := range result.Files {
+			if file.Track != nil || file.Tags.Type != musicType {
+				continue
+			}
+			// Track mappings match the decoded audio, whatever the output format
+			unmapped = append(unmapped, trackEntry{
+				Bank:    bankName,
+				Subsong: streamName(result, file.Subsong),
+				SHA256:  file.decodedHash(),
+			})
+		}
+	}
+	return unmapped
+}
+
+// writeUnmappedTracks writes the unmapped music outputs to the output directory
+func writeUnmappedTracks(dir string, unmapped []trackEntry) error {
+	data, err := json.MarshalIndent(trackMapFile{Tracks: unmapped}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, unmappedTracksFileName), data, 0600)
+}
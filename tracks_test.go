@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupTrack(t *testing.T) {
+	originalTrackMap := trackMap
+	defer func() { trackMap = originalTrackMap }()
+
+	tracks, err := parseTrackMap([]byte(`{"tracks": [
+		{"bank": "Music_Test", "sha256": "ABCDEF", "title": "By Hash", "track": 2},
+		{"bank": "Music_*", "subsong": "mus_prairie*", "title": "Prairie", "album": "OST", "composer": "Someone"}
+	]}`))
+	if err != nil {
+		t.Fatalf("parseTrackMap returned an error: %v", err)
+	}
+	trackMap = tracks
+
+	if info := lookupTrack("Music_Test", "mus_other", "abcdef"); info == nil || info.Title != "By Hash" || info.Track != 2 {
+		t.Errorf("Expected a match by hash, got %+v", info)
+	}
+	if info := lookupTrack("Music_Test", "mus_prairie_day", "123"); info == nil || info.Title != "Prairie" || info.Composer != "Someone" {
+		t.Errorf("Expected a match by subsong name, got %+v", info)
+	}
+	if info := lookupTrack("SFX_Test", "mus_prairie_day", ""); info != nil {
+		t.Errorf("Expected no match in another bank, got %+v", info)
+	}
+	if info := lookupTrack("Music_Test", "", "123"); info != nil {
+		t.Errorf("Expected no match for an unnamed subsong, got %+v", info)
+	}
+
+	for _, invalid := range []string{
+		`{"tracks": [{"subsong": "x"}]}`,
+		`{"tracks": [{"title": "No Key"}]}`,
+		`{"tracks": [{"bank": "[", "subsong": "x", "title": "Bad"}]}`,
+	} {
+		if _, err := parseTrackMap([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestDefaultTrackMapIsExact(t *testing.T) {
+	for _, entry := range mustParseTrackMap(defaultTrackMap) {
+		if err := checkExactTrack(entry); err != nil {
+			t.Errorf("Built-in track %q: %v", entry.Title, err)
+		}
+	}
+
+	tracks, err := parseTrackMap([]byte(`{"tracks": [
+		{"bank": "Music_Prairie", "subsong": "mus_prairie_day", "title": "Exact"},
+		{"sha256": "ABC", "title": "Hashed"},
+		{"bank": "Music_Prairie", "subsong": "re:(?i)prairie", "title": "Regexp"},
+		{"bank": "Music_*", "subsong": "mus_prairie_day", "title": "Glob"},
+		{"subsong": "mus_prairie_day", "title": "Any bank"}
+	]}`))
+	if err != nil {
+		t.Fatalf("parseTrackMap returned an error: %v", err)
+	}
+	for i, entry := range tracks {
+		if err := checkExactTrack(entry); (err == nil) != (i < 2) {
+			t.Errorf("Unexpected result for track %q: %v", entry.Title, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a built-in map with patterns to be rejected")
+		}
+	}()
+	mustParseTrackMap([]byte(`{"tracks": [{"bank": "re:^music", "subsong": "re:forest", "title": "Hidden Forest"}]}`))
+}
+
+func TestLoadTrackMap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	path := filepath.Join(tempDir, "tracks.json")
+	content := `{"tracks": [{"bank": "Music_*", "subsong": "*prairie*", "title": "Corrected"}]}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write track map: %v", err)
+	}
+	tracks, err := loadTrackMap(path)
+	if err != nil {
+		t.Fatalf("loadTrackMap returned an error: %v", err)
+	}
+	if len(tracks) != len(trackMap)+1 || tracks[0].Title != "Corrected" {
+		t.Errorf("Expected the user entries before the built-in ones, got %d entries", len(tracks))
+	}
+}
+
+func TestMappedTrackNames(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testdir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Logf("Error removing temp directory: %v", err)
+		}
+	}()
+
+	originalTrackMap, originalTitleTemplate := trackMap, titleTemplate
+	defer func() { trackMap, titleTemplate = originalTrackMap, originalTitleTemplate }()
+	trackMap, err = parseTrackMap([]byte(`{"tracks": [{"bank": "Music_*", "subsong": "mus_isle", "title": "Isle", "track": 3}]}`))
+	if err != nil {
+		t.Fatalf("parseTrackMap returned an error: %v", err)
+	}
+	titleTemplate = "{track:02} {title}"
+
+	result := bankResult{
+		BankFile: filepath.Join("in", "Music_Test.bank"),
+		Streams:  []streamInfo{{Index: 1, Name: "mus_isle"}, {Index: 2, Name: "mus_xyz"}},
+	}
+	var files []outputFile
+	for _, name := range []string{"00001_mus_isle.wav", "00002_mus_xyz.wav"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(name), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		files = append(files, outputFile{Subsong: subsongFromName(name), Name: name, Tags: areaTags{Type: musicType}})
+	}
+
+	mapTracks(result, files)
+	if files, err = nameOutputFiles(result, tempDir, files); err != nil {
+		t.Fatalf("Failed to name files: %v", err)
+	}
+	if files[0].Name != "03 Isle.wav" || files[1].Name != "02_mus_xyz.wav" {
+		t.Errorf("Expected the mapped track to be named by title, got %s and %s", files[0].Name, files[1].Name)
+	}
+
+	result.Files = files
+	unmapped := unmappedTracks([]bankResult{result})
+	if len(unmapped) != 1 || unmapped[0].Bank != "Music_Test" || unmapped[0].Subsong != "mus_xyz" {
+		t.Fatalf("Expected mus_xyz to be reported as unmapped, got %+v", unmapped)
+	}
+	if err := writeUnmappedTracks(tempDir, unmapped); err != nil {
+		t.Fatalf("Failed to write unmapped tracks: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tempDir, unmappedTracksFileName))
+	if err != nil {
+		t.Fatalf("Failed to read unmapped tracks: %v", err)
+	}
+	var report trackMapFile
+	if err := json.Unmarshal(data, &report); err != nil || len(report.Tracks) != 1 || report.Tracks[0].Subsong != "mus_xyz" {
+		t.Errorf("Expected the report in the mapping file format, got %s (err %v)", data, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// execCommand is a variable so tests can replace it with a helper process
+var execCommand = exec.Command
+
+// streamInfo describes a single subsong as reported by vgmstream's JSON info output
+type streamInfo struct {
+	Index      int    `json:"index"`
+	Name       string `json:"name"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+	Samples    int64  `json:"samples"`
+	Looping    bool   `json:"looping"`
+	LoopStart  int64  `json:"loopStart,omitempty"`
+	LoopEnd    int64  `json:"loopEnd,omitempty"`
+	Encoding   string `json:"encoding,omitempty"`
+}
+
+// Duration returns the playback length of the stream without looping
+func (s streamInfo) Duration() time.Duration {
+	if s.SampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(s.Samples * int64(time.Second) / int64(s.SampleRate))
+}
+
+// vgmstreamInfo mirrors the subset of `vgmstream-cli -m -I` output we care about
+type vgmstreamInfo struct {
+	SampleRate  int `json:"sampleRate"`
+	Channels    int `json:"channels"`
+	LoopingInfo *struct {
+		Start int64 `json:"start"`
+		End   int64 `json:"end"`
+	} `json:"loopingInfo"`
+	NumberOfSamples int64  `json:"numberOfSamples"`
+	Encoding        string `json:"encoding"`
+	StreamInfo      struct {
+		Index int    `json:"index"`
+		Name  string `json:"name"`
+		Total int    `json:"total"`
+	} `json:"streamInfo"`
+}
+
+// queryStreamInfo asks vgmstream for the metadata of one subsong (1-based) and
+// returns it together with the total number of subsongs in the bank
+func queryStreamInfo(bankFile string, subsong int) (streamInfo, int, error) {
+	// #nosec G204
+	cmd := execCommand(vgmstreamPath, "-m", "-I", "-s", fmt.Sprint(subsong), bankFile)
+	output, err := cmd.Output()
+	if err != nil {
+		return streamInfo{}, 0, fmt.Errorf("vgmstream info for subsong %d failed: %v", subsong, err)
+	}
+
+	info, err := parseVgmstreamInfo(output)
+	if err != nil {
+		return streamInfo{}, 0, fmt.Errorf("vgmstream info for subsong %d: %v", subsong, err)
+	}
+
+	stream := streamInfo{
+		Index:      subsong,
+		Name:       info.StreamInfo.Name,
+		SampleRate: info.SampleRate,
+		Channels:   info.Channels,
+		Samples:    info.NumberOfSamples,
+		Encoding:   info.Encoding,
+	}
+	if info.LoopingInfo != nil {
+		stream.Looping = true
+		stream.LoopStart = info.LoopingInfo.Start
+		stream.LoopEnd = info.LoopingInfo.End
+	}
+
+	total := info.StreamInfo.Total
+	if total == 0 {
+		// Formats without subsongs report no stream total
+		total = 1
+	}
+	return stream, total, nil
+}
+
+// parseVgmstreamInfo extracts the JSON object from vgmstream's output, which
+// may be surrounded by other diagnostic text depending on the build
+func parseVgmstreamInfo(output []byte) (vgmstreamInfo, error) {
+	var info vgmstreamInfo
+	start := bytes.IndexByte(output, '{')
+	end := bytes.LastIndexByte(output, '}')
+	if start < 0 || end < start {
+		return info, fmt.Errorf("no JSON info in vgmstream output")
+	}
+	if err := json.Unmarshal(output[start:end+1], &info); err != nil {
+		return info, fmt.Errorf("invalid JSON info: %v", err)
+	}
+	return info, nil
+}
+
+// queryBankInfo returns the metadata of every subsong in a bank
+func queryBankInfo(bankFile string) ([]streamInfo, error) {
+	first, total, err := queryStreamInfo(bankFile, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make([]streamInfo, 0, total)
+	streams = append(streams, first)
+	for i := 2; i <= total; i++ {
+		stream, _, err := queryStreamInfo(bankFile, i)
+		if err != nil {
+			return streams, err
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
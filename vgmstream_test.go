@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseVgmstreamInfo(t *testing.T) {
+	output := []byte("some banner\n{\"sampleRate\":44100,\"channels\":1,\"loopingInfo\":null," +
+		"\"numberOfSamples\":44100,\"streamInfo\":{\"index\":3,\"name\":\"mus_title\",\"total\":7}}\n")
+
+	info, err := parseVgmstreamInfo(output)
+	if err != nil {
+		t.Fatalf("Failed to parse info: %v", err)
+	}
+	if info.SampleRate != 44100 || info.Channels != 1 || info.StreamInfo.Total != 7 {
+		t.Errorf("Unexpected info: %+v", info)
+	}
+	if info.LoopingInfo != nil {
+		t.Errorf("Expected no looping info")
+	}
+
+	if _, err := parseVgmstreamInfo([]byte("error: unsupported file")); err == nil {
+		t.Errorf("Expected an error for output without JSON")
+	}
+}
+
+func TestQueryBankInfo(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+	execCommand = fakeExecCommand("HELPER_STREAM_TOTAL=3")
+
+	streams, err := queryBankInfo("test.bank")
+	if err != nil {
+		t.Fatalf("Failed to query bank info: %v", err)
+	}
+	if len(streams) != 3 {
+		t.Fatalf("Expected 3 streams, got %d", len(streams))
+	}
+	for i, stream := range streams {
+		if stream.Index != i+1 {
+			t.Errorf("Expected index %d, got %d", i+1, stream.Index)
+		}
+		if !stream.Looping || stream.LoopStart != 100 || stream.LoopEnd != 48000 {
+			t.Errorf("Unexpected loop info: %+v", stream)
+		}
+	}
+	if streams[1].Name != "stream2" {
+		t.Errorf("Expected name stream2, got %s", streams[1].Name)
+	}
+	if d := streams[0].Duration(); d != 2*time.Second {
+		t.Errorf("Expected duration 2s, got %v", d)
+	}
+}
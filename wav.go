@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// pcmAudio holds decoded PCM with interleaved channels: integer samples, or
+// for 32-bit float WAV the samples in Float instead
+type pcmAudio struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	Samples       []int32
+	Float         []float32
+}
+
+// frames returns the number of samples per channel
+func (a *pcmAudio) frames() int {
+	if a.Channels == 0 {
+		return 0
+	}
+	if a.Float != nil {
+		return len(a.Float) / a.Channels
+	}
+	return len(a.Samples) / a.Channels
+}
+
+// wavChunk is a RIFF chunk of a WAV file other than fmt and data
+type wavChunk struct {
+	ID   string
+	Data []byte
+}
+
+// readWAVFile reads an integer PCM or 32-bit float WAV file
+func readWAVFile(path string) (*pcmAudio, []wavChunk, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseWAV(data)
+}
+
+// parseWAV decodes integer PCM or 32-bit float audio from a WAV file. Chunks
+// other than fmt and data are returned as they are.
+func parseWAV(data []byte) (*pcmAudio, []wavChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, nil, errors.New("not a RIFF WAVE file")
+	}
+
+	var audio *pcmAudio
+	var float bool
+	var chunks []wavChunk
+	var pcm []byte
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := data[pos+8:]
+		// Streams written to a pipe don't know their size up front
+		if size > len(body) || (id == "data" && size == 0) {
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, nil, errors.New("short fmt chunk")
+			}
+			format := binary.LittleEndian.Uint16(body[0:2])
+			if format == wavFormatExtensible && len(body) >= 26 {
+				format = binary.LittleEndian.Uint16(body[24:26])
+			}
+			if format != wavFormatPCM && format != wavFormatFloat {
+				return nil, nil, fmt.Errorf("unsupported WAV format %d, only integer PCM and float are supported", format)
+			}
+			float = format == wavFormatFloat
+			audio = &pcmAudio{
+				Channels:      int(binary.LittleEndian.Uint16(body[2:4])),
+				SampleRate:    int(binary.LittleEndian.Uint32(body[4:8])),
+				BitsPerSample: int(binary.LittleEndian.Uint16(body[14:16])),
+			}
+		case "data":
+			pcm = body
+		case "fact":
+			// Only meaningful for the format it was written with
+		default:
+			chunks = append(chunks, wavChunk{ID: id, Data: append([]byte(nil), body...)})
+		}
+		// Chunks are padded to an even size
+		pos += 8 + size + size%2
+	}
+
+	if audio == nil || pcm == nil {
+		return nil, nil, errors.New("missing fmt or data chunk")
+	}
+	if audio.Channels < 1 || audio.BitsPerSample < 8 || audio.BitsPerSample > 32 || audio.BitsPerSample%8 != 0 || (float && audio.BitsPerSample != 32) {
+		return nil, nil, fmt.Errorf("unsupported WAV layout: %d channels, %d bits", audio.Channels, audio.BitsPerSample)
+	}
+
+	if float {
+		count := len(pcm) / 4
+		count -= count % audio.Channels
+		audio.Float = make([]float32, count)
+		for i := range audio.Float {
+			audio.Float[i] = math.Float32frombits(binary.LittleEndian.Uint32(pcm[i*4:]))
+		}
+		return audio, chunks, nil
+	}
+
+	width := audio.BitsPerSample / 8
+	count := len(pcm) / width
+	count -= count % audio.Channels
+	audio.Samples = make([]int32, count)
+	for i := range audio.Samples {
+		b := pcm[i*width : (i+1)*width]
+		switch width {
+		case 1:
+			// 8-bit WAV is unsigned
+			audio.Samples[i] = int32(b[0]) - 128
+		case 2:
+			audio.Samples[i] = int32(int16(binary.LittleEndian.Uint16(b)))
+		case 3:
+			audio.Samples[i] = int32(uint32(b[0])|uint32(b[1])<<8|uint32(b[2])<<16) << 8 >> 8
+		case 4:
+			audio.Samples[i] = int32(binary.LittleEndian.Uint32(b))
+		}
+	}
+	return audio, chunks, nil
+}
+
+// writeWAV writes integer PCM, or float audio as 32-bit float, as a WAV file
+// with the given extra chunks placed after the data chunk
+func writeWAV(w io.Writer, audio *pcmAudio, chunks []wavChunk) error {
+	if audio.Float != nil {
+		return writeFloatWAV(w, audio.SampleRate, splitChannels(audio), chunks)
+	}
+	width := audio.BitsPerSample / 8
+	dataSize := len(audio.Samples) * width
+
+	extraSize := 0
+	for _, chunk := range chunks {
+		extraSize += 8 + len(chunk.Data) + len(chunk.Data)%2
+	}
+
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(36+dataSize+dataSize%2+extraSize))
+	copy(header[8:16], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], wavFormatPCM)
+	binary.LittleEndian.PutUint16(header[22:24], uint16(audio.Channels))
+	binary.LittleEndian.PutUint32(header[24:28], uint32(audio.SampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(audio.SampleRate*audio.Channels*width))
+	binary.LittleEndian.PutUint16(header[32:34], uint16(audio.Channels*width))
+	binary.LittleEndian.PutUint16(header[34:36], uint16(audio.BitsPerSample))
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], uint32(dataSize))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	pcm := make([]byte, dataSize+dataSize%2)
+	for i, sample := range audio.Samples {
+		b := pcm[i*width : (i+1)*width]
+		switch width {
+		case 1:
+			b[0] = byte(sample + 128)
+		case 2:
+			binary.LittleEndian.PutUint16(b, uint16(sample))
+		case 3:
+			b[0], b[1], b[2] = byte(sample), byte(sample>>8), byte(sample>>16)
+		case 4:
+			binary.LittleEndian.PutUint32(b, uint32(sample))
+		}
+	}
+	if _, err := w.Write(pcm); err != nil {
+		return err
+	}
+
+	var extra []byte
+	for _, chunk := range chunks {
+		extra = appendWAVChunk(extra, chunk)
+	}
+	if _, err := w.Write(extra); err != nil {
+		return err
+	}
+	return nil
+}
+
+// appendWAVChunk appends a chunk with its header and padding byte
+func appendWAVChunk(buf []byte, chunk wavChunk) []byte {
+	buf = append(buf, chunk.ID...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(chunk.Data)))
+	buf = append(buf, chunk.Data...)
+	if len(chunk.Data)%2 == 1 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// replaceWAVChunks returns the WAV file with the chunks that have the IDs of
+// the given ones replaced by them, and the others appended. The audio is
+// copied as it is, whatever its format.
+func replaceWAVChunks(data []byte, chunks []wavChunk) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("not a RIFF WAVE file")
+	}
+	replaced := make(map[string]bool, len(chunks))
+	for _, chunk := range chunks {
+		replaced[chunk.ID] = true
+	}
+
+	body := []byte("WAVE")
+	hasData := false
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		if size > len(data)-pos-8 || (id == "data" && size == 0) {
+			size = len(data) - pos - 8
+		}
+		if !replaced[id] {
+			body = appendWAVChunk(body, wavChunk{ID: id, Data: data[pos+8 : pos+8+size]})
+		}
+		hasData = hasData || id == "data"
+		pos += 8 + size + size%2
+	}
+	if !hasData {
+		return nil, errors.New("missing data chunk")
+	}
+	for _, chunk := range chunks {
+		body = appendWAVChunk(body, chunk)
+	}
+
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	return append(out, body...), nil
+}
+
+// rewriteWAVChunks replaces or adds chunks in a WAV file on disk
+func rewriteWAVChunks(path string, chunks []wavChunk) error {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	rewritten, err := replaceWAVChunks(data, chunks)
+	if err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, rewritten, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// writeWAVFile replaces a WAV file on disk with the given audio and chunks
+func writeWAVFile(path string, audio *pcmAudio, chunks []wavChunk) error {
+	var buf bytes.Buffer
+	if err := writeWAV(&buf, audio, chunks); err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// writeFloatWAV writes 32-bit float audio, one slice per channel, as a WAV
+// file with the given extra chunks placed after the data chunk
+func writeFloatWAV(w io.Writer, sampleRate int, channels [][]float64, chunks []wavChunk) error {
+	frames := 0
+	if len(channels) > 0 {
+		frames = len(channels[0])
+	}
+	blockAlign := len(channels) * 4
+
+	format := make([]byte, 18)
+	binary.LittleEndian.PutUint16(format[0:2], wavFormatFloat)
+	binary.LittleEndian.PutUint16(format[2:4], uint16(len(channels)))
+	binary.LittleEndian.PutUint32(format[4:8], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(format[8:12], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(format[12:14], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(format[14:16], 32)
+
+	data := make([]byte, frames*blockAlign)
+	for ch, signal := range channels {
+		for i, s := range signal {
+			binary.LittleEndian.PutUint32(data[i*blockAlign+ch*4:], math.Float32bits(float32(s)))
+		}
+	}
+
+	body := []byte("WAVE")
+	body = appendWAVChunk(body, wavChunk{ID: "fmt ", Data: format})
+	// Formats other than PCM need the frame count in a fact chunk
+	body = appendWAVChunk(body, wavChunk{ID: "fact", Data: binary.LittleEndian.AppendUint32(nil, uint32(frames))})
+	body = appendWAVChunk(body, wavChunk{ID: "data", Data: data})
+	for _, chunk := range chunks {
+		body = appendWAVChunk(body, chunk)
+	}
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	_, err := w.Write(append(out, body...))
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWAVRoundTrip(t *testing.T) {
+	for _, bps := range []int{8, 16, 24, 32} {
+		audio := &pcmAudio{SampleRate: 44100, Channels: 2, BitsPerSample: bps}
+		peak := int32(int64(1)<<(bps-1) - 1)
+		audio.Samples = []int32{0, 1, -1, peak, -peak - 1, peak / 3}
+
+		chunks := []wavChunk{{ID: "smpl", Data: []byte{1, 2, 3}}}
+		var buf bytes.Buffer
+		if err := writeWAV(&buf, audio, chunks); err != nil {
+			t.Fatalf("writeWAV returned an error: %v", err)
+		}
+		got, gotChunks, err := parseWAV(buf.Bytes())
+		if err != nil {
+			t.Fatalf("parseWAV returned an error for %d bits: %v", bps, err)
+		}
+		if got.SampleRate != 44100 || got.Channels != 2 || got.BitsPerSample != bps {
+			t.Errorf("Unexpected format %+v", got)
+		}
+		if len(got.Samples) != len(audio.Samples) {
+			t.Fatalf("Expected %d samples, got %d", len(audio.Samples), len(got.Samples))
+		}
+		for i := range got.Samples {
+			if got.Samples[i] != audio.Samples[i] {
+				t.Errorf("%d bits: sample %d is %d, expected %d", bps, i, got.Samples[i], audio.Samples[i])
+			}
+		}
+		if len(gotChunks) != 1 || gotChunks[0].ID != "smpl" || !bytes.Equal(gotChunks[0].Data, chunks[0].Data) {
+			t.Errorf("Expected the smpl chunk to be kept, got %+v", gotChunks)
+		}
+	}
+}
+
+func TestFloatWAVRoundTrip(t *testing.T) {
+	audio := &pcmAudio{SampleRate: 48000, Channels: 2, BitsPerSample: 32, Float: []float32{0, 0.5, -1, 1.25, -0.125, 1e-6}}
+	var buf bytes.Buffer
+	if err := writeWAV(&buf, audio, []wavChunk{{ID: "smpl", Data: []byte{1, 2}}}); err != nil {
+		t.Fatalf("writeWAV returned an error: %v", err)
+	}
+	got, chunks, err := parseWAV(buf.Bytes())
+	if err != nil {
+		t.Fatalf("parseWAV returned an error: %v", err)
+	}
+	if got.Samples != nil || got.frames() != 3 || got.Channels != 2 || got.BitsPerSample != 32 {
+		t.Fatalf("Expected 3 frames of float audio, got %+v", got)
+	}
+	for i := range got.Float {
+		if got.Float[i] != audio.Float[i] {
+			t.Errorf("Sample %d is %g, expected %g", i, got.Float[i], audio.Float[i])
+		}
+	}
+	if len(chunks) != 1 || chunks[0].ID != "smpl" {
+		t.Errorf("Expected the smpl chunk to be kept, got %+v", chunks)
+	}
+}
+
+func TestParseWAVFromPipe(t *testing.T) {
+	audio := &pcmAudio{SampleRate: 48000, Channels: 1, BitsPerSample: 16, Samples: []int32{5, -5, 7}}
+	var buf bytes.Buffer
+	if err := writeWAV(&buf, audio, nil); err != nil {
+		t.Fatalf("writeWAV returned an error: %v", err)
+	}
+	// Streams written to a pipe leave the sizes at 0
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[4:8], 0)
+	binary.LittleEndian.PutUint32(data[40:44], 0)
+
+	got, _, err := parseWAV(data)
+	if err != nil {
+		t.Fatalf("parseWAV returned an error: %v", err)
+	}
+	if len(got.Samples) != 3 || got.Samples[2] != 7 {
+		t.Errorf("Expected the samples up to the end of the stream, got %v", got.Samples)
+	}
+
+	for _, invalid := range [][]byte{[]byte("RIFF subsong 1"), data[:36]} {
+		if _, _, err := parseWAV(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}